@@ -0,0 +1,33 @@
+package blobstore
+
+import (
+	"io"
+)
+
+// A BlobStore stores blobs named by their hashes, such as the files in a ZAP folder. A name may end in a suffix, such
+// as ".zst", which is kept. Missing blobs give errors matching fs.ErrNotExist.
+type BlobStore interface {
+	// Put stores everything read from reader, replacing any blob of the same name. Nothing is stored if reading fails.
+	Put(name string, reader io.Reader) error
+	Get(name string) (io.ReadCloser, error)
+	// Stat returns the size of a blob
+	Stat(name string) (int64, error)
+	Delete(name string) error
+	// List calls visit with the name and size of every blob, stopping at the first error it returns
+	List(visit func(name string, size int64) error) error
+	// ListStrays calls visit with the path of every file in the bucket directories which is not a blob, such as a
+	// temporary file left behind by a crash or a blob in another layout, stopping at the first error it returns
+	ListStrays(visit func(relativePath string, size int64) error) error
+
+	// ReadFile and WriteFile read and write small files kept alongside the blobs, such as settings, which are not
+	// named by hash
+	ReadFile(name string) ([]byte, error)
+	WriteFile(name string, data []byte) error
+
+	// Location describes where a blob is stored, for messages
+	Location(name string) string
+
+	Layout() Layout
+	// WithLayout returns a store for the same place which lays blobs out differently
+	WithLayout(layout Layout) BlobStore
+}
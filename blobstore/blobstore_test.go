@@ -0,0 +1,234 @@
+package blobstore
+
+import (
+	"bytes"
+	"data-tools/blobstore/fakes3"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func newTestS3(t *testing.T) *S3 {
+	store, err := NewS3(S3Options{
+		Endpoint:  fakes3.NewServer(t, "zap"),
+		Region:    "us-east-1",
+		AccessKey: "access",
+		SecretKey: "secret",
+		Insecure:  true,
+		Bucket:    "zap",
+		Prefix:    "data-tools/",
+	})
+	assert.NoError(t, err)
+
+	return store
+}
+
+func testBlobStore(t *testing.T, store BlobStore) {
+	_, err := store.Stat("abcdef")
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+
+	_, err = store.Get("abcdef")
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+
+	assert.NoError(t, store.Put("abcdef", strings.NewReader("hello")))
+	assert.NoError(t, store.Put("abcdef.zst", strings.NewReader("compressed")))
+	assert.NoError(t, store.Put("012345", bytes.NewReader(nil)))
+
+	size, err := store.Stat("abcdef")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), size)
+
+	reader, err := store.Get("abcdef")
+	assert.NoError(t, err)
+	data, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.NoError(t, reader.Close())
+	assert.Equal(t, "hello", string(data))
+
+	// A failed write does not leave anything behind
+	failed := io.MultiReader(strings.NewReader("partial"), &failingReader{})
+	assert.Error(t, store.Put("abcd99", failed))
+	_, err = store.Stat("abcd99")
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+
+	assert.NoError(t, store.WriteFile("settings.json", []byte("{}")))
+	settings, err := store.ReadFile("settings.json")
+	assert.NoError(t, err)
+	assert.Equal(t, "{}", string(settings))
+
+	var strays []string
+	err = store.ListStrays(func(relativePath string, size int64) error {
+		strays = append(strays, relativePath)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Empty(t, strays)
+
+	sizes := map[string]int64{}
+	err = store.List(func(name string, size int64) error {
+		sizes[name] = size
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int64{"abcdef": 5, "abcdef.zst": 10, "012345": 0}, sizes)
+
+	assert.NoError(t, store.Delete("abcdef"))
+	_, err = store.Stat("abcdef")
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+
+	var names []string
+	err = store.List(func(name string, size int64) error {
+		names = append(names, name)
+		return nil
+	})
+	assert.NoError(t, err)
+	sort.Strings(names)
+	assert.Equal(t, []string{"012345", "abcdef.zst"}, names)
+}
+
+type failingReader struct{}
+
+func (r *failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("read failed")
+}
+
+func TestLocal(t *testing.T) {
+	// Nothing is created until something is stored
+	store := NewLocal(path.Join(t.TempDir(), "ZAP"))
+	assert.NoError(t, store.List(func(name string, size int64) error {
+		return errors.New("empty stores have nothing to list")
+	}))
+
+	testBlobStore(t, store)
+
+	assert.Equal(t, path.Join(store.BasePath(), "ab", "cd", "ef.zst"), store.Location("abcdef.zst"))
+
+	entries, err := os.ReadDir(store.BasePath())
+	assert.NoError(t, err)
+	assert.Len(t, entries, 3) // ab, 01 and settings.json
+
+	// Files in the bucket directories which are not blobs are strays, and are not listed as blobs
+	assert.NoError(t, os.WriteFile(path.Join(store.BasePath(), "ab", "cd", ".data-tools-123"), []byte("partial"), 0600))
+	assert.NoError(t, os.WriteFile(path.Join(store.BasePath(), "ab", "notes.txt"), nil, 0600))
+
+	strays := map[string]int64{}
+	err = store.ListStrays(func(relativePath string, size int64) error {
+		strays[relativePath] = size
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int64{"ab/cd/.data-tools-123": 7, "ab/notes.txt": 0}, strays)
+
+	var names []string
+	err = store.List(func(name string, size int64) error {
+		names = append(names, name)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Len(t, names, 2)
+}
+
+func TestLocalWithLayout(t *testing.T) {
+	store := NewLocal(t.TempDir()).WithLayout(Layout{Depth: 1, Width: 3})
+	assert.NoError(t, store.Put("abcdef", strings.NewReader("hello")))
+	assert.Equal(t, path.Join(store.(*Local).BasePath(), "abc", "def"), store.Location("abcdef"))
+
+	// Blobs are only found in the layout they were stored in
+	var names []string
+	err := store.WithLayout(DefaultLayout).List(func(name string, size int64) error {
+		names = append(names, name)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Empty(t, names)
+
+	_, err = store.WithLayout(DefaultLayout).Stat("abcdef")
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+}
+
+func TestLayout(t *testing.T) {
+	assert.Equal(t, "ab/cd/ef0123", DefaultLayout.RelativePath("abcdef0123"))
+	assert.Equal(t, "a/b/c/def0123", Layout{Depth: 3, Width: 1}.RelativePath("abcdef0123"))
+	assert.Equal(t, "abcd/ef0123", Layout{Depth: 1, Width: 4}.RelativePath("abcdef0123"))
+
+	name, isBlob := DefaultLayout.nameFromRelativePath("ab/cd/ef0123.zst")
+	assert.True(t, isBlob)
+	assert.Equal(t, "abcdef0123.zst", name)
+
+	for _, relativePath := range []string{"layout.json", "ab/ef0123", "ab/cd/ef/0123", "abc/cd/ef0123", "xy/cd/ef0123", "ab/cd/.data-tools-123", "ab/cd/notes.txt"} {
+		_, isBlob = DefaultLayout.nameFromRelativePath(relativePath)
+		assert.False(t, isBlob, relativePath)
+	}
+
+	assert.True(t, isStray(DefaultLayout, "ab/cd/.data-tools-123"))
+	assert.True(t, isStray(DefaultLayout, "ab/ef0123"))
+	assert.False(t, isStray(DefaultLayout, "ab/cd/ef0123"))
+	assert.False(t, isStray(DefaultLayout, "layout.json"))
+
+	assert.NoError(t, DefaultLayout.Validate())
+	assert.Error(t, Layout{Depth: 0, Width: 2}.Validate())
+	assert.Error(t, Layout{Depth: 2, Width: 5}.Validate())
+}
+
+func TestManifest(t *testing.T) {
+	store := NewLocal(t.TempDir())
+
+	manifest, err := ReadManifest(store)
+	assert.NoError(t, err)
+	assert.Nil(t, manifest)
+
+	target := Layout{Depth: 1, Width: 3}
+	written := NewManifest(DefaultLayout)
+	written.RelayoutTo = &target
+	assert.NoError(t, WriteManifest(store, written))
+
+	manifest, err = ReadManifest(store)
+	assert.NoError(t, err)
+	assert.Equal(t, written, manifest)
+
+	assert.NoError(t, store.WriteFile(ManifestFileName, []byte(`{"version": 1, "depth": 9, "width": 2}`)))
+	_, err = ReadManifest(store)
+	assert.Error(t, err)
+}
+
+func TestS3(t *testing.T) {
+	store := newTestS3(t)
+	testBlobStore(t, store)
+
+	assert.Equal(t, "s3://zap/data-tools/ab/cd/ef.zst", store.Location("abcdef.zst"))
+
+	// Blobs larger than a part are uploaded in parts
+	large := bytes.Repeat([]byte{1, 2, 3}, s3PartSize/2)
+	assert.NoError(t, store.Put("fedcba", bytes.NewReader(large)))
+
+	reader, err := store.Get("fedcba")
+	assert.NoError(t, err)
+	data, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.NoError(t, reader.Close())
+	assert.Equal(t, large, data)
+}
+
+func TestParseS3URL(t *testing.T) {
+	bucket, prefix, isS3 := ParseS3URL("s3://zap/data-tools/ZAP")
+	assert.True(t, isS3)
+	assert.Equal(t, "zap", bucket)
+	assert.Equal(t, "data-tools/ZAP", prefix)
+
+	bucket, prefix, isS3 = ParseS3URL("s3://zap")
+	assert.True(t, isS3)
+	assert.Equal(t, "zap", bucket)
+	assert.Equal(t, "", prefix)
+
+	_, _, isS3 = ParseS3URL("/mnt/ZAP")
+	assert.False(t, isS3)
+
+	_, _, isS3 = ParseS3URL("s3:///ZAP")
+	assert.False(t, isS3)
+}
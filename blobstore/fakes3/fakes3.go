@@ -0,0 +1,100 @@
+// Package fakes3 runs an in-memory S3 server for tests, so the S3 blob store can be tested without a MinIO
+package fakes3
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// NewServer starts a server with an empty bucket, which is stopped when the test finishes. It returns the endpoint to
+// connect to over HTTP.
+func NewServer(t *testing.T, bucket string) string {
+	backend := s3mem.New()
+	err := backend.CreateBucket(bucket)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(decodeChunkedUploads(gofakes3.New(backend).Server()))
+	t.Cleanup(server.Close)
+
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+// decodeChunkedUploads turns uploads signed in chunks, as clients send over HTTP, into plain uploads, as the fake does
+// not understand every variant
+func decodeChunkedUploads(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := decodeChunks(bufio.NewReader(r.Body))
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+		r.TransferEncoding = nil
+		r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		r.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+		r.Header.Del("Content-Encoding")
+		r.Header.Del("X-Amz-Decoded-Content-Length")
+		r.Header.Del("X-Amz-Trailer")
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// decodeChunks reads chunks of the form "<hex size>;chunk-signature=<signature>\r\n<data>\r\n" until the empty one,
+// ignoring any trailing checksums
+func decodeChunks(reader *bufio.Reader) ([]byte, error) {
+	var body bytes.Buffer
+
+	for {
+		header, err := reader.ReadString('\n')
+
+		if err != nil {
+			return nil, err
+		}
+
+		sizeText, _, _ := strings.Cut(strings.TrimSpace(header), ";")
+		size, err := strconv.ParseInt(sizeText, 16, 64)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid chunk header \"%s\"", header)
+		}
+
+		if size == 0 {
+			return body.Bytes(), nil
+		}
+
+		_, err = io.CopyN(&body, reader, size)
+
+		if err != nil {
+			return nil, err
+		}
+
+		end := make([]byte, 2)
+		_, err = io.ReadFull(reader, end)
+
+		if err != nil || string(end) != "\r\n" {
+			return nil, errors.New("chunk is not followed by a line break")
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package blobstore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// ManifestFileName is kept at the top of a store to record how its blobs are laid out
+const ManifestFileName = "layout.json"
+
+// A Layout spreads blobs between buckets named after the start of their names, so that no one directory holds too
+// many. Each level of buckets is named after the next Width characters of a name.
+type Layout struct {
+	Depth int `json:"depth"`
+	Width int `json:"width"`
+}
+
+// DefaultLayout has 65,536 buckets from 00/00 to ff/ff, and is the layout of stores from before layouts were recorded
+var DefaultLayout = Layout{Depth: 2, Width: 2}
+
+func (l Layout) Validate() error {
+	if l.Depth < 1 || l.Depth > 4 {
+		return fmt.Errorf("the depth of a layout must be between 1 and 4, not %d", l.Depth)
+	}
+
+	if l.Width < 1 || l.Width > 4 {
+		return fmt.Errorf("the width of a layout must be between 1 and 4, not %d", l.Width)
+	}
+
+	return nil
+}
+
+func (l Layout) String() string {
+	return fmt.Sprintf("depth %d, width %d", l.Depth, l.Width)
+}
+
+// RelativePath is where a blob is stored relative to the top of a store
+func (l Layout) RelativePath(name string) string {
+	parts := make([]string, 0, l.Depth+1)
+
+	for level := 0; level < l.Depth; level++ {
+		parts = append(parts, name[level*l.Width:(level+1)*l.Width])
+	}
+
+	return path.Join(append(parts, name[l.Depth*l.Width:])...)
+}
+
+// nameFromRelativePath reverses RelativePath, returning false for paths which are not those of blobs. A blob's name is
+// hex, apart from any suffix.
+func (l Layout) nameFromRelativePath(relativePath string) (string, bool) {
+	parts := strings.Split(relativePath, "/")
+
+	if len(parts) != l.Depth+1 {
+		return "", false
+	}
+
+	stem, _, _ := strings.Cut(parts[l.Depth], ".")
+
+	if !isHex(stem) {
+		return "", false
+	}
+
+	for _, bucket := range parts[:l.Depth] {
+		if len(bucket) != l.Width || !isHex(bucket) {
+			return "", false
+		}
+	}
+
+	return strings.Join(parts, ""), true
+}
+
+// isStray is true for files in the bucket directories which are not blobs. Files alongside the bucket directories,
+// such as the manifest, are not strays.
+func isStray(layout Layout, relativePath string) bool {
+	_, isBlob := layout.nameFromRelativePath(relativePath)
+	return !isBlob && strings.Contains(relativePath, "/")
+}
+
+func isHex(value string) bool {
+	return len(value) > 0 && strings.Trim(value, "0123456789abcdef") == ""
+}
+
+// A Manifest records the layout of a store. While a store is being moved to another layout, RelayoutTo is that layout.
+type Manifest struct {
+	Version int `json:"version"`
+	Layout
+	RelayoutTo *Layout `json:"relayout_to,omitempty"`
+}
+
+func NewManifest(layout Layout) *Manifest {
+	return &Manifest{Version: 1, Layout: layout}
+}
+
+// ReadManifest returns nil if the store has no manifest
+func ReadManifest(store BlobStore) (*Manifest, error) {
+	data, err := store.ReadFile(ManifestFileName)
+
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &Manifest{}
+	err = json.Unmarshal(data, manifest)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid \"%s\": %w", ManifestFileName, err)
+	}
+
+	if manifest.Version != 1 {
+		return nil, fmt.Errorf("unknown \"%s\" version %d", ManifestFileName, manifest.Version)
+	}
+
+	err = manifest.Layout.Validate()
+
+	if err == nil && manifest.RelayoutTo != nil {
+		err = manifest.RelayoutTo.Validate()
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid \"%s\": %w", ManifestFileName, err)
+	}
+
+	return manifest, nil
+}
+
+func WriteManifest(store BlobStore, manifest *Manifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	return store.WriteFile(ManifestFileName, data)
+}
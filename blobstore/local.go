@@ -0,0 +1,191 @@
+package blobstore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// Local stores blobs in a folder on the local filesystem. Bucket directories are only created when something is first
+// stored in them.
+type Local struct {
+	basePath string
+	layout   Layout
+}
+
+// NewLocal returns a store with the default layout
+func NewLocal(basePath string) *Local {
+	return &Local{basePath: basePath, layout: DefaultLayout}
+}
+
+func (l *Local) BasePath() string {
+	return l.basePath
+}
+
+// Path is where a blob is stored, which lets callers move and link files rather than copy them
+func (l *Local) Path(name string) string {
+	return path.Join(l.basePath, l.layout.RelativePath(name))
+}
+
+// CreateBucket creates the directory a blob is stored in, for callers which write to Path themselves
+func (l *Local) CreateBucket(name string) error {
+	return os.MkdirAll(filepath.Dir(l.Path(name)), 0700)
+}
+
+func (l *Local) Put(name string, reader io.Reader) error {
+	return writeFileAtomically(l.Path(name), func(file *os.File) error {
+		_, err := io.Copy(file, reader)
+		return err
+	})
+}
+
+func (l *Local) Get(name string) (io.ReadCloser, error) {
+	file, err := os.Open(path.Clean(l.Path(name)))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return file, nil
+}
+
+func (l *Local) Stat(name string) (int64, error) {
+	info, err := os.Stat(l.Path(name))
+
+	if err != nil {
+		return 0, err
+	}
+
+	if info.IsDir() {
+		return 0, fmt.Errorf("\"%s\" is a directory", l.Path(name))
+	}
+
+	return info.Size(), nil
+}
+
+func (l *Local) Delete(name string) error {
+	return os.Remove(l.Path(name))
+}
+
+func (l *Local) List(visit func(name string, size int64) error) error {
+	return l.walk(func(relativePath string, size int64) error {
+		name, isBlob := l.layout.nameFromRelativePath(relativePath)
+
+		if !isBlob {
+			return nil
+		}
+
+		return visit(name, size)
+	})
+}
+
+func (l *Local) ListStrays(visit func(relativePath string, size int64) error) error {
+	return l.walk(func(relativePath string, size int64) error {
+		if !isStray(l.layout, relativePath) {
+			return nil
+		}
+
+		return visit(relativePath, size)
+	})
+}
+
+// walk calls visit with the slash separated path of every file relative to basePath
+func (l *Local) walk(visit func(relativePath string, size int64) error) error {
+	// Nothing has been stored yet
+	if _, err := os.Stat(l.basePath); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	return filepath.WalkDir(l.basePath, func(filePath string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if entry.IsDir() {
+			return nil
+		}
+
+		relativePath, err := filepath.Rel(l.basePath, filePath)
+
+		if err != nil {
+			return err
+		}
+
+		info, err := entry.Info()
+
+		if err != nil {
+			return err
+		}
+
+		return visit(filepath.ToSlash(relativePath), info.Size())
+	})
+}
+
+func (l *Local) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(path.Join(l.basePath, name))
+}
+
+func (l *Local) WriteFile(name string, data []byte) error {
+	return writeFileAtomically(path.Join(l.basePath, name), func(file *os.File) error {
+		_, err := file.Write(data)
+		return err
+	})
+}
+
+func (l *Local) Location(name string) string {
+	return l.Path(name)
+}
+
+func (l *Local) Layout() Layout {
+	return l.layout
+}
+
+func (l *Local) WithLayout(layout Layout) BlobStore {
+	return &Local{basePath: l.basePath, layout: layout}
+}
+
+// writeFileAtomically writes to a temporary file first, so that a file is never seen half written. Concurrent writes
+// of the same blob write the same contents, so whichever is renamed last does not matter. If write fails the file is
+// not written, and its error is returned. The directory is created if need be.
+func writeFileAtomically(filePath string, write func(file *os.File) error) error {
+	file, err := os.CreateTemp(filepath.Dir(filePath), ".data-tools-*")
+
+	if errors.Is(err, fs.ErrNotExist) {
+		err = os.MkdirAll(filepath.Dir(filePath), 0700)
+
+		if err == nil {
+			file, err = os.CreateTemp(filepath.Dir(filePath), ".data-tools-*")
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	err = write(file)
+
+	if err == nil {
+		err = file.Sync()
+	}
+
+	closeErr := file.Close()
+
+	if err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(file.Name(), filePath)
+	}
+
+	if err != nil {
+		_ = os.Remove(file.Name())
+		return err
+	}
+
+	return nil
+}
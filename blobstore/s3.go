@@ -0,0 +1,223 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// s3PartSize is how much of a blob is held in memory at a time when uploading, as blobs are streamed without their size
+// being known up front
+const s3PartSize = 16 * 1024 * 1024
+
+type S3Options struct {
+	Endpoint  string
+	Region    string
+	AccessKey string
+	SecretKey string
+	Insecure  bool // Use HTTP rather than HTTPS, such as for a local MinIO
+	Bucket    string
+	Prefix    string
+}
+
+// S3 stores blobs in an S3 compatible object store, laid out as Local lays out files under an optional prefix
+type S3 struct {
+	client *minio.Client
+	bucket string
+	prefix string
+	layout Layout
+}
+
+// NewS3 returns a store with the default layout
+func NewS3(options S3Options) (*S3, error) {
+	client, err := minio.New(options.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(options.AccessKey, options.SecretKey, ""),
+		Secure: !options.Insecure,
+		Region: options.Region,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &S3{
+		client: client,
+		bucket: options.Bucket,
+		prefix: strings.Trim(options.Prefix, "/"),
+		layout: DefaultLayout,
+	}, nil
+}
+
+// ParseS3URL splits an s3://bucket/prefix URL, returning false if location is not one
+func ParseS3URL(location string) (string, string, bool) {
+	rest, isS3 := strings.CutPrefix(location, "s3://")
+
+	if !isS3 {
+		return "", "", false
+	}
+
+	bucket, prefix, _ := strings.Cut(rest, "/")
+	return bucket, prefix, len(bucket) > 0
+}
+
+func (s *S3) key(name string) string {
+	return path.Join(s.prefix, s.layout.RelativePath(name))
+}
+
+func (s *S3) Put(name string, reader io.Reader) error {
+	// Most blobs fit in one part, and uploading those in one request is much quicker than a multipart upload
+	start, err := io.ReadAll(io.LimitReader(reader, s3PartSize))
+
+	if err != nil {
+		return err
+	}
+
+	if len(start) < s3PartSize {
+		_, err = s.client.PutObject(context.Background(), s.bucket, s.key(name), bytes.NewReader(start), int64(len(start)), minio.PutObjectOptions{})
+		return s.translateError(s.key(name), err)
+	}
+
+	_, err = s.client.PutObject(context.Background(), s.bucket, s.key(name), io.MultiReader(bytes.NewReader(start), reader), -1, minio.PutObjectOptions{PartSize: s3PartSize})
+	return s.translateError(s.key(name), err)
+}
+
+func (s *S3) Get(name string) (io.ReadCloser, error) {
+	object, err := s.client.GetObject(context.Background(), s.bucket, s.key(name), minio.GetObjectOptions{})
+
+	if err != nil {
+		return nil, s.translateError(s.key(name), err)
+	}
+
+	// Objects are only requested when first used, so this is where a missing blob is found
+	_, err = object.Stat()
+
+	if err != nil {
+		_ = object.Close()
+		return nil, s.translateError(s.key(name), err)
+	}
+
+	return object, nil
+}
+
+func (s *S3) Stat(name string) (int64, error) {
+	info, err := s.client.StatObject(context.Background(), s.bucket, s.key(name), minio.StatObjectOptions{})
+
+	if err != nil {
+		return 0, s.translateError(s.key(name), err)
+	}
+
+	return info.Size, nil
+}
+
+func (s *S3) Delete(name string) error {
+	err := s.client.RemoveObject(context.Background(), s.bucket, s.key(name), minio.RemoveObjectOptions{})
+	return s.translateError(s.key(name), err)
+}
+
+func (s *S3) List(visit func(name string, size int64) error) error {
+	return s.walk(func(relativePath string, size int64) error {
+		name, isBlob := s.layout.nameFromRelativePath(relativePath)
+
+		if !isBlob {
+			return nil
+		}
+
+		return visit(name, size)
+	})
+}
+
+func (s *S3) ListStrays(visit func(relativePath string, size int64) error) error {
+	return s.walk(func(relativePath string, size int64) error {
+		if !isStray(s.layout, relativePath) {
+			return nil
+		}
+
+		return visit(relativePath, size)
+	})
+}
+
+// walk calls visit with the key of every object under the prefix, relative to it
+func (s *S3) walk(visit func(relativePath string, size int64) error) error {
+	prefix := ""
+
+	if len(s.prefix) > 0 {
+		prefix = s.prefix + "/"
+	}
+
+	listContext, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for object := range s.client.ListObjects(listContext, s.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if object.Err != nil {
+			return object.Err
+		}
+
+		err := visit(strings.TrimPrefix(object.Key, prefix), object.Size)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *S3) ReadFile(name string) ([]byte, error) {
+	key := path.Join(s.prefix, name)
+	object, err := s.client.GetObject(context.Background(), s.bucket, key, minio.GetObjectOptions{})
+
+	if err != nil {
+		return nil, s.translateError(key, err)
+	}
+
+	defer object.Close()
+
+	data, err := io.ReadAll(object)
+
+	if err != nil {
+		return nil, s.translateError(key, err)
+	}
+
+	return data, nil
+}
+
+func (s *S3) WriteFile(name string, data []byte) error {
+	key := path.Join(s.prefix, name)
+	_, err := s.client.PutObject(context.Background(), s.bucket, key, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{})
+	return s.translateError(key, err)
+}
+
+func (s *S3) Location(name string) string {
+	return s.url(s.key(name))
+}
+
+func (s *S3) Layout() Layout {
+	return s.layout
+}
+
+func (s *S3) WithLayout(layout Layout) BlobStore {
+	return &S3{client: s.client, bucket: s.bucket, prefix: s.prefix, layout: layout}
+}
+
+func (s *S3) url(key string) string {
+	return fmt.Sprintf("s3://%s/%s", s.bucket, key)
+}
+
+// translateError makes errors for missing objects match fs.ErrNotExist, as they do for Local
+func (s *S3) translateError(key string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return fmt.Errorf("\"%s\": %w", s.url(key), fs.ErrNotExist)
+	}
+
+	return fmt.Errorf("\"%s\": %w", s.url(key), err)
+}
@@ -0,0 +1,132 @@
+package chunker
+
+import (
+	"errors"
+	"io"
+	"math/bits"
+)
+
+// MinAverageSize keeps chunks large enough to be worth storing separately
+const MinAverageSize = 256
+
+// gear is a table of random numbers which the rolling hash adds one of for each byte. The table only needs to be
+// random looking, and must never change, as chunk boundaries (and so which chunks are shared) depend on it.
+var gear = func() [256]uint64 {
+	var table [256]uint64
+	state := uint64(0x6461746120746f6f) // SplitMix64
+
+	for index := range table {
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[index] = z ^ (z >> 31)
+	}
+
+	return table
+}()
+
+// A Chunker splits a stream into content-defined chunks using FastCDC, so that an insertion or deletion only changes
+// the chunks around it rather than every chunk after it.
+// See https://www.usenix.org/conference/atc16/technical-sessions/presentation/xia
+type Chunker struct {
+	reader  io.Reader
+	buffer  []byte
+	start   int
+	end     int
+	eof     bool
+	minSize int
+	avgSize int
+	maxSize int
+	maskS   uint64 // Harder to match, used before the average size is reached
+	maskL   uint64 // Easier to match, used after the average size is reached
+}
+
+// IsValidAverageSize is true for powers of two of at least MinAverageSize
+func IsValidAverageSize(averageSize int) bool {
+	return averageSize >= MinAverageSize && bits.OnesCount(uint(averageSize)) == 1
+}
+
+// New returns a Chunker with chunks averaging averageSize bytes, which must be a power of two
+func New(reader io.Reader, averageSize int) (*Chunker, error) {
+	if !IsValidAverageSize(averageSize) {
+		return nil, errors.New("the average chunk size must be a power of two of at least 256 bytes")
+	}
+
+	maskBits := bits.TrailingZeros(uint(averageSize))
+
+	return &Chunker{
+		reader:  reader,
+		buffer:  make([]byte, averageSize*8),
+		minSize: averageSize / 4,
+		avgSize: averageSize,
+		maxSize: averageSize * 8,
+		maskS:   highBits(maskBits + 2),
+		maskL:   highBits(maskBits - 2),
+	}, nil
+}
+
+// The rolling hash shifts left, so the highest bits depend on the most bytes
+func highBits(count int) uint64 {
+	return ^uint64(0) << (64 - count)
+}
+
+// Next returns the next chunk, or io.EOF once there are none left. The chunk is only valid until Next is called again.
+func (c *Chunker) Next() ([]byte, error) {
+	if !c.eof && c.end-c.start < c.maxSize {
+		// Move what is left to the start of the buffer, then fill the rest
+		c.end = copy(c.buffer, c.buffer[c.start:c.end])
+		c.start = 0
+
+		read, err := io.ReadFull(c.reader, c.buffer[c.end:])
+		c.end += read
+
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+
+	length := c.cut(c.buffer[c.start:c.end])
+	chunk := c.buffer[c.start : c.start+length]
+	c.start += length
+
+	return chunk, nil
+}
+
+// cut finds where the first chunk in data ends
+func (c *Chunker) cut(data []byte) int {
+	length := len(data)
+
+	if length <= c.minSize {
+		return length
+	}
+
+	length = min(length, c.maxSize)
+	normalSize := min(c.avgSize, length)
+	hash := uint64(0)
+	index := c.minSize
+
+	for ; index < normalSize; index++ {
+		hash = (hash << 1) + gear[data[index]]
+
+		if hash&c.maskS == 0 {
+			return index + 1
+		}
+	}
+
+	for ; index < length; index++ {
+		hash = (hash << 1) + gear[data[index]]
+
+		if hash&c.maskL == 0 {
+			return index + 1
+		}
+	}
+
+	return length
+}
@@ -0,0 +1,75 @@
+package chunker
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func getChunks(t *testing.T, data []byte, averageSize int) [][]byte {
+	c, err := New(bytes.NewReader(data), averageSize)
+	assert.NoError(t, err)
+
+	var chunks [][]byte
+
+	for {
+		chunk, err := c.Next()
+
+		if err == io.EOF {
+			return chunks
+		}
+
+		assert.NoError(t, err)
+		chunks = append(chunks, bytes.Clone(chunk))
+	}
+}
+
+func TestChunker(t *testing.T) {
+	data := make([]byte, 1024*1024)
+	random := rand.New(rand.NewSource(1))
+	random.Read(data)
+
+	chunks := getChunks(t, data, 4096)
+	assert.Equal(t, data, bytes.Join(chunks, nil))
+
+	for index, chunk := range chunks {
+		assert.LessOrEqual(t, len(chunk), 4096*8)
+
+		if index < len(chunks)-1 {
+			assert.Greater(t, len(chunk), 4096/4)
+		}
+	}
+
+	// Roughly the average size
+	assert.InDelta(t, len(data)/4096, len(chunks), float64(len(data)/4096/2))
+
+	// Inserting data part way through only changes the chunks around it
+	edited := append(bytes.Clone(data[:500000]), append([]byte("inserted"), data[500000:]...)...)
+	editedChunks := getChunks(t, edited, 4096)
+
+	existing := map[string]bool{}
+
+	for _, chunk := range chunks {
+		existing[string(chunk)] = true
+	}
+
+	changed := 0
+
+	for _, chunk := range editedChunks {
+		if !existing[string(chunk)] {
+			changed++
+		}
+	}
+
+	assert.LessOrEqual(t, changed, 2)
+}
+
+func TestChunkerShouldHandleSmallAndEmptyInputs(t *testing.T) {
+	assert.Empty(t, getChunks(t, nil, 4096))
+	assert.Equal(t, [][]byte{[]byte("small")}, getChunks(t, []byte("small"), 4096))
+
+	_, err := New(bytes.NewReader(nil), 1000)
+	assert.Error(t, err)
+}
@@ -1,31 +1,97 @@
 package config
 
 import (
+	"data-tools/blobstore"
+	"data-tools/chunker"
+	"data-tools/crypto"
+	"data-tools/utils"
+	"fmt"
 	"gopkg.in/yaml.v3"
 	"log"
 	"os"
 	"path"
+	"regexp"
+	"strings"
 )
 
+// ZapModes decide what happens to duplicate files when ZAP-ping
+var ZapModes = []string{"store", "hardlink", "reflink", "symlink"}
+
+// FileTypeBackends decide how the MIME type of a file is detected when hashing
+var FileTypeBackends = []string{"native", "file"}
+
+// KeepPolicies decide which copy of a file is kept when ZAP-ping. They are applied in the order configured.
+var KeepPolicies = []string{"oldest", "shortest_path", "preferred_root", "path_pattern"}
+
 type yamlConfig struct {
 	IsDebug                     bool     `yaml:"debug"`
 	LogFilePath                 string   `yaml:"log_file_path"`
 	DBPath                      string   `yaml:"db_path"`
 	ZapDataPath                 string   `yaml:"zap_data_path"`
+	QuarantinePath              string   `yaml:"quarantine_path"`
+	QuarantineRetentionDays     int64    `yaml:"quarantine_retention_days"`
+	VerifyBeforeDelete          bool     `yaml:"verify_before_delete"`
+	HashPrefilter               bool     `yaml:"hash_prefilter"`
+	HashCache                   bool     `yaml:"hash_cache"`
+	PerceptualHash              bool     `yaml:"perceptual_hash"`
+	SimilarImagesMaxDistance    int64    `yaml:"similar_images_max_distance"`
+	HashAlgorithm               string   `yaml:"hash_algorithm"`
+	FileTypeBackend             string   `yaml:"file_type_backend"`
 	BatchSize                   int64    `yaml:"batch_size"`
 	MaxConcurrentFileOperations int64    `yaml:"max_concurrent_file_operations"`
 	FileNamesToIgnore           []string `yaml:"file_names_to_ignore"`
 	FolderNamesToIgnore         []string `yaml:"folder_names_to_ignore"`
+	ZapMode                     string   `yaml:"zap_mode"`
+	ZapRelativeSymlinks         bool     `yaml:"zap_relative_symlinks"`
+	ZapChunking                 bool     `yaml:"zap_chunking"`
+	ZapCompression              bool     `yaml:"zap_compression"`
+	ZapEncryption               bool     `yaml:"zap_encryption"`
+	ZapEncryptionKeyFile        string   `yaml:"zap_encryption_key_file"`
+	ZapS3Endpoint               string   `yaml:"zap_s3_endpoint"`
+	ZapS3Region                 string   `yaml:"zap_s3_region"`
+	ZapS3Insecure               bool     `yaml:"zap_s3_insecure"`
+	ZapLayoutDepth              int64    `yaml:"zap_layout_depth"`
+	ZapLayoutWidth              int64    `yaml:"zap_layout_width"`
+	ZapChunkingMinFileSize      int64    `yaml:"zap_chunking_min_file_size"`
+	ZapChunkSize                int64    `yaml:"zap_chunk_size"`
+	ZapKeepPolicies             []string `yaml:"zap_keep_policies"`
+	ZapPreferredRoots           []string `yaml:"zap_preferred_roots"`
+	ZapPreferredPathPatterns    []string `yaml:"zap_preferred_path_patterns"`
 }
 type Config struct {
 	IsDebug                     bool
 	LogFilePath                 string
 	DBPath                      string
 	ZapDataPath                 string
+	QuarantinePath              string
+	QuarantineRetentionDays     int64
+	VerifyBeforeDelete          bool
+	HashPrefilter               bool
+	HashCache                   bool
+	PerceptualHash              bool
+	SimilarImagesMaxDistance    int64
+	HashAlgorithm               string
+	FileTypeBackend             string
 	BatchSize                   int64
 	MaxConcurrentFileOperations int64
 	FileNamesToIgnore           []string
 	FolderNamesToIgnore         []string
+	ZapMode                     string
+	ZapRelativeSymlinks         bool
+	ZapChunking                 bool
+	ZapCompression              bool
+	ZapEncryption               bool
+	ZapEncryptionKeyFile        string
+	ZapS3Endpoint               string
+	ZapS3Region                 string
+	ZapS3Insecure               bool
+	ZapLayoutDepth              int64
+	ZapLayoutWidth              int64
+	ZapChunkingMinFileSize      int64
+	ZapChunkSize                int64
+	ZapKeepPolicies             []string
+	ZapPreferredRoots           []string
+	ZapPreferredPathPatterns    []*regexp.Regexp
 }
 
 func Load(defaultConfigData []byte) (*Config, error) {
@@ -59,14 +125,144 @@ func parseConfigFile(configFilePath string) (*Config, error) {
 		return nil, err
 	}
 
+	zapMode := config.ZapMode
+
+	if len(zapMode) == 0 {
+		zapMode = "store"
+	}
+
+	if !utils.IsInArray(zapMode, ZapModes) {
+		return nil, fmt.Errorf("unknown ZAP mode \"%s\"", zapMode)
+	}
+
+	// Links point at whole files, so chunks can only be used when files are stored
+	if config.ZapChunking && zapMode != "store" {
+		return nil, fmt.Errorf("ZAP chunking can only be used with the store ZAP mode")
+	}
+
+	if config.ZapCompression && zapMode != "store" {
+		return nil, fmt.Errorf("ZAP compression can only be used with the store ZAP mode")
+	}
+
+	if config.ZapEncryption && zapMode != "store" {
+		return nil, fmt.Errorf("ZAP encryption can only be used with the store ZAP mode")
+	}
+
+	// Links need files on the local filesystem to point at
+	if strings.HasPrefix(config.ZapDataPath, "s3://") && zapMode != "store" {
+		return nil, fmt.Errorf("a ZAP folder in S3 can only be used with the store ZAP mode")
+	}
+
+	zapS3Endpoint := config.ZapS3Endpoint
+
+	if len(zapS3Endpoint) == 0 {
+		zapS3Endpoint = "s3.amazonaws.com"
+	}
+
+	zapLayout := blobstore.DefaultLayout
+
+	if config.ZapLayoutDepth != 0 {
+		zapLayout.Depth = int(config.ZapLayoutDepth)
+	}
+
+	if config.ZapLayoutWidth != 0 {
+		zapLayout.Width = int(config.ZapLayoutWidth)
+	}
+
+	err = zapLayout.Validate()
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid ZAP layout: %w", err)
+	}
+
+	if config.ZapChunking && !chunker.IsValidAverageSize(int(config.ZapChunkSize)) {
+		return nil, fmt.Errorf("ZAP chunk size must be a power of two of at least %d bytes", chunker.MinAverageSize)
+	}
+
+	if config.BatchSize <= 0 {
+		return nil, fmt.Errorf("batch size must be at least 1")
+	}
+
+	if config.QuarantineRetentionDays < 0 {
+		return nil, fmt.Errorf("quarantine retention days must not be negative")
+	}
+
+	// Perceptual hashes are 64 bits
+	if config.SimilarImagesMaxDistance < 0 || config.SimilarImagesMaxDistance > 64 {
+		return nil, fmt.Errorf("similar images max distance must be between 0 and 64")
+	}
+
+	hashAlgorithm := config.HashAlgorithm
+
+	if len(hashAlgorithm) == 0 {
+		hashAlgorithm = crypto.DefaultAlgorithm
+	}
+
+	if !utils.IsInArray(hashAlgorithm, crypto.Algorithms) {
+		return nil, fmt.Errorf("unknown hash algorithm \"%s\"", hashAlgorithm)
+	}
+
+	fileTypeBackend := config.FileTypeBackend
+
+	if len(fileTypeBackend) == 0 {
+		fileTypeBackend = "native"
+	}
+
+	if !utils.IsInArray(fileTypeBackend, FileTypeBackends) {
+		return nil, fmt.Errorf("unknown file type backend \"%s\"", fileTypeBackend)
+	}
+
+	for _, policy := range config.ZapKeepPolicies {
+		if !utils.IsInArray(policy, KeepPolicies) {
+			return nil, fmt.Errorf("unknown ZAP keep policy \"%s\"", policy)
+		}
+	}
+
+	var zapPreferredPathPatterns []*regexp.Regexp
+
+	for _, pattern := range config.ZapPreferredPathPatterns {
+		compiledPattern, err := regexp.Compile(pattern)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid ZAP preferred path pattern \"%s\": %v", pattern, err)
+		}
+
+		zapPreferredPathPatterns = append(zapPreferredPathPatterns, compiledPattern)
+	}
+
 	return &Config{
 		IsDebug:                     config.IsDebug,
 		LogFilePath:                 config.LogFilePath,
 		DBPath:                      config.DBPath,
 		ZapDataPath:                 config.ZapDataPath,
+		QuarantinePath:              config.QuarantinePath,
+		QuarantineRetentionDays:     config.QuarantineRetentionDays,
+		VerifyBeforeDelete:          config.VerifyBeforeDelete,
+		HashPrefilter:               config.HashPrefilter,
+		HashCache:                   config.HashCache,
+		PerceptualHash:              config.PerceptualHash,
+		SimilarImagesMaxDistance:    config.SimilarImagesMaxDistance,
+		HashAlgorithm:               hashAlgorithm,
+		FileTypeBackend:             fileTypeBackend,
 		BatchSize:                   config.BatchSize,
 		MaxConcurrentFileOperations: config.MaxConcurrentFileOperations,
 		FileNamesToIgnore:           config.FileNamesToIgnore,
 		FolderNamesToIgnore:         config.FolderNamesToIgnore,
+		ZapMode:                     zapMode,
+		ZapRelativeSymlinks:         config.ZapRelativeSymlinks,
+		ZapChunking:                 config.ZapChunking,
+		ZapCompression:              config.ZapCompression,
+		ZapEncryption:               config.ZapEncryption,
+		ZapEncryptionKeyFile:        config.ZapEncryptionKeyFile,
+		ZapS3Endpoint:               zapS3Endpoint,
+		ZapS3Region:                 config.ZapS3Region,
+		ZapS3Insecure:               config.ZapS3Insecure,
+		ZapLayoutDepth:              int64(zapLayout.Depth),
+		ZapLayoutWidth:              int64(zapLayout.Width),
+		ZapChunkingMinFileSize:      config.ZapChunkingMinFileSize,
+		ZapChunkSize:                config.ZapChunkSize,
+		ZapKeepPolicies:             config.ZapKeepPolicies,
+		ZapPreferredRoots:           config.ZapPreferredRoots,
+		ZapPreferredPathPatterns:    zapPreferredPathPatterns,
 	}, nil
 }
@@ -8,4 +8,7 @@ import (
 type Context struct {
 	Config *config.Config
 	DB     *gorm.DB
+
+	// IgnoreHashCache is set by hash --no-cache. Every file is read, and the hash cache is refreshed with the results.
+	IgnoreHashCache bool
 }
@@ -1,37 +1,52 @@
 package main
 
 import (
+	"bytes"
+	"data-tools/blobstore"
 	"data-tools/utils"
+	"errors"
 	"fmt"
 	"github.com/schollz/progressbar/v3"
+	"io/fs"
 	"log"
 	"os"
-
-	"path"
+	"strings"
 )
 
-func MergeZaps(sourcePath, destinationPath string) error {
-	sourcePathInfo, err := os.Stat(sourcePath)
+func (ctx *Context) MergeZaps(sourceLocation, destinationLocation string) error {
+	source, err := ctx.openBlobStore(sourceLocation)
 
 	if err != nil {
 		return err
 	}
 
-	if !sourcePathInfo.IsDir() {
-		return fmt.Errorf("\"%s\" is not a directory", sourcePath)
-	}
-
-	destinationPathInfo, err := os.Stat(destinationPath)
+	destination, err := ctx.openBlobStore(destinationLocation)
 
 	if err != nil {
 		return err
 	}
 
-	if !destinationPathInfo.IsDir() {
-		return fmt.Errorf("\"%s\" is not a directory", destinationPathInfo)
+	for _, blobs := range []blobstore.BlobStore{source, destination} {
+		if local, isLocal := blobs.(*blobstore.Local); isLocal {
+			info, err := os.Stat(local.BasePath())
+
+			if err != nil {
+				return err
+			}
+
+			if !info.IsDir() {
+				return fmt.Errorf("\"%s\" is not a directory", local.BasePath())
+			}
+		}
+	}
+
+	err = assertZapsEncryptedAlike(source, destination)
+
+	if err != nil {
+		return err
 	}
 
-	print(fmt.Printf("This will move zaps from :\"%s\" to \"%s\". If you wish to proceed type YES: ", sourcePath, destinationPath))
+	print(fmt.Printf("This will move zaps from :\"%s\" to \"%s\". If you wish to proceed type YES: ", sourceLocation, destinationLocation))
 	var input string
 	_, err = fmt.Scanln(&input)
 
@@ -43,13 +58,53 @@ func MergeZaps(sourcePath, destinationPath string) error {
 		return nil
 	}
 
-	paths := buildPathMap(sourcePath, destinationPath)
-	bar := progressbar.Default(int64(len(paths)))
-	orchestrator := utils.NewTaskOrchestrator(bar, len(paths), 10)
+	return mergeZaps(source, destination)
+}
+
+// assertZapsEncryptedAlike checks that two ZAP folders are either both unencrypted or encrypted with the same key, as
+// files cannot be moved between them otherwise
+func assertZapsEncryptedAlike(source, destination blobstore.BlobStore) error {
+	sourceParameters, err := readEncryptionParameters(source)
+
+	if err != nil {
+		return err
+	}
+
+	destinationParameters, err := readEncryptionParameters(destination)
 
-	for sourceFilePath, destinationFilePath := range paths {
+	if err != nil {
+		return err
+	}
+
+	if sourceParameters == nil && destinationParameters == nil {
+		return nil
+	}
+
+	if sourceParameters == nil || destinationParameters == nil || !bytes.Equal(sourceParameters.Salt, destinationParameters.Salt) || sourceParameters.Check != destinationParameters.Check {
+		return ErrZapFoldersEncryptedDifferently
+	}
+
+	return nil
+}
+
+func mergeZaps(source, destination blobstore.BlobStore) error {
+	var names []string
+
+	err := source.List(func(name string, size int64) error {
+		names = append(names, name)
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	bar := progressbar.Default(int64(len(names)))
+	orchestrator := utils.NewTaskOrchestrator(bar, len(names), 10)
+
+	for _, name := range names {
 		orchestrator.StartTask()
-		go copyZapsInFolder(orchestrator, sourceFilePath, destinationFilePath)
+		go mergeZapFileInTask(orchestrator, source, destination, name)
 	}
 
 	orchestrator.WaitForTasks()
@@ -57,26 +112,101 @@ func MergeZaps(sourcePath, destinationPath string) error {
 	return nil
 }
 
-func buildPathMap(sourcePath, destinationPath string) map[string]string {
-	paths := map[string]string{}
+func mergeZapFileInTask(orchestrator *utils.TaskOrchestrator, source, destination blobstore.BlobStore, name string) {
+	// If there is an error, log it and move onto the next file
+	err := mergeZapFile(source, destination, name)
+
+	if err != nil {
+		log.Printf("Error moving file \"%s\" to \"%s\": %s\n", source.Location(name), destination.Location(name), err)
+	}
 
-	for x := 0; x < 0x100; x++ {
-		for y := 0; y < 0x100; y++ {
-			src := path.Join(sourcePath, fmt.Sprintf("%02x", x), fmt.Sprintf("%02x", y))
-			dst := path.Join(destinationPath, fmt.Sprintf("%02x", x), fmt.Sprintf("%02x", y))
-			paths[src] = dst
+	orchestrator.FinishTask()
+}
+
+// mergeZapFile moves a file from one ZAP folder to another. Files which are already in the destination in another
+// form, compressed or in chunks, are not moved, so that they are only stored once.
+func mergeZapFile(source, destination blobstore.BlobStore, name string) error {
+	baseName := strings.TrimSuffix(strings.TrimSuffix(name, compressedSuffix), chunkManifestSuffix)
+
+	if !isBlob(destination, name) && (isBlob(destination, baseName) || isBlob(destination, baseName+compressedSuffix) || isBlob(destination, baseName+chunkManifestSuffix)) {
+		return source.Delete(name)
+	}
+
+	sourceLocal, isSourceLocal := source.(*blobstore.Local)
+	destinationLocal, isDestinationLocal := destination.(*blobstore.Local)
+
+	if isSourceLocal && isDestinationLocal {
+		err := destinationLocal.CreateBucket(name)
+
+		if err != nil {
+			return err
+		}
+
+		_, err = CopyOrMoveFile(sourceLocal.Path(name), destinationLocal.Path(name), true, true)
+		return err
+	}
+
+	// As with CopyOrMoveFile, files are compared by size as their names are their hashes
+	sourceSize, err := source.Stat(name)
+
+	if err != nil {
+		return err
+	}
+
+	destinationSize, err := destination.Stat(name)
+
+	if err == nil {
+		if sourceSize != destinationSize {
+			log.Printf("Not moving file \"%s\" to \"%s\" because they are different\n", source.Location(name), destination.Location(name))
+			return nil
 		}
+
+		return source.Delete(name)
 	}
 
-	return paths
+	if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return moveBlob(source, destination, name)
 }
 
-func copyZapsInFolder(orchestrator *utils.TaskOrchestrator, sourcePath, destinationPath string) {
-	err := CopyOrMoveFiles(sourcePath, destinationPath, true, true)
+// moveBlob moves a blob from one store to another, renaming it when both are on the local filesystem
+func moveBlob(source, destination blobstore.BlobStore, name string) error {
+	sourceLocal, isSourceLocal := source.(*blobstore.Local)
+	destinationLocal, isDestinationLocal := destination.(*blobstore.Local)
+
+	if isSourceLocal && isDestinationLocal {
+		err := destinationLocal.CreateBucket(name)
+
+		if err != nil {
+			return err
+		}
+
+		return osMove(sourceLocal.Path(name), destinationLocal.Path(name))
+	}
+
+	reader, err := source.Get(name)
+
+	if err != nil {
+		return err
+	}
+
+	err = destination.Put(name, reader)
+	closeErr := reader.Close()
+
+	if err == nil {
+		err = closeErr
+	}
 
 	if err != nil {
-		log.Print(err)
+		return err
 	}
 
-	orchestrator.FinishTask()
+	return source.Delete(name)
+}
+
+func isBlob(blobs blobstore.BlobStore, name string) bool {
+	_, err := blobs.Stat(name)
+	return err == nil
 }
@@ -31,12 +31,19 @@ func (ctx *Context) Crawl(rootPath string) error {
 
 	// Has the path already been added, hence crawled?
 	if result.RowsAffected > 0 {
-		utils.ConsoleAndLogPrintf("\"%s\" has already been crawled.", absoluteRootPath)
+		utils.ConsoleAndLogPrintf("\"%s\" has already been crawled. Use recrawl to pick up any changes.", absoluteRootPath)
 		return ErrPathAlreadyAdded
 	}
 
+	rootPathInfo, err := os.Stat(absoluteRootPath)
+
+	if err != nil {
+		return err
+	}
+
 	rootPathModel := models.Path{
-		Name: absoluteRootPath,
+		Name:     absoluteRootPath,
+		Metadata: GetMetadata(rootPathInfo),
 	}
 
 	// Add the root path
@@ -82,10 +89,17 @@ func (ctx *Context) crawlRootPath(rootPath models.Path) error {
 					return filepath.SkipDir
 				}
 
+				info, err := d.Info()
+
+				if err != nil {
+					return err
+				}
+
 				pathModels[thisPath] = &models.Path{
 					ParentPath: pathModels[filepath.Dir(thisPath)],
 					Name:       d.Name(),
 					Level:      currentLevel,
+					Metadata:   GetMetadata(info),
 				}
 
 				result := tx.Create(pathModels[thisPath])
@@ -100,10 +114,17 @@ func (ctx *Context) crawlRootPath(rootPath models.Path) error {
 					return nil
 				}
 
+				info, err := d.Info()
+
+				if err != nil {
+					return err
+				}
+
 				result := tx.Create(&models.File{
-					Path:  *pathModels[filepath.Dir(thisPath)],
-					Name:  d.Name(),
-					Level: currentLevel,
+					Path:     *pathModels[filepath.Dir(thisPath)],
+					Name:     d.Name(),
+					Level:    currentLevel,
+					Metadata: GetMetadata(info),
 				})
 
 				if result.Error != nil {
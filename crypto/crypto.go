@@ -2,10 +2,12 @@ package crypto
 
 import (
 	"github.com/btcsuite/btcd/btcutil/base58"
+	"github.com/zeebo/xxh3"
 	"golang.org/x/crypto/blake2b"
 	"io"
 	"os"
 	"path"
+	"strconv"
 )
 
 // https://crypto.stackexchange.com/a/89559
@@ -50,3 +52,53 @@ func HashFile(filePath string) (string, error) {
 	// This results in a little reduction in storage use over hex, which would be 128 characters (2 chars per byte)
 	return base58.Encode(hash.Sum(nil)), err
 }
+
+// PartialHashBlockSize is how much of the head and the tail of a file HashFilePartial reads
+const PartialHashBlockSize = 64 * 1024
+
+// HashFilePartial hashes the size along with the first and last blocks of a file. It is cheap to compute, so is used
+// to rule out files which cannot be duplicates before they are fully hashed. Small files are hashed in full.
+func HashFilePartial(filePath string) (string, error) {
+	file, err := os.Open(path.Clean(filePath))
+
+	if err != nil {
+		return "", err
+	}
+
+	defer file.Close()
+
+	info, err := file.Stat()
+
+	if err != nil {
+		return "", err
+	}
+
+	// This only needs to tell files apart, not resist attack, so the fastest algorithm is used
+	hash := &xxh3Hash128{xxh3.New()}
+	size := info.Size()
+	hash.Write([]byte(strconv.FormatInt(size, 10)))
+
+	if size <= 2*PartialHashBlockSize {
+		_, err = io.Copy(hash, file)
+
+		if err != nil {
+			return "", err
+		}
+
+		return base58.Encode(hash.Sum(nil)), nil
+	}
+
+	_, err = io.Copy(hash, io.NewSectionReader(file, 0, PartialHashBlockSize))
+
+	if err != nil {
+		return "", err
+	}
+
+	_, err = io.Copy(hash, io.NewSectionReader(file, size-PartialHashBlockSize, PartialHashBlockSize))
+
+	if err != nil {
+		return "", err
+	}
+
+	return base58.Encode(hash.Sum(nil)), nil
+}
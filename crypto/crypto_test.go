@@ -10,3 +10,39 @@ func TestHashFile(t *testing.T) {
 	expected := "3tSamSfZTrePjU1wwBcwGjo1tGujGVoAjcPAt6mis6Adr5jMUFQZPY2dBVRV4RKX5UReejgzZdkTEQVFTqjBVjVq"
 	assert.Equal(t, expected, result)
 }
+
+func TestHashFilePartial(t *testing.T) {
+	// Small files are hashed in full, so identical files give the same result
+	left, err := HashFilePartial("../test/data/a/file.md")
+	assert.NoError(t, err)
+
+	right, err := HashFilePartial("../test/data/a/a/file.md")
+	assert.NoError(t, err)
+	assert.Equal(t, left, right)
+
+	// Larger files only have their head and tail read
+	large, err := HashFilePartial("../test/data/a/b/4276652.png")
+	assert.NoError(t, err)
+	assert.NotEqual(t, left, large)
+}
+
+func TestHasher(t *testing.T) {
+	expected := map[string]string{
+		BLAKE2b512: "3tSamSfZTrePjU1wwBcwGjo1tGujGVoAjcPAt6mis6Adr5jMUFQZPY2dBVRV4RKX5UReejgzZdkTEQVFTqjBVjVq",
+		SHA256:     "BazKVmZDUMfStnWyV2bZBgq5VwinRW3gYohRSNd8sPja",
+		BLAKE3:     "HvM7bSzsjbzmmr87LBcwUtWKaGVjYjK99iKgccknFEAZ",
+		XXH3128:    "KNxoSU8HScwxUwKExMeAL4",
+	}
+
+	for _, algorithm := range Algorithms {
+		hasher, err := NewHasher(algorithm)
+		assert.NoError(t, err)
+
+		result, err := hasher.HashFile("../test/data/a/file.md")
+		assert.NoError(t, err)
+		assert.Equal(t, expected[algorithm], result, algorithm)
+	}
+
+	_, err := NewHasher("md5")
+	assert.Error(t, err)
+}
@@ -0,0 +1,293 @@
+package crypto
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+	"io"
+)
+
+const (
+	encryptionMagic = "DTE1"
+	noncePrefixSize = 16
+	tagSize         = chacha20poly1305.Overhead
+	headerSize      = len(encryptionMagic) + noncePrefixSize
+
+	// SegmentSize is how much is encrypted at a time, so that files of any size can be streamed
+	SegmentSize = 64 * 1024
+)
+
+var (
+	ErrWrongKey         = errors.New("wrong passphrase or key file")
+	ErrDecryptionFailed = errors.New("decryption failed, the data is corrupt or was encrypted with another key")
+)
+
+// KeyParameters are what is needed, along with the passphrase or key file, to derive a Key again. None of them are
+// secret, so they are stored alongside the encrypted data.
+type KeyParameters struct {
+	Version int    `json:"version"`
+	Salt    []byte `json:"salt"`
+	Time    uint32 `json:"time"`
+	Memory  uint32 `json:"memory"` // KiB
+	Threads uint8  `json:"threads"`
+	Check   string `json:"check"` // Tells whether a key is the right one without having to decrypt anything
+}
+
+// NewKeyParameters returns parameters with a random salt and the Argon2id settings recommended by RFC 9106
+func NewKeyParameters() (*KeyParameters, error) {
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &KeyParameters{
+		Version: 1,
+		Salt:    salt,
+		Time:    3,
+		Memory:  64 * 1024,
+		Threads: 4,
+	}, nil
+}
+
+// A Key encrypts data with XChaCha20-Poly1305, and names it with keyed hashes so that names give nothing away
+type Key struct {
+	encryptionKey []byte
+	namingKey     []byte
+}
+
+// DeriveKey derives a key from a passphrase or the contents of a key file using Argon2id. Parameters without a check
+// are given one, otherwise ErrWrongKey is returned if the secret is not the one they were created with.
+func DeriveKey(secret []byte, parameters *KeyParameters) (*Key, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("the passphrase or key file is empty")
+	}
+
+	if parameters.Version != 1 {
+		return nil, fmt.Errorf("unknown key parameters version %d", parameters.Version)
+	}
+
+	derived := argon2.IDKey(secret, parameters.Salt, parameters.Time, parameters.Memory, parameters.Threads, 2*chacha20poly1305.KeySize)
+
+	key := &Key{
+		encryptionKey: derived[:chacha20poly1305.KeySize],
+		namingKey:     derived[chacha20poly1305.KeySize:],
+	}
+
+	check := key.Name([]byte("data-tools key check"))
+
+	if len(parameters.Check) == 0 {
+		parameters.Check = check
+	} else if subtle.ConstantTimeCompare([]byte(check), []byte(parameters.Check)) != 1 {
+		return nil, ErrWrongKey
+	}
+
+	return key, nil
+}
+
+// Name returns a hex encoded HMAC-SHA256 of data, which cannot be linked back to the data without the key
+func (k *Key) Name(data []byte) string {
+	mac := hmac.New(sha256.New, k.namingKey)
+	mac.Write(data)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// NewWriter encrypts everything written to it into w. It must be closed to write the final segment. The same
+// associated data must be given to NewReader, so that encrypted data cannot be passed off as something else.
+func (k *Key) NewWriter(w io.Writer, associatedData []byte) (io.WriteCloser, error) {
+	aead, err := chacha20poly1305.NewX(k.encryptionKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	noncePrefix := make([]byte, noncePrefixSize)
+	_, err = rand.Read(noncePrefix)
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = w.Write(append([]byte(encryptionMagic), noncePrefix...))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptWriter{
+		segmenter: segmenter{aead: aead, noncePrefix: noncePrefix, associatedData: associatedData},
+		writer:    w,
+		buffer:    make([]byte, 0, SegmentSize),
+	}, nil
+}
+
+// NewReader decrypts what was written by a writer from NewWriter
+func (k *Key) NewReader(r io.Reader, associatedData []byte) (io.Reader, error) {
+	aead, err := chacha20poly1305.NewX(k.encryptionKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, headerSize)
+	_, err = io.ReadFull(r, header)
+
+	if err != nil || string(header[:len(encryptionMagic)]) != encryptionMagic {
+		return nil, ErrDecryptionFailed
+	}
+
+	return &decryptReader{
+		segmenter: segmenter{aead: aead, noncePrefix: header[len(encryptionMagic):], associatedData: associatedData},
+		reader:    bufio.NewReaderSize(r, SegmentSize+tagSize+1),
+		segment:   make([]byte, SegmentSize+tagSize),
+	}, nil
+}
+
+// PlaintextSize works out how large encrypted data was before it was encrypted, from its size
+func PlaintextSize(encryptedSize int64) (int64, error) {
+	size := encryptedSize - int64(headerSize)
+
+	if size < tagSize {
+		return 0, ErrDecryptionFailed
+	}
+
+	segments := (size + SegmentSize + tagSize - 1) / (SegmentSize + tagSize)
+
+	return size - segments*tagSize, nil
+}
+
+// segmenter seals and opens segments following the STREAM construction, so that segments cannot be reordered,
+// dropped or truncated without it being noticed.
+// See https://eprint.iacr.org/2015/189.pdf
+type segmenter struct {
+	aead           cipher.AEAD
+	noncePrefix    []byte
+	associatedData []byte
+	counter        uint64
+}
+
+func (s *segmenter) nextNonceAndData(final bool) ([]byte, []byte) {
+	nonce := make([]byte, s.aead.NonceSize())
+	copy(nonce, s.noncePrefix)
+	binary.BigEndian.PutUint64(nonce[noncePrefixSize:], s.counter)
+	s.counter++
+
+	finalFlag := byte(0)
+
+	if final {
+		finalFlag = 1
+	}
+
+	return nonce, append(append([]byte{}, s.associatedData...), finalFlag)
+}
+
+type encryptWriter struct {
+	segmenter
+	writer io.Writer
+	buffer []byte
+	closed bool
+}
+
+func (w *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+
+	for len(p) > 0 {
+		// A full segment is only written once there is more to come, as the last segment is sealed differently
+		if len(w.buffer) == SegmentSize {
+			err := w.writeSegment(false)
+
+			if err != nil {
+				return written, err
+			}
+		}
+
+		count := copy(w.buffer[len(w.buffer):SegmentSize], p)
+		w.buffer = w.buffer[:len(w.buffer)+count]
+		p = p[count:]
+		written += count
+	}
+
+	return written, nil
+}
+
+func (w *encryptWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+
+	w.closed = true
+	return w.writeSegment(true)
+}
+
+func (w *encryptWriter) writeSegment(final bool) error {
+	nonce, associatedData := w.nextNonceAndData(final)
+	sealed := w.aead.Seal(nil, nonce, w.buffer, associatedData)
+
+	w.buffer = w.buffer[:0]
+	_, err := w.writer.Write(sealed)
+
+	return err
+}
+
+type decryptReader struct {
+	segmenter
+	reader    *bufio.Reader
+	segment   []byte
+	plaintext []byte
+	finished  bool
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	for len(r.plaintext) == 0 {
+		if r.finished {
+			return 0, io.EOF
+		}
+
+		err := r.readSegment()
+
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	count := copy(p, r.plaintext)
+	r.plaintext = r.plaintext[count:]
+
+	return count, nil
+}
+
+func (r *decryptReader) readSegment() error {
+	read, err := io.ReadFull(r.reader, r.segment)
+	final := false
+
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		final = true
+	} else if err != nil {
+		return err
+	} else if _, peekErr := r.reader.Peek(1); errors.Is(peekErr, io.EOF) {
+		final = true
+	}
+
+	nonce, associatedData := r.nextNonceAndData(final)
+	plaintext, err := r.aead.Open(r.segment[:0], nonce, r.segment[:read], associatedData)
+
+	if err != nil {
+		return ErrDecryptionFailed
+	}
+
+	r.plaintext = plaintext
+	r.finished = final
+
+	return nil
+}
@@ -0,0 +1,100 @@
+package crypto
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"testing"
+)
+
+func newTestKey(t *testing.T, secret string, parameters *KeyParameters) *Key {
+	key, err := DeriveKey([]byte(secret), parameters)
+	assert.NoError(t, err)
+
+	return key
+}
+
+// Cheap parameters, as the tests do not need to resist guessing
+func newTestKeyParameters() *KeyParameters {
+	return &KeyParameters{Version: 1, Salt: []byte("0123456789abcdef"), Time: 1, Memory: 64, Threads: 1}
+}
+
+func encrypt(t *testing.T, key *Key, plaintext, associatedData []byte) []byte {
+	var encrypted bytes.Buffer
+	writer, err := key.NewWriter(&encrypted, associatedData)
+	assert.NoError(t, err)
+
+	_, err = writer.Write(plaintext)
+	assert.NoError(t, err)
+	assert.NoError(t, writer.Close())
+
+	return encrypted.Bytes()
+}
+
+func decrypt(key *Key, encrypted, associatedData []byte) ([]byte, error) {
+	reader, err := key.NewReader(bytes.NewReader(encrypted), associatedData)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return io.ReadAll(reader)
+}
+
+func TestEncryption(t *testing.T) {
+	key := newTestKey(t, "passphrase", newTestKeyParameters())
+
+	for _, size := range []int{0, 1, SegmentSize - 1, SegmentSize, SegmentSize + 1, 3 * SegmentSize} {
+		plaintext := bytes.Repeat([]byte{byte(size)}, size)
+		encrypted := encrypt(t, key, plaintext, []byte("name"))
+
+		decrypted, err := decrypt(key, encrypted, []byte("name"))
+		assert.NoError(t, err, size)
+		assert.Equal(t, plaintext, decrypted, size)
+
+		plaintextSize, err := PlaintextSize(int64(len(encrypted)))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(size), plaintextSize, size)
+
+		// Encrypted data cannot be passed off as something else
+		_, err = decrypt(key, encrypted, []byte("another name"))
+		assert.ErrorIs(t, err, ErrDecryptionFailed, size)
+	}
+}
+
+func TestEncryptionShouldDetectTampering(t *testing.T) {
+	key := newTestKey(t, "passphrase", newTestKeyParameters())
+	plaintext := bytes.Repeat([]byte("data"), SegmentSize)
+	encrypted := encrypt(t, key, plaintext, nil)
+
+	// Dropping the last segments leaves a segment which was not sealed as the last one
+	_, err := decrypt(key, encrypted[:headerSize+2*(SegmentSize+tagSize)], nil)
+	assert.ErrorIs(t, err, ErrDecryptionFailed)
+
+	changed := bytes.Clone(encrypted)
+	changed[len(changed)/2] ^= 1
+	_, err = decrypt(key, changed, nil)
+	assert.ErrorIs(t, err, ErrDecryptionFailed)
+
+	otherKey := newTestKey(t, "another passphrase", newTestKeyParameters())
+	_, err = decrypt(otherKey, encrypted, nil)
+	assert.ErrorIs(t, err, ErrDecryptionFailed)
+}
+
+func TestDeriveKey(t *testing.T) {
+	parameters := newTestKeyParameters()
+	key := newTestKey(t, "passphrase", parameters)
+	assert.NotEmpty(t, parameters.Check)
+
+	// The check recorded the first time catches the wrong passphrase
+	_, err := DeriveKey([]byte("wrong passphrase"), parameters)
+	assert.ErrorIs(t, err, ErrWrongKey)
+
+	sameKey := newTestKey(t, "passphrase", parameters)
+	assert.Equal(t, key.Name([]byte("hash")), sameKey.Name([]byte("hash")))
+	assert.NotEqual(t, key.Name([]byte("hash")), key.Name([]byte("other hash")))
+	assert.Len(t, key.Name([]byte("hash")), 64)
+
+	_, err = DeriveKey(nil, newTestKeyParameters())
+	assert.Error(t, err)
+}
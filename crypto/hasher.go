@@ -0,0 +1,114 @@
+package crypto
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/btcsuite/btcd/btcutil/base58"
+	"github.com/zeebo/blake3"
+	"github.com/zeebo/xxh3"
+	"golang.org/x/crypto/blake2b"
+	"hash"
+	"io"
+	"os"
+	"path"
+)
+
+const (
+	BLAKE2b512 = "blake2b-512"
+	BLAKE3     = "blake3"
+	SHA256     = "sha256"
+	XXH3128    = "xxh3-128" // Not cryptographic, but very fast. Best suited to prefiltering.
+)
+
+// Algorithms are the hash algorithms a Hasher supports
+var Algorithms = []string{BLAKE2b512, BLAKE3, SHA256, XXH3128}
+
+// DefaultAlgorithm is used for catalogs which predate algorithms being recorded
+const DefaultAlgorithm = BLAKE2b512
+
+// A Hasher produces base-58 encoded digests of files using one algorithm
+type Hasher struct {
+	Algorithm string
+	newHash   func() hash.Hash
+}
+
+func NewHasher(algorithm string) (*Hasher, error) {
+	var newHash func() hash.Hash
+
+	switch algorithm {
+	case BLAKE2b512:
+		newHash = func() hash.Hash {
+			// This can only fail when given a key which is too long
+			h, _ := blake2b.New512(nil)
+			return h
+		}
+	case BLAKE3:
+		newHash = func() hash.Hash {
+			return blake3.New()
+		}
+	case SHA256:
+		newHash = sha256.New
+	case XXH3128:
+		newHash = func() hash.Hash {
+			return &xxh3Hash128{xxh3.New()}
+		}
+	default:
+		return nil, fmt.Errorf("unknown hash algorithm \"%s\"", algorithm)
+	}
+
+	return &Hasher{
+		Algorithm: algorithm,
+		newHash:   newHash,
+	}, nil
+}
+
+// New returns a hash.Hash for the algorithm, for hashing something other than a whole file
+func (h *Hasher) New() hash.Hash {
+	return h.newHash()
+}
+
+func (h *Hasher) HashFile(filePath string) (string, error) {
+	file, err := os.Open(path.Clean(filePath))
+
+	if err != nil {
+		return "", err
+	}
+
+	defer file.Close()
+
+	return h.HashReader(file)
+}
+
+// HashReader produces a base-58 encoded digest of everything read from reader
+func (h *Hasher) HashReader(reader io.Reader) (string, error) {
+	digest := h.newHash()
+	_, err := io.Copy(digest, reader)
+
+	if err != nil {
+		return "", err
+	}
+
+	return base58.Encode(digest.Sum(nil)), nil
+}
+
+// HashBytes produces a base-58 encoded digest of data which is already in memory
+func (h *Hasher) HashBytes(data []byte) string {
+	digest := h.newHash()
+	digest.Write(data)
+
+	return base58.Encode(digest.Sum(nil))
+}
+
+// xxh3Hash128 makes the 128-bit variant of xxh3 a hash.Hash. By default it only sums 64 bits.
+type xxh3Hash128 struct {
+	*xxh3.Hasher
+}
+
+func (h *xxh3Hash128) Size() int {
+	return 16
+}
+
+func (h *xxh3Hash128) Sum(b []byte) []byte {
+	sum := h.Sum128().Bytes()
+	return append(b, sum[:]...)
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"data-tools/config"
 	"data-tools/models"
+	"fmt"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
 	"log"
@@ -50,6 +51,9 @@ func connect(dsn string, gormConfig *gorm.Config) *gorm.DB {
 		&models.FileType{},
 		&models.FileHash{},
 		&models.File{},
+		&models.QuarantinedFile{},
+		&models.HashCacheEntry{},
+		&models.Scrub{},
 		&models.Note{},
 		&models.PathHashNote{},
 		&models.PathNote{},
@@ -64,3 +68,30 @@ func connect(dsn string, gormConfig *gorm.Config) *gorm.DB {
 
 	return db
 }
+
+// updateFileHashesByID sets a column of each file hash to its own value in one statement, so is given a batch at a time
+func updateFileHashesByID[T any](tx *gorm.DB, column string, valuesByID map[uint]T) error {
+	if len(valuesByID) == 0 {
+		return nil
+	}
+
+	var arguments []interface{}
+	var ids []uint
+
+	for id, value := range valuesByID {
+		arguments = append(arguments, id, value)
+		ids = append(ids, id)
+	}
+
+	result := tx.Exec(QueryUpdateFileHashesByID(column, len(ids)), append(arguments, ids)...)
+
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected != int64(len(ids)) {
+		return fmt.Errorf("could not update the %s of file hashes in db", column)
+	}
+
+	return nil
+}
@@ -52,38 +52,204 @@ const fileAbsolutePathCTEQuery = `
 ) absolute_path
 `
 
+// All the paths beneath (and including) a root path. Ignored paths are returned but not descended into.
+const pathTreeCTEQuery = `
+WITH RECURSIVE path_tree(id, ignored) AS
+(
+	SELECT	p1.id,
+			p1.ignored
+	FROM	paths p1
+	WHERE	p1.id = ?
+	AND		p1.deleted_at IS NULL
+
+	UNION ALL
+
+	SELECT	p2.id,
+			p2.ignored
+	FROM	paths p2
+	JOIN	path_tree ON p2.parent_path_id = path_tree.id
+	WHERE	p2.deleted_at IS NULL
+	AND		path_tree.ignored = 0
+)
+`
+
+const metadataColumns = `%[1]s.mod_time,
+			%[1]s.access_time,
+			%[1]s.mode,
+			%[1]s.uid,
+			%[1]s.gid,
+			%[1]s.inode,
+			%[1]s.device_id`
+
 func QueryUnHashedFilePathsWithLimit() string {
 	return fmt.Sprintf(`
 SELECT		f.id file_id,
 			%s
 FROM		files f
 WHERE 		f.file_hash_id IS NULL
+AND			f.hash_deferred = 0
 AND 		absolute_path IS NOT NULL
 AND 		f.deleted_at IS NULL
 AND			f.ignored = 0
+AND			f.id NOT IN ?
 ORDER BY	f.id -- for deterministic result order
 LIMIT 		?
 `, fileAbsolutePathCTEQuery)
 }
 
-func QueryGetFileIdsToZap() string {
+func QueryGetFileIdsToSize() string {
+	return `
+SELECT		f.id,
+			BATCH_NUMBER
+FROM		files f
+WHERE 		f.file_hash_id IS NULL
+AND			f.size IS NULL
+AND 		f.deleted_at IS NULL
+AND			f.ignored = 0
+ORDER BY	f.id -- for deterministic result order
+`
+}
+
+// QueryDeferFilesWithUniqueSize defers hashing files whose size no other file shares
+func QueryDeferFilesWithUniqueSize() string {
+	return `
+UPDATE		files
+SET			hash_deferred = 1
+WHERE		file_hash_id IS NULL
+AND			size IS NOT NULL
+AND			deleted_at IS NULL
+AND			ignored = 0
+AND			NOT EXISTS (
+				SELECT	1
+				FROM	files o
+				WHERE	o.size = files.size
+				AND		o.id != files.id
+				AND		o.deleted_at IS NULL
+				AND		o.ignored = 0
+			)
+`
+}
+
+// QueryGetFileIdsToPartiallyHash finds files which share their size with another file
+func QueryGetFileIdsToPartiallyHash() string {
+	return `
+SELECT		f.id,
+			BATCH_NUMBER
+FROM		files f
+WHERE 		f.file_hash_id IS NULL
+AND			f.hash_deferred = 0
+AND			f.size IS NOT NULL
+AND			f.partial_hash IS NULL
+AND 		f.deleted_at IS NULL
+AND			f.ignored = 0
+ORDER BY	f.id -- for deterministic result order
+`
+}
+
+// QueryGetDeferredFileIds finds the files whose hashing has been deferred
+func QueryGetDeferredFileIds() string {
 	return `
 SELECT		f.id,
 			BATCH_NUMBER
+FROM		files f
+WHERE 		f.file_hash_id IS NULL
+AND			f.hash_deferred = 1
+AND 		f.deleted_at IS NULL
+AND			f.ignored = 0
+ORDER BY	f.id -- for deterministic result order
+`
+}
+
+// QueryDeferFilesWithUniquePartialHash defers hashing files which differ from every other file of the same size.
+// Files hashed without a partial hash could be the same, so are assumed to be.
+func QueryDeferFilesWithUniquePartialHash() string {
+	return `
+UPDATE		files
+SET			hash_deferred = 1
+WHERE		file_hash_id IS NULL
+AND			partial_hash IS NOT NULL
+AND			deleted_at IS NULL
+AND			ignored = 0
+AND			NOT EXISTS (
+				SELECT	1
+				FROM	files o
+				WHERE	o.size = files.size
+				AND		o.id != files.id
+				AND		(o.partial_hash IS NULL OR o.partial_hash = files.partial_hash)
+				AND		o.deleted_at IS NULL
+				AND		o.ignored = 0
+			)
+`
+}
+
+// zapFileConditions are the files which ZAP acts on. The ZAP plan uses them too, so that it cannot drift from what ZAP does.
+const zapFileConditions = `f.zapped = 0
+AND			f.restored = 0
+AND			f.deleted_at IS NULL
+AND			f.ignored = 0
+AND			fh.ignored = 0
+AND			NOT (fh.zapped = 1 AND fh.corrupt = 1)`
+
+func QueryGetFileIdsToZap() string {
+	return fmt.Sprintf(`
+SELECT		f.id,
+			BATCH_NUMBER
 FROM 		file_hashes fh
-JOIN  		(
-				SELECT		f.id,
-							max(f.file_hash_id) AS file_hash_id -- for deterministic result order
-				FROM 		files f
-				WHERE		f.zapped = 0
-				AND			f.deleted_at IS NULL
-				AND			f.ignored = 0
-				GROUP BY 	f.file_hash_id
-  			) f ON f.file_hash_id = fh.id
+JOIN  		files f ON f.id = fh.canonical_file_id
 WHERE		fh.zapped = 0
-AND			fh.ignored = 0
+AND			%s
 ORDER BY	fh.id -- for deterministic result order
-`
+`, zapFileConditions)
+}
+
+// QueryGetFileHashIdsToSelectCanonicalFile finds the hashes which have not yet been ZAPped that have a file which could be kept
+func QueryGetFileHashIdsToSelectCanonicalFile() string {
+	return fmt.Sprintf(`
+SELECT		fh.id,
+			BATCH_NUMBER
+FROM		file_hashes fh
+WHERE		fh.zapped = 0
+AND			EXISTS (
+				SELECT	1
+				FROM	files f
+				WHERE	f.file_hash_id = fh.id
+				AND		f.link_type IS NULL
+				AND		%s
+			)
+ORDER BY	fh.id -- for deterministic result order
+`, zapFileConditions)
+}
+
+func QueryGetCanonicalFileCandidates() string {
+	return fmt.Sprintf(`
+SELECT		f.id file_id,
+			fh.id file_hash_id,
+			f.mod_time,
+			%s
+FROM 		files f
+JOIN 		file_hashes fh ON f.file_hash_id = fh.id
+WHERE		fh.id IN ?
+AND			fh.zapped = 0
+AND			f.link_type IS NULL
+AND			%s
+ORDER BY	fh.id, f.id -- to group files by hash, and for deterministic result order
+`, fileAbsolutePathCTEQuery, zapFileConditions)
+}
+
+func QueryGetZapPlan() string {
+	return fmt.Sprintf(`
+SELECT		f.id file_id,
+			fh.id file_hash_id,
+			fh.hash,
+			fh.size,
+			fh.zapped hash_zapped,
+			f.link_type,
+			%s
+FROM 		files f
+JOIN 		file_hashes fh ON f.file_hash_id = fh.id
+WHERE		%s
+ORDER BY	fh.id, f.id -- to group files by hash, and for deterministic result order
+`, fileAbsolutePathCTEQuery, zapFileConditions)
 }
 
 func QueryGetFileHashesToZapMOOO() string {
@@ -91,39 +257,170 @@ func QueryGetFileHashesToZapMOOO() string {
 SELECT		fh.id file_hash_id,
         	fh.hash,
     		f.id file_id,
+			ft.type file_type,
 			%s
 FROM 		files f
 JOIN  		file_hashes fh ON fh.id = f.file_hash_id
+LEFT JOIN	file_types ft ON ft.id = fh.file_type_id
 WHERE 		f.id IN ?
 ORDER BY	f.id -- for deterministic result order
 `, fileAbsolutePathCTEQuery)
 }
 
 func QueryGetDuplicateFileIdsToRemove() string {
-	return `
+	return fmt.Sprintf(`
 SELECT		f.id,
 			BATCH_NUMBER
 FROM 		files f
 JOIN 		file_hashes fh ON f.file_hash_id = fh.id
+WHERE		fh.zapped = 1
+AND			%s
+ORDER BY	f.size DESC -- to remove the largest duplicates first, and for deterministic result order
+`, zapFileConditions)
+}
+
+// QueryCountDuplicatesOfCorruptHashes counts the files which are kept because the ZAP-ped copy of their hash is
+// corrupt, as they may be the only good copy left
+func QueryCountDuplicatesOfCorruptHashes() string {
+	return `
+SELECT		COUNT(*)
+FROM 		files f
+JOIN 		file_hashes fh ON f.file_hash_id = fh.id
 WHERE		f.zapped = 0
 AND			f.deleted_at IS NULL
 AND			f.ignored = 0
 AND			fh.zapped = 1
 AND			fh.ignored = 0
-ORDER BY	f.size DESC -- to remove the largest duplicates first, and for deterministic result order
+AND			fh.corrupt = 1
 `
 }
 
 func QueryGetDuplicateFilesToRemove() string {
 	return fmt.Sprintf(`
 SELECT		f.id file_id,
+			fh.id file_hash_id,
+			fh.hash,
 			%s
 FROM 		files f
+JOIN 		file_hashes fh ON f.file_hash_id = fh.id
 WHERE		f.id IN ?
 ORDER BY	f.size DESC -- to remove the largest duplicates first, and for deterministic result order 
 `, fileAbsolutePathCTEQuery)
 }
 
+func QueryGetDuplicateFileIdsToLink() string {
+	return fmt.Sprintf(`
+SELECT		f.id,
+			BATCH_NUMBER
+FROM 		files f
+JOIN 		file_hashes fh ON f.file_hash_id = fh.id
+WHERE		f.id != fh.canonical_file_id
+AND			fh.zapped = 0
+AND			f.link_type IS NULL
+AND			%s
+ORDER BY	f.size DESC -- to link the largest duplicates first, and for deterministic result order
+`, zapFileConditions)
+}
+
+func QueryGetDuplicateFilesToLink() string {
+	return fmt.Sprintf(`
+SELECT		f.id file_id,
+			fh.canonical_file_id linked_file_id,
+			%s
+FROM 		files f
+JOIN 		file_hashes fh ON f.file_hash_id = fh.id
+WHERE		f.id IN ?
+ORDER BY	f.size DESC -- to link the largest duplicates first, and for deterministic result order
+`, fileAbsolutePathCTEQuery)
+}
+
+func QueryGetFileHashIdsToScrub(lastFileHashID uint) string {
+	return fmt.Sprintf(`
+SELECT		fh.id,
+			BATCH_NUMBER
+FROM 		file_hashes fh
+WHERE		fh.id > %d
+AND			fh.zapped = 1
+AND			fh.ignored = 0
+ORDER BY	fh.id -- scrubs are resumed from the last ID checked
+`, lastFileHashID)
+}
+
+func QueryGetFileHashesToScrub() string {
+	return `
+SELECT		fh.id,
+			fh.hash,
+			fh.algorithm,
+			fh.corrupt
+FROM 		file_hashes fh
+WHERE		fh.id IN ?
+ORDER BY	fh.id -- for deterministic result order
+`
+}
+
+func QueryGetLinkedFileIds() string {
+	return `
+SELECT		f.id,
+			BATCH_NUMBER
+FROM 		files f
+WHERE		f.link_type IS NOT NULL
+AND			f.deleted_at IS NULL
+AND			f.ignored = 0
+ORDER BY	f.id -- for deterministic result order
+`
+}
+
+func QueryGetLinkedFiles() string {
+	return fmt.Sprintf(`
+SELECT		f.id file_id,
+			f.linked_file_id,
+			f.link_type,
+			fh.hash,
+			%s
+FROM 		files f
+JOIN 		file_hashes fh ON f.file_hash_id = fh.id
+WHERE		f.id IN ?
+ORDER BY	f.id -- for deterministic result order
+`, fileAbsolutePathCTEQuery)
+}
+
+func QueryGetSymlinkedFileIds() string {
+	return `
+SELECT		f.id,
+			BATCH_NUMBER
+FROM 		files f
+WHERE		f.link_type = 'symlink'
+AND			f.zapped = 1
+AND			f.deleted_at IS NULL
+AND			f.ignored = 0
+ORDER BY	f.id -- for deterministic result order
+`
+}
+
+func QueryGetSymlinkedFilesToMaterialise() string {
+	return fmt.Sprintf(`
+SELECT		fh.id file_hash_id,
+        	fh.hash,
+    		f.id file_id,
+			%s,
+			%s
+FROM 		files f
+JOIN 		file_hashes fh ON f.file_hash_id = fh.id
+WHERE		f.id IN ?
+ORDER BY	f.id -- for deterministic result order
+`, fmt.Sprintf(metadataColumns, "f"), fileAbsolutePathCTEQuery)
+}
+
+func QueryGetFilePaths() string {
+	return fmt.Sprintf(`
+SELECT		f.id file_id,
+			%s
+FROM 		files f
+WHERE		f.id IN ?
+ORDER BY	f.id -- for deterministic result order
+`, fileAbsolutePathCTEQuery)
+}
+
 func QueryGetZappedFolders() string {
 	return fmt.Sprintf(`
 SELECT		%s
@@ -143,6 +440,8 @@ func QueryGetZappedFileHashesToUnZapWithLimit() string {
 SELECT		fh.id file_hash_id,
         	fh.hash,
     		f.id file_id,
+			fh.corrupt,
+			%s,
 			%s
 FROM 		files f
 JOIN 		file_hashes fh ON f.file_hash_id = fh.id
@@ -154,7 +453,7 @@ AND			fh.ignored = 0
 AND			f.id NOT IN ?
 ORDER BY	f.id -- for deterministic result order
 LIMIT 		?
-`, fileAbsolutePathCTEQuery)
+`, fmt.Sprintf(metadataColumns, "f"), fileAbsolutePathCTEQuery)
 }
 
 func QueryGetExistingHashSignatures() string {
@@ -162,17 +461,163 @@ func QueryGetExistingHashSignatures() string {
 SELECT		fh.id hash_id,
     		fh.hash,
         	fh.size,
-        	fh.file_type_id,
-        	ft.type file_type
+        	fh.file_type_id
 FROM		file_hashes fh
-JOIN        file_types ft ON fh.file_type_id = ft.id
-WHERE 		fh.hash IS NOT NULL
-AND 		fh.size IS NOT NULL
-AND 		fh.file_type_id IS NOT NULL
+WHERE 		fh.size IS NOT NULL
+AND			fh.algorithm = ?
+AND 		fh.hash IN ?
 ORDER BY	fh.id -- for deterministic result order
 `
 }
 
+func QueryGetHashCacheEntries() string {
+	return `
+SELECT		hc.*
+FROM		hash_cache_entries hc
+INNER JOIN	files f ON f.device_id = hc.device_id AND f.inode = hc.inode
+WHERE		hc.algorithm = ?
+AND			f.id IN ?
+`
+}
+
+func QueryDeleteHashCacheEntriesOfFiles() string {
+	return `
+DELETE FROM	hash_cache_entries
+WHERE		id IN (
+	SELECT		hc.id
+	FROM		hash_cache_entries hc
+	INNER JOIN	files f ON f.device_id = hc.device_id AND f.inode = hc.inode
+	WHERE		f.id IN ?
+)
+`
+}
+
+func QueryGetPathTree() string {
+	return fmt.Sprintf(`
+%s
+SELECT		p.id path_id,
+			p.parent_path_id,
+			p.level,
+			p.name,
+			p.ignored,
+			%s
+FROM		path_tree pt
+JOIN		paths p ON p.id = pt.id
+ORDER BY	p.level, p.id -- parents first, and for deterministic result order
+`, pathTreeCTEQuery, fmt.Sprintf(metadataColumns, "p"))
+}
+
+func QueryGetFilesInPathTree() string {
+	return fmt.Sprintf(`
+%s
+SELECT		f.id file_id,
+			f.path_id,
+			f.name,
+			f.size,
+			f.ignored,
+			f.zapped,
+			f.link_type,
+			%s
+FROM		files f
+JOIN		path_tree pt ON f.path_id = pt.id
+WHERE		f.deleted_at IS NULL
+AND			pt.ignored = 0
+ORDER BY	f.id -- for deterministic result order
+`, pathTreeCTEQuery, fmt.Sprintf(metadataColumns, "f"))
+}
+
+func QueryGetRootPaths() string {
+	return `
+SELECT		p.id
+FROM		paths p
+WHERE		p.parent_path_id IS NULL
+AND			p.deleted_at IS NULL
+AND			p.ignored = 0
+ORDER BY	p.id -- for deterministic result order
+`
+}
+
+func QueryGetHashedFilesInPathTree() string {
+	return fmt.Sprintf(`
+%s
+SELECT		f.path_id,
+			f.name,
+			f.hash_deferred,
+			fh.hash,
+			fh.size
+FROM		files f
+JOIN		path_tree pt ON f.path_id = pt.id
+LEFT JOIN	file_hashes fh ON f.file_hash_id = fh.id
+WHERE		f.deleted_at IS NULL
+AND			f.ignored = 0
+AND			pt.ignored = 0
+ORDER BY	f.id -- for deterministic result order
+`, pathTreeCTEQuery)
+}
+
+func QueryDeleteUnusedPathHashes() string {
+	return `
+DELETE FROM	path_hashes
+WHERE		id NOT IN (SELECT path_hash_id FROM paths WHERE path_hash_id IS NOT NULL)
+AND			id NOT IN (SELECT path_hash_id FROM path_hash_notes)
+`
+}
+
+// One file of each hash is enough, as the contents are the same
+const firstFileOfHashQuery = `
+SELECT		MIN(f2.id)
+FROM		files f2
+WHERE		f2.file_hash_id = fh.id
+AND			f2.deleted_at IS NULL
+AND			f2.ignored = 0
+`
+
+func QueryCountImagesToPerceptuallyHash() string {
+	return `
+SELECT		COUNT(*)
+FROM		file_hashes fh
+JOIN		file_types ft ON fh.file_type_id = ft.id
+WHERE		fh.perceptual_hash IS NULL
+AND			fh.perceptual_hash_failed = 0
+AND			fh.ignored = 0
+AND			ft.type IN ?
+`
+}
+
+func QueryGetImagesToPerceptuallyHashWithLimit() string {
+	return fmt.Sprintf(`
+SELECT		fh.id file_hash_id,
+			fh.hash,
+			fh.zapped,
+			ft.type file_type,
+			f.id file_id,
+			%s
+FROM		file_hashes fh
+JOIN		file_types ft ON fh.file_type_id = ft.id
+LEFT JOIN	files f ON f.id = (%s)
+WHERE		fh.perceptual_hash IS NULL
+AND			fh.perceptual_hash_failed = 0
+AND			fh.ignored = 0
+AND			ft.type IN ?
+ORDER BY	fh.id -- for deterministic result order
+LIMIT		?
+`, fileAbsolutePathCTEQuery, firstFileOfHashQuery)
+}
+
+func QueryGetPerceptuallyHashedImages() string {
+	return fmt.Sprintf(`
+SELECT		fh.id file_hash_id,
+			fh.perceptual_hash,
+			fh.size,
+			%s
+FROM		file_hashes fh
+JOIN		files f ON f.id = (%s)
+WHERE		fh.perceptual_hash IS NOT NULL
+AND			fh.ignored = 0
+ORDER BY	fh.id -- for deterministic result order
+`, fileAbsolutePathCTEQuery, firstFileOfHashQuery)
+}
+
 func QueryGetExistingFileTypes() string {
 	return `
 SELECT		id,
@@ -182,6 +627,16 @@ ORDER BY	id -- for deterministic result order
 `
 }
 
+// QueryUpdateFileHashesByID sets a column of many file hashes to a value of their own in one statement. It takes the
+// ID and value of each file hash in turn, followed by all of their IDs.
+func QueryUpdateFileHashesByID(column string, count int) string {
+	return fmt.Sprintf(`
+UPDATE		file_hashes
+SET			%s = CASE id%s END
+WHERE		id IN ?
+`, column, strings.Repeat(" WHEN ? THEN ?", count))
+}
+
 func (ctx *Context) GetBatchesOfIDs(query, idPrefix string) (int64, [][]int, error) {
 	total := int64(0)
 	var output [][]int
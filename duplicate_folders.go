@@ -0,0 +1,362 @@
+package main
+
+import (
+	"data-tools/crypto"
+	"data-tools/models"
+	"data-tools/utils"
+	"github.com/dustin/go-humanize"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"maps"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+type HashedFileInPath struct {
+	PathID       uint
+	Name         string
+	Hash         *string
+	Size         *uint
+	HashDeferred bool
+}
+
+// folderHash is the Merkle-style hash of a folder tree, built from the hashes of its files and sub-folders
+type folderHash struct {
+	pathID         uint
+	parentPathID   *uint
+	absolutePath   string
+	hash           string
+	contentHash    string
+	size           uint
+	fileCount      uint
+	childPathCount uint
+	complete       bool // Every file in the tree has been hashed
+	unhashed       bool // Some file in the tree has not been hashed yet, as opposed to being deferred
+	ignored        bool
+	entries        []string
+	contentEntries []string
+}
+
+// DuplicateFolderGroup is a set of folder trees which are identical
+type DuplicateFolderGroup struct {
+	Size  uint
+	Paths []string
+}
+
+// DuplicateFolders hashes every crawled folder tree, then reports the trees which are identical, or which are identical
+// apart from the names of the files and folders in them
+func (ctx *Context) DuplicateFolders(ignoreNames bool) error {
+	groups, err := ctx.findDuplicateFolders(ignoreNames)
+
+	if err != nil {
+		return err
+	}
+
+	for _, group := range groups {
+		utils.ConsoleAndLogPrintf("%s identical folders of %s each:", humanize.Comma(int64(len(group.Paths))), humanize.Bytes(uint64(group.Size)))
+
+		for _, p := range group.Paths {
+			utils.ConsoleAndLogPrintf("  %s", p)
+		}
+	}
+
+	utils.ConsoleAndLogPrintf("Found %s of duplicate folders", utils.Pluralize("group", int64(len(groups))))
+	return nil
+}
+
+func (ctx *Context) findDuplicateFolders(ignoreNames bool) ([]DuplicateFolderGroup, error) {
+	var rootPathIDs []uint
+	result := ctx.DB.Raw(QueryGetRootPaths()).Scan(&rootPathIDs)
+
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	hasher, err := ctx.getHasher()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var folders []*folderHash
+
+	for _, rootPathID := range rootPathIDs {
+		rootFolders, err := ctx.hashFolders(hasher, rootPathID)
+
+		if err != nil {
+			return nil, err
+		}
+
+		folders = append(folders, rootFolders...)
+	}
+
+	err = ctx.savePathHashes(folders)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var unhashedCount int64 = 0
+
+	for _, folder := range folders {
+		if folder.unhashed {
+			unhashedCount++
+		}
+	}
+
+	if unhashedCount > 0 {
+		utils.ConsoleAndLogPrintf("Skipped %s containing files which have not been hashed. Run hash first to include them.", utils.Pluralize("folder", unhashedCount))
+	}
+
+	return groupDuplicateFolders(folders, ignoreNames), nil
+}
+
+// hashFolders hashes every folder beneath (and including) a root path. Folders are only hashed when every file in them
+// has been, and empty folders are left out of the hashes of their parents.
+func (ctx *Context) hashFolders(hasher *crypto.Hasher, rootPathID uint) ([]*folderHash, error) {
+	paths, _, err := ctx.getPathTree(rootPathID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var files []HashedFileInPath
+	result := ctx.DB.Raw(QueryGetHashedFilesInPathTree(), rootPathID).Scan(&files)
+
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	var folders []*folderHash
+	foldersByID := map[uint]*folderHash{}
+
+	for _, p := range paths {
+		folder := &folderHash{
+			pathID:       p.PathID,
+			parentPathID: p.ParentPathID,
+			absolutePath: p.absolutePath,
+			complete:     true,
+			ignored:      p.Ignored,
+		}
+
+		folders = append(folders, folder)
+		foldersByID[p.PathID] = folder
+	}
+
+	for _, file := range files {
+		folder := foldersByID[file.PathID]
+
+		// Files which cannot be duplicates are not hashed, and nor can the folders they are in be duplicates
+		if file.Hash == nil || file.Size == nil {
+			folder.complete = false
+			folder.unhashed = folder.unhashed || !file.HashDeferred
+			continue
+		}
+
+		// Names cannot contain a slash, so they are safe to separate with one
+		folder.entries = append(folder.entries, "file/"+file.Name+"/"+*file.Hash)
+		folder.contentEntries = append(folder.contentEntries, "file/"+*file.Hash)
+		folder.size += *file.Size
+		folder.fileCount++
+	}
+
+	// Parents are always returned before children, so work backwards to finish children first
+	for index := len(folders) - 1; index >= 0; index-- {
+		folder := folders[index]
+
+		if folder.ignored {
+			continue
+		}
+
+		if folder.complete && folder.fileCount > 0 {
+			sort.Strings(folder.entries)
+			sort.Strings(folder.contentEntries)
+
+			folder.hash = hasher.HashBytes([]byte(strings.Join(folder.entries, "\x00")))
+			folder.contentHash = hasher.HashBytes([]byte(strings.Join(folder.contentEntries, "\x00")))
+		}
+
+		if folder.parentPathID == nil {
+			continue
+		}
+
+		parent := foldersByID[*folder.parentPathID]
+		parent.childPathCount++
+
+		if !folder.complete {
+			parent.complete = false
+			parent.unhashed = parent.unhashed || folder.unhashed
+			continue
+		}
+
+		if folder.fileCount == 0 {
+			continue
+		}
+
+		parent.entries = append(parent.entries, "folder/"+filepath.Base(folder.absolutePath)+"/"+folder.hash)
+		parent.contentEntries = append(parent.contentEntries, "folder/"+folder.contentHash)
+		parent.size += folder.size
+		parent.fileCount += folder.fileCount
+	}
+
+	return folders, nil
+}
+
+// savePathHashes records the hash, size and number of sub-folders of every folder
+func (ctx *Context) savePathHashes(folders []*folderHash) error {
+	pathHashes := map[string]*models.PathHash{}
+
+	for _, folder := range folders {
+		if len(folder.hash) == 0 {
+			continue
+		}
+
+		size := folder.size
+		pathHashes[folder.hash] = &models.PathHash{
+			Hash:        folder.hash,
+			ContentHash: folder.contentHash,
+			Size:        &size,
+		}
+	}
+
+	hashes := slices.Sorted(maps.Keys(pathHashes))
+	batchSize := max(int(ctx.Config.BatchSize), 1) // slices.Chunk panics otherwise
+
+	return ctx.DB.Transaction(func(tx *gorm.DB) error {
+		pathHashIDs := map[string]uint{}
+		ignoredHashes := map[string]bool{}
+
+		for batch := range slices.Chunk(hashes, batchSize) {
+			var newPathHashes []*models.PathHash
+
+			for _, hash := range batch {
+				newPathHashes = append(newPathHashes, pathHashes[hash])
+			}
+
+			result := tx.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "hash"}},
+				DoUpdates: clause.AssignmentColumns([]string{"content_hash", "size"}),
+			}).Create(&newPathHashes)
+
+			if result.Error != nil {
+				return result.Error
+			}
+
+			var existingPathHashes []models.PathHash
+			result = tx.Where("hash IN ?", batch).Find(&existingPathHashes)
+
+			if result.Error != nil {
+				return result.Error
+			}
+
+			for _, pathHash := range existingPathHashes {
+				pathHashIDs[pathHash.Hash] = pathHash.ID
+				ignoredHashes[pathHash.Hash] = pathHash.Ignored
+			}
+		}
+
+		for _, folder := range folders {
+			var pathHashID *uint
+
+			if id, found := pathHashIDs[folder.hash]; found {
+				pathHashID = &id
+			}
+
+			// Ignored path hashes are kept out of the report
+			if ignoredHashes[folder.hash] {
+				folder.ignored = true
+			}
+
+			result := tx.Model(&models.Path{}).Where("id = ?", folder.pathID).Updates(map[string]interface{}{
+				"path_hash_id":     pathHashID,
+				"child_path_count": folder.childPathCount,
+				"size":             folder.size,
+			})
+
+			if result.Error != nil {
+				return result.Error
+			}
+		}
+
+		// Folders which have changed leave their old hashes behind
+		return tx.Exec(QueryDeleteUnusedPathHashes()).Error
+	})
+}
+
+// groupDuplicateFolders finds the folders which share a hash. Folders whose parents are duplicates of each other are
+// only reported when they are also duplicated somewhere else, so each duplicated tree is reported from its top.
+func groupDuplicateFolders(folders []*folderHash, ignoreNames bool) []DuplicateFolderGroup {
+	getKey := func(folder *folderHash) string {
+		if ignoreNames {
+			return folder.contentHash
+		}
+
+		return folder.hash
+	}
+
+	var keys []string
+	foldersByKey := map[string][]*folderHash{}
+	foldersByID := map[uint]*folderHash{}
+
+	for _, folder := range folders {
+		foldersByID[folder.pathID] = folder
+
+		if folder.ignored || len(folder.hash) == 0 {
+			continue
+		}
+
+		key := getKey(folder)
+
+		if _, found := foldersByKey[key]; !found {
+			keys = append(keys, key)
+		}
+
+		foldersByKey[key] = append(foldersByKey[key], folder)
+	}
+
+	isDuplicate := func(folder *folderHash) bool {
+		return !folder.ignored && len(folder.hash) > 0 && len(foldersByKey[getKey(folder)]) > 1
+	}
+
+	var groups []DuplicateFolderGroup
+
+	for _, key := range keys {
+		members := foldersByKey[key]
+
+		// Such as folders holding nothing but empty .gitignore files, which are not worth reporting
+		if len(members) < 2 || members[0].size == 0 {
+			continue
+		}
+
+		coveredByParents := true
+
+		for _, member := range members {
+			if member.parentPathID == nil || !isDuplicate(foldersByID[*member.parentPathID]) {
+				coveredByParents = false
+				break
+			}
+		}
+
+		if coveredByParents {
+			continue
+		}
+
+		group := DuplicateFolderGroup{Size: members[0].size}
+
+		for _, member := range members {
+			group.Paths = append(group.Paths, member.absolutePath)
+		}
+
+		sort.Strings(group.Paths)
+		groups = append(groups, group)
+	}
+
+	// Largest first, as these are the most worth dealing with
+	sort.SliceStable(groups, func(i, j int) bool {
+		return groups[i].Size*uint(len(groups[i].Paths)-1) > groups[j].Size*uint(len(groups[j].Paths)-1)
+	})
+
+	return groups
+}
@@ -0,0 +1,77 @@
+//go:build integration
+// +build integration
+
+package main
+
+import (
+	"data-tools/config"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestDuplicateFolders(t *testing.T) {
+	tempTestDataPath := createTempTestDataPath(t)
+	defer os.RemoveAll(tempTestDataPath)
+
+	c := &config.Config{
+		DBPath:                      path.Join(tempTestDataPath, "db.db"),
+		BatchSize:                   5,
+		MaxConcurrentFileOperations: 2,
+		ZapDataPath:                 path.Join(tempTestDataPath, "ZAP"),
+	}
+
+	ctx := &Context{
+		Config: c,
+		DB:     initDb(c),
+	}
+
+	// b2 is an exact copy of b, and b3 is a copy with a file renamed
+	dataPath := path.Join(tempTestDataPath, "a")
+	assert.NoError(t, CopyOrMoveFiles(path.Join(dataPath, "b"), path.Join(dataPath, "b2"), false, false))
+	assert.NoError(t, CopyOrMoveFiles(path.Join(dataPath, "b"), path.Join(dataPath, "b3"), false, false))
+	assert.NoError(t, os.Rename(path.Join(dataPath, "b3", "j.txt"), path.Join(dataPath, "b3", "k.txt")))
+
+	err := ctx.Crawl(dataPath)
+	assert.NoError(t, err)
+
+	// Folders are not hashed until their files are
+	groups, err := ctx.findDuplicateFolders(false)
+	assert.NoError(t, err)
+	assert.Empty(t, groups)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM path_hashes", 0)
+
+	err = ctx.HashFiles()
+	assert.NoError(t, err)
+
+	groups, err = ctx.findDuplicateFolders(false)
+	assert.NoError(t, err)
+
+	// The c folders are identical too, but only hold an empty file
+	assert.Equal(t, []DuplicateFolderGroup{
+		{Size: 255636, Paths: []string{path.Join(dataPath, "b"), path.Join(dataPath, "b2")}},
+	}, groups)
+
+	groups, err = ctx.findDuplicateFolders(true)
+	assert.NoError(t, err)
+	assert.Equal(t, []DuplicateFolderGroup{
+		{Size: 255636, Paths: []string{path.Join(dataPath, "b"), path.Join(dataPath, "b2"), path.Join(dataPath, "b3")}},
+	}, groups)
+
+	// The root, a, b (and b2), b3, and c (in each of b, b2 and b3)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM path_hashes", 5)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM paths WHERE path_hash_id IS NOT NULL", 8)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM paths WHERE parent_path_id IS NULL AND child_path_count = 4", 1)
+
+	// Changing a folder replaces its hash, and the hashes of the folders above it
+	assert.NoError(t, os.WriteFile(path.Join(dataPath, "b2", "new.txt"), []byte("new"), 0644))
+	assert.NoError(t, ctx.ReCrawl(dataPath))
+	assert.NoError(t, ctx.HashFiles())
+
+	// Only the c folders are still the same
+	groups, err = ctx.findDuplicateFolders(false)
+	assert.NoError(t, err)
+	assert.Empty(t, groups)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM path_hashes", 6)
+}
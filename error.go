@@ -1,12 +1,37 @@
 package main
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var (
 	ErrCouldNotResolvePath                 = errors.New("could not resolve path")
 	ErrPathAlreadyAdded                    = errors.New("this path has already been added")
+	ErrPathNotAdded                        = errors.New("this path has not been added")
 	ErrCouldNotResolveHash                 = errors.New("could not resolve hash")
 	ErrCouldNotResolveFileType             = errors.New("could not resolve file type")
 	ErrNotOverwritingExistingDifferentFile = errors.New("not overwriting existing (different) file")
 	ErrDestinationPathNotEmpty             = errors.New("the destination path is not empty")
+	ErrFileContentsDiffer                  = errors.New("the contents of the files differ")
+	ErrNoZapSecret                         = errors.New("a key file or " + zapPassphraseVariable + " is needed for an encrypted ZAP folder")
+	ErrZapFolderNotEncrypted               = errors.New("the ZAP folder already has unencrypted files in it")
+	ErrZapFoldersEncryptedDifferently      = errors.New("the ZAP folders are not encrypted with the same key")
+	ErrZapRelayoutUnfinished               = errors.New("the ZAP folder was being moved to another layout, run relayout to finish")
 )
+
+// FileOperationError describes a file which could not be moved or copied
+type FileOperationError struct {
+	Op          string
+	Source      string
+	Destination string
+	Err         error
+}
+
+func (e *FileOperationError) Error() string {
+	return fmt.Sprintf("could not %s \"%s\" to \"%s\": %v", e.Op, e.Source, e.Destination, e.Err)
+}
+
+func (e *FileOperationError) Unwrap() error {
+	return e.Err
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"data-tools/magic"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -24,11 +25,27 @@ func IsFile(path string) bool {
 	return false
 }
 
+const (
+	FileTypeBackendNative = "native"
+	FileTypeBackendFile   = "file"
+)
+
+const fileCommandPath = "/usr/bin/file"
+
+// GetFileType detects the MIME type of a file with the configured backend
+func GetFileType(filePath string, backend string) (string, error) {
+	if backend == FileTypeBackendFile {
+		return getFileTypeWithFileCommand(filePath)
+	}
+
+	return magic.DetectFile(filePath)
+}
+
 // file -b --mime-type test.db
 // application/vnd.sqlite3
 
-func GetFileType(filePath string) (string, error) {
-	command := exec.Command("/usr/bin/file", "-b", "--mime-type", filePath)
+func getFileTypeWithFileCommand(filePath string) (string, error) {
+	command := exec.Command(fileCommandPath, "-b", "--mime-type", filePath)
 	output, err := command.Output()
 
 	if err != nil {
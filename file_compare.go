@@ -27,12 +27,25 @@ func CompareFiles(left, right string) (bool, error) {
 
 	defer f2.Close()
 
+	return compareReaders(f1, f2)
+}
+
+// compareReaders reads full buffers so that readers which return short reads (e.g. at the end of a chunk) still line up
+func compareReaders(f1, f2 io.Reader) (bool, error) {
 	buf1 := make([]byte, bufferSize)
 	buf2 := make([]byte, bufferSize)
 
 	for {
-		n1, err1 := f1.Read(buf1)
-		n2, err2 := f2.Read(buf2)
+		n1, err1 := io.ReadFull(f1, buf1)
+		n2, err2 := io.ReadFull(f2, buf2)
+
+		if err1 == io.ErrUnexpectedEOF {
+			err1 = io.EOF
+		}
+
+		if err2 == io.ErrUnexpectedEOF {
+			err2 = io.EOF
+		}
 
 		if err1 != nil && err1 != io.EOF {
 			return false, fmt.Errorf("error reading file for left-hand comparison: %v", err1)
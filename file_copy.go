@@ -1,14 +1,15 @@
 package main
 
 import (
-	"bytes"
 	"errors"
+	"fmt"
+	"io"
 	"log"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
 	"strings"
+	"syscall"
 )
 
 func CopyOrMoveFiles(source, destination string, move, isDestinationZap bool) error {
@@ -98,35 +99,101 @@ func CopyOrMoveFile(source, destination string, move, isDestinationZap bool) (bo
 	return false, errors.New("comparisonResult test not implemented")
 }
 
-// we use the OS rather than golang API to get around limitations e.g. file operations across different filesystems
+// osMove renames a file, falling back to copying and removing it when the destination is on a different filesystem
 func osMove(source, destination string) error {
-	command := exec.Command("/bin/mv", source, destination)
-	return debuggableExecution(command)
+	err := os.Rename(source, destination)
+
+	if err == nil {
+		return nil
+	}
+
+	if !errors.Is(err, syscall.EXDEV) {
+		return &FileOperationError{Op: "move", Source: source, Destination: destination, Err: err}
+	}
+
+	return moveByCopying(source, destination)
 }
 
-// we use the OS rather than golang API to get around imitations e.g. file operations across different filesystems
+func moveByCopying(source, destination string) error {
+	err := osCopy(source, destination)
+
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(source)
+
+	if err != nil {
+		return &FileOperationError{Op: "move", Source: source, Destination: destination, Err: err}
+	}
+
+	return nil
+}
+
+// osCopy copies a file along with its permissions, timestamps and (when running as root) ownership, where the destination
+// allows them to be set. The copy is synced to disk before returning so that the source can safely be removed. Copying
+// between files lets the kernel do the work where it can (copy_file_range or sendfile on Linux).
 func osCopy(source, destination string) error {
-	command := exec.Command("/bin/cp", source, destination)
-	return debuggableExecution(command)
+	err := copyFile(source, destination)
+
+	if err != nil {
+		return &FileOperationError{Op: "copy", Source: source, Destination: destination, Err: err}
+	}
+
+	return nil
 }
 
-func debuggableExecution(cmd *exec.Cmd) error {
-	var stdout bytes.Buffer
-	var stderr bytes.Buffer
+func copyFile(source, destination string) error {
+	sourceFile, err := os.Open(path.Clean(source))
+
+	if err != nil {
+		return err
+	}
 
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
+	defer sourceFile.Close()
 
-	err := cmd.Run()
+	info, err := sourceFile.Stat()
 
 	if err != nil {
-		stdoutStr := stdout.String()
-		stderrStr := stderr.String()
+		return err
+	}
+
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("\"%s\" is not a regular file", source)
+	}
+
+	destinationFile, err := os.OpenFile(path.Clean(destination), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
 
-		log.Print(stdoutStr, stderrStr, err)
+	if err != nil {
 		return err
 	}
 
+	_, err = io.Copy(destinationFile, sourceFile)
+
+	if err == nil {
+		err = destinationFile.Sync()
+	}
+
+	closeErr := destinationFile.Close()
+
+	if err == nil {
+		err = closeErr
+	}
+
+	// Never leave a partial copy behind
+	if err != nil {
+		_ = os.Remove(destination)
+		return err
+	}
+
+	// Filesystems such as SMB and exFAT often refuse to change ownership, permissions or timestamps, which is no reason
+	// to throw away a good copy
+	err = ApplyMetadata(destination, GetMetadata(info))
+
+	if err != nil {
+		log.Printf("Warning: Could not copy the metadata of \"%s\" to \"%s\": %v", source, destination, err)
+	}
+
 	return nil
 }
 
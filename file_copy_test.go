@@ -2,9 +2,11 @@ package main
 
 import (
 	"github.com/stretchr/testify/assert"
+	"io/fs"
 	"os"
 	"path"
 	"testing"
+	"time"
 )
 
 func TestFileCopyShouldCreateDirectoryAndCopy(t *testing.T) {
@@ -56,3 +58,60 @@ func TestFileCopyShouldDoNothingIfTheFileIsDifferent(t *testing.T) {
 	assert.NoError(t, err)
 	assert.False(t, filesEqual)
 }
+
+func TestOsCopyShouldPreserveMetadata(t *testing.T) {
+	tempTestDataPath := createTempTestDataPath(t)
+	defer os.RemoveAll(tempTestDataPath)
+
+	sourceFilePath := path.Join(tempTestDataPath, "/a/file.md")
+	destinationFilePath := path.Join(tempTestDataPath, "/a/file2.md")
+
+	modTime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	assert.NoError(t, os.Chmod(sourceFilePath, 0640))
+	assert.NoError(t, os.Chtimes(sourceFilePath, modTime, modTime))
+
+	assert.NoError(t, osCopy(sourceFilePath, destinationFilePath))
+
+	filesEqual, err := CompareFiles(sourceFilePath, destinationFilePath)
+	assert.NoError(t, err)
+	assert.True(t, filesEqual)
+
+	info, err := os.Stat(destinationFilePath)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+	assert.True(t, modTime.Equal(info.ModTime()))
+}
+
+func TestMoveByCopyingShouldRemoveSource(t *testing.T) {
+	tempTestDataPath := createTempTestDataPath(t)
+	defer os.RemoveAll(tempTestDataPath)
+
+	sourceFilePath := path.Join(tempTestDataPath, "/a/b/4276652.png")
+	destinationFilePath := path.Join(tempTestDataPath, "/a/moved.png")
+
+	// This is what happens when renaming across filesystems fails
+	assert.NoError(t, moveByCopying(sourceFilePath, destinationFilePath))
+
+	assert.False(t, IsFile(sourceFilePath))
+	assert.True(t, IsFile(destinationFilePath))
+}
+
+func TestOsMoveShouldReturnFileOperationError(t *testing.T) {
+	tempTestDataPath := createEmptyTempTestDataPath(t)
+	defer os.RemoveAll(tempTestDataPath)
+
+	sourceFilePath := path.Join(tempTestDataPath, "missing.md")
+	destinationFilePath := path.Join(tempTestDataPath, "moved.md")
+
+	err := osMove(sourceFilePath, destinationFilePath)
+
+	var fileOperationError *FileOperationError
+	assert.ErrorAs(t, err, &fileOperationError)
+	assert.Equal(t, "move", fileOperationError.Op)
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	err = osCopy(sourceFilePath, destinationFilePath)
+	assert.ErrorAs(t, err, &fileOperationError)
+	assert.Equal(t, "copy", fileOperationError.Op)
+	assert.False(t, IsFile(destinationFilePath))
+}
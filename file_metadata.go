@@ -0,0 +1,79 @@
+package main
+
+import (
+	"data-tools/models"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// GetMetadata captures what we need from the filesystem in order to detect changes and restore files faithfully
+func GetMetadata(info fs.FileInfo) models.Metadata {
+	modTime := info.ModTime()
+	mode := uint32(info.Mode())
+
+	metadata := models.Metadata{
+		ModTime: &modTime,
+		Mode:    &mode,
+	}
+
+	// Ownership, inode and device details are not available on all platforms
+	populatePlatformMetadata(info, &metadata)
+
+	return metadata
+}
+
+// metadataChanged ignores the access time, which changes whenever a file is read
+func metadataChanged(existing, current models.Metadata) bool {
+	if existing.ModTime == nil || current.ModTime == nil || !existing.ModTime.Equal(*current.ModTime) {
+		return true
+	}
+
+	return !equalPointerValues(existing.Mode, current.Mode) ||
+		!equalPointerValues(existing.UID, current.UID) ||
+		!equalPointerValues(existing.GID, current.GID) ||
+		!equalPointerValues(existing.Inode, current.Inode) ||
+		!equalPointerValues(existing.DeviceID, current.DeviceID)
+}
+
+func equalPointerValues[T comparable](left, right *T) bool {
+	if left == nil || right == nil {
+		return left == right
+	}
+
+	return *left == *right
+}
+
+// ApplyMetadata restores the ownership (only possible when running as root), permissions and timestamps of a file or folder
+func ApplyMetadata(filePath string, metadata models.Metadata) error {
+	// Ownership must be restored first because changing it clears the setuid and setgid bits
+	if metadata.UID != nil && metadata.GID != nil && os.Geteuid() == 0 {
+		err := os.Lchown(filePath, int(*metadata.UID), int(*metadata.GID))
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if metadata.Mode != nil {
+		mode := fs.FileMode(*metadata.Mode) & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)
+		err := os.Chmod(filePath, mode)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if metadata.ModTime != nil {
+		// A zero access time leaves the access time as-is
+		accessTime := time.Time{}
+
+		if metadata.AccessTime != nil {
+			accessTime = *metadata.AccessTime
+		}
+
+		return os.Chtimes(filePath, accessTime, *metadata.ModTime)
+	}
+
+	return nil
+}
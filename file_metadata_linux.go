@@ -0,0 +1,10 @@
+package main
+
+import (
+	"syscall"
+	"time"
+)
+
+func statAccessTime(stat *syscall.Stat_t) time.Time {
+	return time.Unix(stat.Atim.Unix())
+}
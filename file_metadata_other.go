@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"data-tools/models"
+	"io/fs"
+)
+
+func populatePlatformMetadata(_ fs.FileInfo, _ *models.Metadata) {
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/fs"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestMetadataChangedShouldIgnoreAccessTime(t *testing.T) {
+	tempTestDataPath := createTempTestDataPath(t)
+	defer os.RemoveAll(tempTestDataPath)
+
+	filePath := path.Join(tempTestDataPath, "a", "file.md")
+
+	info, err := os.Stat(filePath)
+	assert.NoError(t, err)
+
+	original := GetMetadata(info)
+	assert.NotNil(t, original.ModTime)
+	assert.NotNil(t, original.Mode)
+	assert.Equal(t, uint32(info.Mode()), *original.Mode)
+
+	_, err = os.ReadFile(filePath)
+	assert.NoError(t, err)
+
+	info, err = os.Stat(filePath)
+	assert.NoError(t, err)
+
+	assert.False(t, metadataChanged(original, GetMetadata(info)))
+
+	err = os.Chmod(filePath, 0400)
+	assert.NoError(t, err)
+
+	info, err = os.Stat(filePath)
+	assert.NoError(t, err)
+
+	changed := GetMetadata(info)
+	assert.True(t, metadataChanged(original, changed))
+	assert.Equal(t, fs.FileMode(0400), fs.FileMode(*changed.Mode).Perm())
+}
@@ -0,0 +1,29 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"data-tools/models"
+	"io/fs"
+	"syscall"
+)
+
+func populatePlatformMetadata(info fs.FileInfo, metadata *models.Metadata) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+
+	if !ok {
+		return
+	}
+
+	accessTime := statAccessTime(stat)
+	uid := stat.Uid
+	gid := stat.Gid
+	inode := stat.Ino
+	deviceID := uint64(stat.Dev) // #nosec G115 -- this is int32 on macOS
+
+	metadata.AccessTime = &accessTime
+	metadata.UID = &uid
+	metadata.GID = &gid
+	metadata.Inode = &inode
+	metadata.DeviceID = &deviceID
+}
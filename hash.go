@@ -1,15 +1,16 @@
 package main
 
 import (
+	"data-tools/blobstore"
 	"encoding/hex"
 	"github.com/btcsuite/btcd/btcutil/base58"
-	"path"
 )
 
 func DecodeHash(hash string) string {
 	return hex.EncodeToString(base58.Decode(hash))
 }
 
+// FormatRelativeZapFilePathFromHash is where a file is stored in a ZAP folder with the default layout
 func FormatRelativeZapFilePathFromHash(hash string) string {
-	return path.Join(hash[:2], hash[2:4], hash[4:])
+	return blobstore.DefaultLayout.RelativePath(hash)
 }
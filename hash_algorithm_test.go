@@ -0,0 +1,60 @@
+//go:build integration
+// +build integration
+
+package main
+
+import (
+	"data-tools/config"
+	"data-tools/crypto"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestHashFilesShouldRecordTheAlgorithm(t *testing.T) {
+	tempTestDataPath := createTempTestDataPath(t)
+	defer os.RemoveAll(tempTestDataPath)
+
+	c := &config.Config{
+		DBPath:                      path.Join(tempTestDataPath, "db.db"),
+		BatchSize:                   5,
+		MaxConcurrentFileOperations: 2,
+		ZapDataPath:                 path.Join(tempTestDataPath, "ZAP"),
+		HashAlgorithm:               crypto.BLAKE3,
+	}
+
+	ctx := &Context{
+		Config: c,
+		DB:     initDb(c),
+	}
+
+	dataPath := path.Join(tempTestDataPath, "a")
+	err := ctx.Crawl(dataPath)
+	assert.NoError(t, err)
+
+	err = ctx.HashFiles()
+	assert.NoError(t, err)
+
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes WHERE algorithm = 'blake3'", 3)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes WHERE hash = 'HvM7bSzsjbzmmr87LBcwUtWKaGVjYjK99iKgccknFEAZ'", 1)
+
+	// Hashes made with a different algorithm are not matched
+	c.HashAlgorithm = crypto.SHA256
+	newFilePath := path.Join(dataPath, "b", "copy.md")
+	assert.NoError(t, os.WriteFile(newFilePath, []byte("# File"), 0644))
+
+	err = ctx.ReCrawl(dataPath)
+	assert.NoError(t, err)
+
+	err = ctx.HashFiles()
+	assert.NoError(t, err)
+
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes WHERE algorithm = 'sha256'", 1)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes", 4)
+
+	// ZAP-ping still works with a mixed catalog
+	err = ctx.Zap()
+	assert.NoError(t, err)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes WHERE zapped = 1", 4)
+}
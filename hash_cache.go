@@ -0,0 +1,143 @@
+package main
+
+import (
+	"data-tools/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"io/fs"
+)
+
+// hashCacheKey is where a file is stored on disk, which stays the same while it is modified in place
+type hashCacheKey struct {
+	DeviceID uint64
+	Inode    uint64
+}
+
+// getHashCache loads the cached hashes of a batch of files. Nothing is loaded when the cache is disabled or ignored.
+func (ctx *Context) getHashCache(algorithm string, files []FileIdAndPath) (map[hashCacheKey]models.HashCacheEntry, error) {
+	if !ctx.Config.HashCache || ctx.IgnoreHashCache {
+		return nil, nil
+	}
+
+	var fileIDs []uint
+
+	for _, file := range files {
+		fileIDs = append(fileIDs, file.FileID)
+	}
+
+	var entries []models.HashCacheEntry
+	result := ctx.DB.Raw(QueryGetHashCacheEntries(), algorithm, fileIDs).Scan(&entries)
+
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	hashCache := map[hashCacheKey]models.HashCacheEntry{}
+
+	for _, entry := range entries {
+		hashCache[hashCacheKey{DeviceID: entry.DeviceID, Inode: entry.Inode}] = entry
+	}
+
+	return hashCache, nil
+}
+
+// newHashCacheEntry describes a file as it is now, without a hash. Nil is returned where inodes are not available.
+func newHashCacheEntry(algorithm string, info fs.FileInfo) *models.HashCacheEntry {
+	metadata := GetMetadata(info)
+
+	if metadata.DeviceID == nil || metadata.Inode == nil {
+		return nil
+	}
+
+	return &models.HashCacheEntry{
+		DeviceID:  *metadata.DeviceID,
+		Inode:     *metadata.Inode,
+		Algorithm: algorithm,
+		Size:      uint(info.Size()),
+		ModTimeNs: info.ModTime().UnixNano(),
+	}
+}
+
+// findInHashCache returns the cached hash of a file, as long as the file has not changed size or been modified since
+func findInHashCache(hashCache map[hashCacheKey]models.HashCacheEntry, entry *models.HashCacheEntry) (models.HashCacheEntry, bool) {
+	if entry == nil {
+		return models.HashCacheEntry{}, false
+	}
+
+	cached, found := hashCache[hashCacheKey{DeviceID: entry.DeviceID, Inode: entry.Inode}]
+
+	if !found || cached.Size != entry.Size || cached.ModTimeNs != entry.ModTimeNs {
+		return models.HashCacheEntry{}, false
+	}
+
+	return cached, true
+}
+
+// updateHashCache records the hashes of files which were read, and forgets those of files which failed the hash
+// collision check, as a cached hash may be the reason
+func (ctx *Context) updateHashCache(tx *gorm.DB, hashedFiles []HashedFile, failedFileIDs []uint) error {
+	if !ctx.Config.HashCache {
+		return nil
+	}
+
+	failed := map[uint]bool{}
+
+	for _, fileID := range failedFileIDs {
+		failed[fileID] = true
+	}
+
+	// Hardlinked files share an inode, so there is only one entry for them
+	entries := map[hashCacheKey]*models.HashCacheEntry{}
+
+	for _, file := range hashedFiles {
+		if file.cacheEntry == nil {
+			continue
+		}
+
+		key := hashCacheKey{DeviceID: file.cacheEntry.DeviceID, Inode: file.cacheEntry.Inode}
+
+		if failed[file.FileID] {
+			result := tx.Where("device_id = ? AND inode = ? AND algorithm = ?", key.DeviceID, key.Inode, file.cacheEntry.Algorithm).Delete(&models.HashCacheEntry{})
+
+			if result.Error != nil {
+				return result.Error
+			}
+
+			delete(entries, key)
+			continue
+		}
+
+		if file.fromCache {
+			continue
+		}
+
+		entry := *file.cacheEntry
+		entry.Hash = file.Hash
+		entry.FileType = file.FileType
+		entries[key] = &entry
+	}
+
+	if len(entries) == 0 {
+		return nil
+	}
+
+	var newEntries []*models.HashCacheEntry
+
+	for _, entry := range entries {
+		newEntries = append(newEntries, entry)
+	}
+
+	return tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "device_id"}, {Name: "inode"}, {Name: "algorithm"}},
+		DoUpdates: clause.AssignmentColumns([]string{"size", "mod_time_ns", "hash", "file_type"}),
+	}).Create(&newEntries).Error
+}
+
+// forgetCachedHashes removes the cached hashes of files whose contents were found to no longer match their hash
+func forgetCachedHashes(tx *gorm.DB, fileIDs []uint) error {
+	if len(fileIDs) == 0 {
+		return nil
+	}
+
+	return tx.Exec(QueryDeleteHashCacheEntriesOfFiles(), fileIDs).Error
+}
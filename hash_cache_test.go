@@ -0,0 +1,80 @@
+//go:build integration
+// +build integration
+
+package main
+
+import (
+	"data-tools/config"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestHashFilesShouldUseTheHashCache(t *testing.T) {
+	tempTestDataPath := createTempTestDataPath(t)
+	defer os.RemoveAll(tempTestDataPath)
+
+	c := &config.Config{
+		DBPath:                      path.Join(tempTestDataPath, "db.db"),
+		BatchSize:                   5,
+		MaxConcurrentFileOperations: 2,
+		ZapDataPath:                 path.Join(tempTestDataPath, "ZAP"),
+		HashCache:                   true,
+	}
+
+	ctx := &Context{
+		Config: c,
+		DB:     initDb(c),
+	}
+
+	dataPath := path.Join(tempTestDataPath, "a")
+	err := ctx.Crawl(dataPath)
+	assert.NoError(t, err)
+
+	err = ctx.HashFiles()
+	assert.NoError(t, err)
+
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM hash_cache_entries", 5)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes", 3)
+
+	// Change the contents without changing the size or modification time, so only the cache can tell
+	filePath := path.Join(dataPath, "file.md")
+	info, err := os.Stat(filePath)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(filePath, []byte("# Edit"), 0644))
+	assert.NoError(t, os.Chtimes(filePath, info.ModTime(), info.ModTime()))
+
+	resetHashes := func() {
+		result := ctx.DB.Exec("UPDATE files SET file_hash_id = NULL")
+		assert.NoError(t, result.Error)
+	}
+
+	resetHashes()
+	err = ctx.HashFiles()
+	assert.NoError(t, err)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes", 3)
+
+	// Ignoring the cache reads the file and refreshes its entry
+	resetHashes()
+	ctx.IgnoreHashCache = true
+	err = ctx.HashFiles()
+	assert.NoError(t, err)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes", 4)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM hash_cache_entries", 5)
+
+	resetHashes()
+	ctx.IgnoreHashCache = false
+	err = ctx.HashFiles()
+	assert.NoError(t, err)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes", 4)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM files WHERE file_hash_id IS NULL", 0)
+
+	// Files found to have changed when verifying lose their cache entry
+	err = ctx.DB.Transaction(func(tx *gorm.DB) error {
+		return flagHashMismatchesInDB(tx, []uint{1})
+	})
+	assert.NoError(t, err)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM hash_cache_entries", 4)
+}
@@ -9,7 +9,10 @@ import (
 	"github.com/schollz/progressbar/v3"
 	"gorm.io/gorm"
 	"log"
+	"maps"
 	"os"
+	"slices"
+	"sort"
 )
 
 type HashSignature struct {
@@ -26,9 +29,49 @@ type FileIdAndPath struct {
 	AbsolutePath string
 }
 
+// HashedFile is the result of hashing a single file
+type HashedFile struct {
+	FileIdAndPath
+	Hash       string
+	Size       uint
+	FileType   string
+	cacheEntry *models.HashCacheEntry // Nil where inodes are not available
+	fromCache  bool
+}
+
+type HashStats struct {
+	NewUniqueHashes     int64
+	DuplicateFileHashes int64
+	TotalFileSize       uint
+	DuplicateFileSize   uint
+	CachedFiles         int64
+}
+
 func (ctx *Context) HashFiles() error {
+	if ctx.Config.HashPrefilter {
+		err := ctx.prefilterFilesToHash()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	err := ctx.hashFiles()
+
+	if err != nil {
+		return err
+	}
+
+	if ctx.Config.PerceptualHash {
+		return ctx.hashImages()
+	}
+
+	return nil
+}
+
+func (ctx *Context) hashFiles() error {
 	var count int64 = 0
-	result := ctx.DB.Model(&models.File{}).Where("deleted_at IS NULL AND file_hash_id IS NULL AND size IS NULL AND file_type_id IS NULL AND ignored = 0").Count(&count)
+	result := ctx.DB.Model(&models.File{}).Where("deleted_at IS NULL AND file_hash_id IS NULL AND hash_deferred = 0 AND ignored = 0").Count(&count)
 
 	if result.Error != nil {
 		return result.Error
@@ -40,15 +83,14 @@ func (ctx *Context) HashFiles() error {
 		return nil
 	}
 
-	utils.ConsoleAndLogPrintf("Acquiring data")
-
-	var hashSignatures []HashSignature
-	result = ctx.DB.Raw(QueryGetExistingHashSignatures()).Scan(&hashSignatures)
+	hasher, err := ctx.getHasher()
 
-	if result.Error != nil {
-		return result.Error
+	if err != nil {
+		return err
 	}
 
+	utils.ConsoleAndLogPrintf("Acquiring data")
+
 	var existingFileTypes []models.FileType
 	result = ctx.DB.Raw(QueryGetExistingFileTypes()).Scan(&existingFileTypes)
 
@@ -56,19 +98,25 @@ func (ctx *Context) HashFiles() error {
 		return result.Error
 	}
 
-	utils.ConsoleAndLogPrintf("Hashing %s", utils.Pluralize("file", count))
+	fileTypeIDs := map[string]uint{}
+
+	for _, fileType := range existingFileTypes {
+		fileTypeIDs[fileType.Type] = fileType.ID
+	}
+
+	utils.ConsoleAndLogPrintf("Hashing %s with %s", utils.Pluralize("file", count), hasher.Algorithm)
 
 	bar := progressbar.Default(count)
+	stats := &HashStats{}
 
-	totalNewUniqueHashes := int64(0)
-	duplicateFileHashes := 0
-	totalFileSize := uint(0)
-	duplicateFileSize := uint(0)
+	// Files which could not be hashed are skipped so that they are not selected again.
+	// We need something in the array for gorm to work. No file will have an ID of 0
+	failedFileIDs := []uint{0}
 
 	// Do batches until there are no more
 	for {
 		var files []FileIdAndPath
-		result := ctx.DB.Raw(QueryUnHashedFilePathsWithLimit(), ctx.Config.BatchSize).Scan(&files)
+		result := ctx.DB.Raw(QueryUnHashedFilePathsWithLimit(), failedFileIDs, ctx.Config.BatchSize).Scan(&files)
 
 		if result.Error != nil {
 			return result.Error
@@ -76,109 +124,204 @@ func (ctx *Context) HashFiles() error {
 
 		// Have we finished?
 		if len(files) == 0 {
-			utils.ConsoleAndLogPrintf("Processed %s. Total new and unique file hashes found: %s, duplicate file hashes: %s (%s)", humanize.Bytes(uint64(totalFileSize)), humanize.Comma(totalNewUniqueHashes), humanize.Comma(int64(duplicateFileHashes)), humanize.Bytes(uint64(duplicateFileSize)))
+			if stats.CachedFiles > 0 {
+				utils.ConsoleAndLogPrintf("Used the cached hashes of %s which had not changed", utils.Pluralize("file", stats.CachedFiles))
+			}
+
+			utils.ConsoleAndLogPrintf("Processed %s. Total new and unique file hashes found: %s, duplicate file hashes: %s (%s)", humanize.Bytes(uint64(stats.TotalFileSize)), humanize.Comma(stats.NewUniqueHashes), humanize.Comma(stats.DuplicateFileHashes), humanize.Bytes(uint64(stats.DuplicateFileSize)))
 			return nil
 		}
 
+		hashCache, err := ctx.getHashCache(hasher.Algorithm, files)
+
+		if err != nil {
+			return err
+		}
+
+		var hashedFiles []HashedFile
 		var notFoundFileIDs []uint
 
 		orchestrator := utils.NewTaskOrchestrator(bar, len(files), ctx.Config.MaxConcurrentFileOperations)
 
 		for _, file := range files {
 			orchestrator.StartTask()
-			go hashFile(orchestrator, &hashSignatures, &notFoundFileIDs, file)
+			go ctx.hashFile(orchestrator, hasher, hashCache, &hashedFiles, &notFoundFileIDs, &failedFileIDs, file)
 		}
 
 		orchestrator.WaitForTasks()
 
-		err := ctx.DB.Transaction(func(tx *gorm.DB) error {
-			for hashSignatureIndex, hashSignature := range hashSignatures {
-				// Try to resolve the file type ID if required
-				if hashSignature.FileTypeID == nil {
-					for _, fileType := range existingFileTypes {
-						if hashSignature.FileType == fileType.Type {
-							hashSignatures[hashSignatureIndex].FileTypeID = &fileType.ID
-							break
-						}
-					}
-				}
+		for _, file := range hashedFiles {
+			if file.fromCache {
+				stats.CachedFiles++
+			}
+		}
 
-				// Create a new FileType if required
-				if hashSignatures[hashSignatureIndex].FileTypeID == nil {
-					fileTypeModel := models.FileType{Type: hashSignature.FileType}
+		signatures, err := ctx.getHashSignatures(hasher.Algorithm, hashedFiles, &failedFileIDs)
 
-					createFileTypeResult := tx.Create(&fileTypeModel)
+		if err != nil {
+			return err
+		}
 
-					if createFileTypeResult.Error != nil {
-						return createFileTypeResult.Error
-					}
+		err = ctx.DB.Transaction(func(tx *gorm.DB) error {
+			for _, signature := range signatures {
+				err := recordHashSignature(tx, hasher.Algorithm, signature, fileTypeIDs, stats)
 
-					hashSignatures[hashSignatureIndex].FileTypeID = &fileTypeModel.ID
-					existingFileTypes = append(existingFileTypes, fileTypeModel)
+				if err != nil {
+					return err
 				}
+			}
 
-				// Create a new FileHash if required
-				if hashSignature.HashID == nil {
-					model := models.FileHash{
-						Hash:       hashSignature.Hash,
-						FileTypeID: hashSignatures[hashSignatureIndex].FileTypeID,
-						Size:       &hashSignature.Size,
-					}
+			err := ctx.updateHashCache(tx, hashedFiles, failedFileIDs)
 
-					createFileHashResult := tx.Create(&model)
+			if err != nil {
+				return err
+			}
 
-					if createFileHashResult.Error != nil {
-						return createFileHashResult.Error
-					}
+			return DealWithNotFoundFiles(tx, notFoundFileIDs)
+		})
 
-					totalNewUniqueHashes++
+		if err != nil {
+			return err
+		}
+	}
+}
 
-					if len(hashSignature.fileIDs) > 1 {
-						duplicateCountAsInt := len(hashSignature.fileIDs) - 1
+// getHashSignatures groups the files hashed in a batch by their hash, and finds which of those hashes are already known.
+// Only the hashes in the batch are looked up, so this does not slow down as the catalog grows.
+func (ctx *Context) getHashSignatures(algorithm string, hashedFiles []HashedFile, failedFileIDs *[]uint) ([]*HashSignature, error) {
+	signaturesByHash := map[string]*HashSignature{}
+	var signatures []*HashSignature
+
+	// Files are in the order they finished hashing, so sort them for deterministic results
+	sort.Slice(hashedFiles, func(i, j int) bool {
+		return hashedFiles[i].FileID < hashedFiles[j].FileID
+	})
+
+	for _, file := range hashedFiles {
+		signature, found := signaturesByHash[file.Hash]
+
+		if !found {
+			signature = &HashSignature{
+				Hash:     file.Hash,
+				Size:     file.Size,
+				FileType: file.FileType,
+			}
 
-						duplicateFileHashes += duplicateCountAsInt
+			signaturesByHash[file.Hash] = signature
+			signatures = append(signatures, signature)
+		}
 
-						// Ensure we have not wrapped around for uint conversion, prevent CWE-190
-						if duplicateCountAsInt > 0 {
-							duplicateFileSize += hashSignature.Size * uint(duplicateCountAsInt)
-						}
-					}
+		// Do hash collision detection on the found hash. We only need to compare size, not type.
+		if signature.Size != file.Size {
+			log.Printf("File \"%s\" has unexpected size. Expected %d, got %d. Has a hash collision occured?", file.AbsolutePath, signature.Size, file.Size)
+			*failedFileIDs = append(*failedFileIDs, file.FileID)
+			continue
+		}
 
-					hashSignatures[hashSignatureIndex].HashID = &model.ID
-				} else {
-					duplicateFileHashes += len(hashSignature.fileIDs)
-					duplicateFileSize += hashSignature.Size * uint(len(hashSignature.fileIDs))
-				}
+		signature.fileIDs = append(signature.fileIDs, file.FileID)
+	}
 
-				totalFileSize += hashSignature.Size * uint(len(hashSignature.fileIDs))
+	if len(signatures) == 0 {
+		return nil, nil
+	}
 
-				for _, fileID := range hashSignature.fileIDs {
-					fileUpdateResult := tx.Where("id = ?", fileID).Updates(models.File{
-						FileHashID: hashSignatures[hashSignatureIndex].HashID,
-						Size:       &hashSignature.Size,
-						FileTypeID: hashSignatures[hashSignatureIndex].FileTypeID,
-					})
+	var existingSignatures []HashSignature
+	result := ctx.DB.Raw(QueryGetExistingHashSignatures(), algorithm, slices.Collect(maps.Keys(signaturesByHash))).Scan(&existingSignatures)
 
-					if fileUpdateResult.Error != nil {
-						return fileUpdateResult.Error
-					}
+	if result.Error != nil {
+		return nil, result.Error
+	}
 
-					if fileUpdateResult.RowsAffected != 1 {
-						return errors.New("failed to update hash signature")
-					}
-				}
+	for _, existingSignature := range existingSignatures {
+		signature := signaturesByHash[existingSignature.Hash]
+
+		// We do not compare by type because different versions of file command have different outputs.
+		// If we run crawl on one machine and hash on another it can lead to problems.
+		if existingSignature.Size != signature.Size {
+			log.Printf("Hash %s has unexpected size. Expected %d, got %d. Has a hash collision occured?", signature.Hash, existingSignature.Size, signature.Size)
+			*failedFileIDs = append(*failedFileIDs, signature.fileIDs...)
+			signature.fileIDs = nil
+			continue
+		}
+
+		signature.HashID = existingSignature.HashID
+		signature.FileTypeID = existingSignature.FileTypeID
+	}
+
+	return signatures, nil
+}
+
+func recordHashSignature(tx *gorm.DB, algorithm string, signature *HashSignature, fileTypeIDs map[string]uint, stats *HashStats) error {
+	if len(signature.fileIDs) == 0 {
+		return nil
+	}
+
+	// Resolve the file type ID, creating a new FileType if required
+	if signature.FileTypeID == nil {
+		fileTypeID, found := fileTypeIDs[signature.FileType]
+
+		if !found {
+			fileTypeModel := models.FileType{Type: signature.FileType}
+
+			createFileTypeResult := tx.Create(&fileTypeModel)
+
+			if createFileTypeResult.Error != nil {
+				return createFileTypeResult.Error
 			}
 
-			return DealWithNotFoundFiles(tx, notFoundFileIDs)
-		})
+			fileTypeID = fileTypeModel.ID
+			fileTypeIDs[signature.FileType] = fileTypeID
+		}
 
-		if err != nil {
-			return err
+		signature.FileTypeID = &fileTypeID
+	}
+
+	fileCount := uint(len(signature.fileIDs))
+
+	// Create a new FileHash if required
+	if signature.HashID == nil {
+		model := models.FileHash{
+			Hash:       signature.Hash,
+			Algorithm:  algorithm,
+			FileTypeID: signature.FileTypeID,
+			Size:       &signature.Size,
 		}
+
+		createFileHashResult := tx.Create(&model)
+
+		if createFileHashResult.Error != nil {
+			return createFileHashResult.Error
+		}
+
+		signature.HashID = &model.ID
+		stats.NewUniqueHashes++
+
+		// The first file is the unique one
+		fileCount--
 	}
+
+	stats.DuplicateFileHashes += int64(fileCount)
+	stats.DuplicateFileSize += signature.Size * fileCount
+	stats.TotalFileSize += signature.Size * uint(len(signature.fileIDs))
+
+	fileUpdateResult := tx.Model(&models.File{}).Where("id IN ?", signature.fileIDs).Updates(models.File{
+		FileHashID: signature.HashID,
+		Size:       &signature.Size,
+		FileTypeID: signature.FileTypeID,
+	})
+
+	if fileUpdateResult.Error != nil {
+		return fileUpdateResult.Error
+	}
+
+	if fileUpdateResult.RowsAffected != int64(len(signature.fileIDs)) {
+		return errors.New("failed to update hash signature")
+	}
+
+	return nil
 }
 
-func hashFile(orchestrator *utils.TaskOrchestrator, existingHashSignatures *[]HashSignature, notFoundFileIDs *[]uint, file FileIdAndPath) {
+func (ctx *Context) hashFile(orchestrator *utils.TaskOrchestrator, hasher *crypto.Hasher, hashCache map[hashCacheKey]models.HashCacheEntry, hashedFiles *[]HashedFile, notFoundFileIDs, failedFileIDs *[]uint, file FileIdAndPath) {
 	fileInfo, err := os.Stat(file.AbsolutePath)
 
 	// If the file does not exist we can ignore it
@@ -195,7 +338,7 @@ func hashFile(orchestrator *utils.TaskOrchestrator, existingHashSignatures *[]Ha
 		}
 
 		log.Printf("Error: Could not open file \"%s\": %v", file.AbsolutePath, err)
-		orchestrator.FinishTask()
+		failHashingFile(orchestrator, failedFileIDs, file)
 		return
 	}
 
@@ -210,68 +353,79 @@ func hashFile(orchestrator *utils.TaskOrchestrator, existingHashSignatures *[]Ha
 		return
 	}
 
-	// Do file typing first to fail faster if there is a file issue
-	fileType, err := GetFileType(file.AbsolutePath)
-
-	if err != nil {
-		log.Printf("Error: Could not type file \"%s\": %v", file.AbsolutePath, err)
+	size := fileInfo.Size()
 
-		orchestrator.FinishTask()
+	// Ensure we have not wrapped around for uint conversion
+	if size < 0 {
+		log.Printf("Error: Negative file size \"%s\"", file.AbsolutePath)
+		failHashingFile(orchestrator, failedFileIDs, file)
 		return
 	}
 
-	hash, err := crypto.HashFile(file.AbsolutePath)
+	cacheEntry := newHashCacheEntry(hasher.Algorithm, fileInfo)
+	cached, found := findInHashCache(hashCache, cacheEntry)
 
-	if err != nil {
-		log.Printf("Error: Could not hash file \"%s\": %v", file.AbsolutePath, err)
+	if found {
+		orchestrator.Lock()
+		*hashedFiles = append(*hashedFiles, HashedFile{
+			FileIdAndPath: file,
+			Hash:          cached.Hash,
+			Size:          uint(size),
+			FileType:      cached.FileType,
+			cacheEntry:    cacheEntry,
+			fromCache:     true,
+		})
+		orchestrator.Unlock()
 
 		orchestrator.FinishTask()
 		return
 	}
 
-	size := fileInfo.Size()
-
-	// Ensure we have not wrapped around for uint conversion
-	if size < 0 {
-		log.Printf("Error: Negative file size \"%s\"", file.AbsolutePath)
+	// Do file typing first to fail faster if there is a file issue
+	fileType, err := GetFileType(file.AbsolutePath, ctx.Config.FileTypeBackend)
 
-		orchestrator.FinishTask()
+	if err != nil {
+		log.Printf("Error: Could not type file \"%s\": %v", file.AbsolutePath, err)
+		failHashingFile(orchestrator, failedFileIDs, file)
 		return
 	}
 
-	signature := HashSignature{
-		Hash:     hash,
-		Size:     uint(size),
-		FileType: fileType,
-		fileIDs:  []uint{file.FileID},
+	hash, err := hasher.HashFile(file.AbsolutePath)
+
+	if err != nil {
+		log.Printf("Error: Could not hash file \"%s\": %v", file.AbsolutePath, err)
+		failHashingFile(orchestrator, failedFileIDs, file)
+		return
 	}
 
-	// Maps are not threadsafe
+	// Hashes are only compared once the whole batch is done, so the lock is held as briefly as possible
 	orchestrator.Lock()
+	*hashedFiles = append(*hashedFiles, HashedFile{
+		FileIdAndPath: file,
+		Hash:          hash,
+		Size:          uint(size),
+		FileType:      fileType,
+		cacheEntry:    cacheEntry,
+	})
+	orchestrator.Unlock()
 
-	for existingHashSignatureIndex, existingHashSignature := range *existingHashSignatures {
-		if existingHashSignature.Hash == signature.Hash {
-			// Do hash collision detection on the found hash. We only need to compare size, not type.
-			// We do not compare by type because different versions of file command have different outputs.
-			// If we run crawl on one machine and hash on another it can lead to problems.
-			if existingHashSignature.Size != signature.Size {
-				log.Printf("File \"%s\" has unexpected size. Expected %d, got %d. Has a hash collision occured?", file.AbsolutePath, existingHashSignature.Size, signature.Size)
-				orchestrator.Unlock()
-
-				orchestrator.FinishTask()
-				return
-			}
-
-			(*existingHashSignatures)[existingHashSignatureIndex].fileIDs = append(existingHashSignature.fileIDs, file.FileID)
-			orchestrator.Unlock()
-
-			orchestrator.FinishTask()
-			return
-		}
-	}
+	orchestrator.FinishTask()
+}
 
-	*existingHashSignatures = append(*existingHashSignatures, signature)
+func failHashingFile(orchestrator *utils.TaskOrchestrator, failedFileIDs *[]uint, file FileIdAndPath) {
+	orchestrator.Lock()
+	*failedFileIDs = append(*failedFileIDs, file.FileID)
 	orchestrator.Unlock()
 
 	orchestrator.FinishTask()
 }
+
+func (ctx *Context) getHasher() (*crypto.Hasher, error) {
+	algorithm := ctx.Config.HashAlgorithm
+
+	if len(algorithm) == 0 {
+		algorithm = crypto.DefaultAlgorithm
+	}
+
+	return crypto.NewHasher(algorithm)
+}
@@ -1 +1,60 @@
 package main
+
+import (
+	"data-tools/config"
+	"data-tools/crypto"
+	"data-tools/models"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestGetHashSignatures(t *testing.T) {
+	tempTestDataPath := createEmptyTempTestDataPath(t)
+	defer os.RemoveAll(tempTestDataPath)
+
+	c := &config.Config{
+		DBPath: path.Join(tempTestDataPath, "db.db"),
+	}
+
+	ctx := &Context{
+		Config: c,
+		DB:     initDb(c),
+	}
+
+	existingSize := uint(10)
+	existing := models.FileHash{Hash: "existing", Algorithm: crypto.BLAKE2b512, Size: &existingSize}
+	assert.NoError(t, ctx.DB.Create(&existing).Error)
+
+	// A hash from another algorithm is never matched
+	otherAlgorithm := models.FileHash{Hash: "new", Algorithm: crypto.SHA256, Size: &existingSize}
+	assert.NoError(t, ctx.DB.Create(&otherAlgorithm).Error)
+
+	newHashedFile := func(fileID uint, hash string, size uint) HashedFile {
+		return HashedFile{FileIdAndPath: FileIdAndPath{FileID: fileID}, Hash: hash, Size: size}
+	}
+
+	failedFileIDs := []uint{0}
+	signatures, err := ctx.getHashSignatures(crypto.BLAKE2b512, []HashedFile{
+		newHashedFile(4, "new", 5),
+		newHashedFile(1, "existing", 10),
+		newHashedFile(2, "new", 5),
+		newHashedFile(3, "new", 6),
+		newHashedFile(5, "existing", 11),
+	}, &failedFileIDs)
+	assert.NoError(t, err)
+
+	assert.Len(t, signatures, 2)
+
+	assert.Equal(t, "existing", signatures[0].Hash)
+	assert.Equal(t, &existing.ID, signatures[0].HashID)
+	assert.Equal(t, []uint{1}, signatures[0].fileIDs)
+
+	assert.Equal(t, "new", signatures[1].Hash)
+	assert.Nil(t, signatures[1].HashID)
+	assert.Equal(t, []uint{2, 4}, signatures[1].fileIDs)
+
+	// Files whose size does not match their hash are not recorded
+	assert.Equal(t, []uint{0, 3, 5}, failedFileIDs)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"data-tools/crypto"
+	"data-tools/imagehash"
+	"data-tools/models"
+	"data-tools/utils"
+	"errors"
+	"fmt"
+	"github.com/dustin/go-humanize"
+	"github.com/schollz/progressbar/v3"
+	"gorm.io/gorm"
+	"io/fs"
+	"log"
+	"os"
+)
+
+// prefilterFilesToHash rules out files which cannot be duplicates so that only potential duplicates are fully hashed.
+// Files are grouped by size, then files which share a size are grouped by a hash of their first and last blocks.
+// Files left on their own are deferred, and are only fully hashed when ZAP-ping needs their hash.
+func (ctx *Context) prefilterFilesToHash() error {
+	// A file added since the last run may share the size of a deferred file, so everything is reconsidered
+	result := ctx.DB.Model(&models.File{}).Where("hash_deferred = 1 AND file_hash_id IS NULL").Update("hash_deferred", false)
+
+	if result.Error != nil {
+		return result.Error
+	}
+
+	utils.ConsoleAndLogPrintf("Reading file sizes...")
+	err := ctx.updateFilesInBatches(QueryGetFileIdsToSize(), "size", func(absolutePath string) (interface{}, error) {
+		info, err := os.Stat(absolutePath)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if info.IsDir() {
+			return nil, fmt.Errorf("\"%s\" is a directory, not a file: %w", absolutePath, fs.ErrNotExist)
+		}
+
+		return uint(info.Size()), nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	result = ctx.DB.Exec(QueryDeferFilesWithUniqueSize())
+
+	if result.Error != nil {
+		return result.Error
+	}
+
+	utils.ConsoleAndLogPrintf("Partially hashing files which share a size...")
+	err = ctx.updateFilesInBatches(QueryGetFileIdsToPartiallyHash(), "partial_hash", func(absolutePath string) (interface{}, error) {
+		return crypto.HashFilePartial(absolutePath)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	result = ctx.DB.Exec(QueryDeferFilesWithUniquePartialHash())
+
+	if result.Error != nil {
+		return result.Error
+	}
+
+	// Images need a hash to be perceptually hashed, so are not deferred even though they cannot be duplicates
+	if ctx.Config.PerceptualHash {
+		utils.ConsoleAndLogPrintf("Detecting images among the files which cannot be duplicates...")
+		err = ctx.updateFilesInBatches(QueryGetDeferredFileIds(), "hash_deferred", func(absolutePath string) (interface{}, error) {
+			fileType, err := GetFileType(absolutePath, ctx.Config.FileTypeBackend)
+
+			if err != nil {
+				return nil, err
+			}
+
+			return !imagehash.IsSupported(fileType), nil
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	type DeferredInfo struct {
+		Count int64
+		Size  uint64
+	}
+
+	var info DeferredInfo
+	result = ctx.DB.Raw("SELECT COUNT(*) count, COALESCE(SUM(size), 0) size FROM files WHERE hash_deferred = 1 AND deleted_at IS NULL AND ignored = 0").First(&info)
+
+	if result.Error != nil {
+		return result.Error
+	}
+
+	utils.ConsoleAndLogPrintf("Deferred hashing %s (%s) which cannot be duplicates", utils.Pluralize("file", info.Count), humanize.Bytes(info.Size))
+	return nil
+}
+
+// hashDeferredFiles fully hashes the files which prefilterFilesToHash deferred
+func (ctx *Context) hashDeferredFiles() error {
+	result := ctx.DB.Model(&models.File{}).Where("hash_deferred = 1 AND file_hash_id IS NULL").Update("hash_deferred", false)
+
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return nil
+	}
+
+	utils.ConsoleAndLogPrintf("Hashing %s deferred until ZAP-ping", utils.Pluralize("file", result.RowsAffected))
+	return ctx.hashFiles()
+}
+
+// updateFilesInBatches sets a column of the files found by the query to the value returned for each file
+func (ctx *Context) updateFilesInBatches(fileIDsQuery, column string, getValue func(absolutePath string) (interface{}, error)) error {
+	total, batches, err := ctx.GetBatchesOfIDs(fileIDsQuery, "f")
+
+	if err != nil {
+		return err
+	}
+
+	if len(batches) == 0 {
+		return nil
+	}
+
+	bar := progressbar.Default(total)
+
+	for _, batch := range batches {
+		var fileIDs []uint
+
+		for _, fileID := range batch {
+			fileIDs = append(fileIDs, uint(fileID))
+		}
+
+		filePaths, err := ctx.getFilePaths(fileIDs)
+
+		if err != nil {
+			return err
+		}
+
+		values := map[uint]interface{}{}
+		var notFoundFileIDs []uint
+
+		orchestrator := utils.NewTaskOrchestrator(bar, len(batch), ctx.Config.MaxConcurrentFileOperations)
+
+		for _, fileID := range fileIDs {
+			orchestrator.StartTask()
+
+			go func(fileID uint) {
+				defer orchestrator.FinishTask()
+
+				absolutePath, found := filePaths[fileID]
+
+				// The path could not be resolved, so this file will be skipped
+				if !found {
+					return
+				}
+
+				value, err := getValue(absolutePath)
+
+				orchestrator.Lock()
+				defer orchestrator.Unlock()
+
+				if errors.Is(err, fs.ErrNotExist) {
+					log.Printf("Ignoring not-found file \"%s\"", absolutePath)
+					notFoundFileIDs = append(notFoundFileIDs, fileID)
+					return
+				}
+
+				if err != nil {
+					log.Printf("Error: Could not read file \"%s\": %v", absolutePath, err)
+					return
+				}
+
+				values[fileID] = value
+			}(fileID)
+		}
+
+		orchestrator.WaitForTasks()
+
+		err = ctx.DB.Transaction(func(tx *gorm.DB) error {
+			for fileID, value := range values {
+				result := tx.Model(&models.File{}).Where("id = ?", fileID).Update(column, value)
+
+				if result.Error != nil {
+					return result.Error
+				}
+
+				if result.RowsAffected != 1 {
+					return fmt.Errorf("could not update %s in db", column)
+				}
+			}
+
+			return DealWithNotFoundFiles(tx, notFoundFileIDs)
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,57 @@
+//go:build integration
+// +build integration
+
+package main
+
+import (
+	"data-tools/config"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestHashFilesShouldOnlyHashPotentialDuplicates(t *testing.T) {
+	tempTestDataPath := createTempTestDataPath(t)
+	defer os.RemoveAll(tempTestDataPath)
+
+	c := &config.Config{
+		DBPath:                      path.Join(tempTestDataPath, "db.db"),
+		BatchSize:                   5,
+		MaxConcurrentFileOperations: 2,
+		ZapDataPath:                 path.Join(tempTestDataPath, "ZAP"),
+		HashPrefilter:               true,
+	}
+
+	ctx := &Context{
+		Config: c,
+		DB:     initDb(c),
+	}
+
+	dataPath := path.Join(tempTestDataPath, "a")
+
+	// The same size as the three copies of file.md, but different contents
+	assert.NoError(t, os.WriteFile(path.Join(dataPath, "b", "k.txt"), []byte("# Fil!"), 0644))
+
+	err := ctx.Crawl(dataPath)
+	assert.NoError(t, err)
+
+	err = ctx.HashFiles()
+	assert.NoError(t, err)
+
+	// The PNG and the empty .gitignore have unique sizes, and k.txt has a unique partial hash
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM files WHERE hash_deferred = 1 AND file_hash_id IS NULL", 3)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM files WHERE file_hash_id IS NOT NULL", 3)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes", 1)
+
+	// Hashing again should not change anything
+	err = ctx.HashFiles()
+	assert.NoError(t, err)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM files WHERE hash_deferred = 1 AND file_hash_id IS NULL", 3)
+
+	err = ctx.Zap()
+	assert.NoError(t, err)
+
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM files WHERE zapped = 1", 6)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes WHERE zapped = 1", 4)
+}
@@ -0,0 +1,235 @@
+package imagehash
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+	"golang.org/x/image/webp"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"maps"
+	"math/bits"
+	"os"
+	"path"
+	"slices"
+)
+
+var ErrUnsupportedType = errors.New("unsupported image type")
+var ErrTooLarge = errors.New("image too large to hash")
+
+// MaxPixels is the most pixels an image can have to be hashed, as decoding it takes 4 bytes a pixel or more
+const MaxPixels = 64 * 1000 * 1000
+
+type decoder struct {
+	decode       func(r io.Reader) (image.Image, error)
+	decodeConfig func(r io.Reader) (image.Config, error)
+}
+
+var decoders = map[string]decoder{
+	"image/jpeg": {jpeg.Decode, jpeg.DecodeConfig},
+	"image/png":  {png.Decode, png.DecodeConfig},
+	"image/gif":  {gif.Decode, gif.DecodeConfig},
+	"image/bmp":  {bmp.Decode, bmp.DecodeConfig},
+	"image/tiff": {tiff.Decode, tiff.DecodeConfig},
+	"image/webp": {webp.Decode, webp.DecodeConfig},
+}
+
+// SupportedTypes are the MIME types of the images which can be hashed
+func SupportedTypes() []string {
+	return slices.Sorted(maps.Keys(decoders))
+}
+
+// IsSupported is true if images of a MIME type can be decoded to be hashed
+func IsSupported(mimeType string) bool {
+	_, found := decoders[mimeType]
+	return found
+}
+
+// HashFile decodes an image and returns its difference hash
+func HashFile(filePath, mimeType string) (uint64, error) {
+	file, err := os.Open(path.Clean(filePath))
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer file.Close()
+
+	return Hash(file, mimeType)
+}
+
+// Hash is HashFile for images which are not in a single file
+func Hash(reader io.Reader, mimeType string) (uint64, error) {
+	decoder, found := decoders[mimeType]
+
+	if !found {
+		return 0, fmt.Errorf("%w: %s", ErrUnsupportedType, mimeType)
+	}
+
+	// The dimensions are checked before decoding, as a few large images would otherwise run out of memory. What is
+	// read to find them is kept to be decoded again.
+	var header bytes.Buffer
+	config, err := decoder.decodeConfig(io.TeeReader(reader, &header))
+
+	if err != nil {
+		return 0, err
+	}
+
+	if int64(config.Width)*int64(config.Height) > MaxPixels {
+		return 0, fmt.Errorf("%w: %dx%d", ErrTooLarge, config.Width, config.Height)
+	}
+
+	img, err := decoder.decode(io.MultiReader(&header, reader))
+
+	if err != nil {
+		return 0, err
+	}
+
+	return DHash(img), nil
+}
+
+// DHash is a perceptual hash which compares the brightness of neighbouring areas of an image. It survives resizing,
+// recompression and small edits, so similar images have hashes a short Hamming distance apart.
+// See https://www.hackerfactor.com/blog/index.php?/archives/529-Kind-of-Like-That.html
+func DHash(img image.Image) uint64 {
+	const width, height = 9, 8
+
+	brightness := shrink(img, width, height)
+	hash := uint64(0)
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width-1; x++ {
+			hash <<= 1
+
+			if brightness[y*width+x] > brightness[y*width+x+1] {
+				hash |= 1
+			}
+		}
+	}
+
+	return hash
+}
+
+// shrink averages the brightness of an image over a grid of width by height areas
+func shrink(img image.Image, width, height int) []float64 {
+	bounds := img.Bounds()
+	totals := make([]float64, width*height)
+	counts := make([]float64, width*height)
+
+	gray, isGray := img.(*image.Gray)
+	yCbCr, isYCbCr := img.(*image.YCbCr)
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		row := (y - bounds.Min.Y) * height / bounds.Dy()
+
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			column := (x - bounds.Min.X) * width / bounds.Dx()
+
+			var luminance float64
+
+			// JPEGs and greyscale images already store brightness, so avoid converting every pixel
+			switch {
+			case isYCbCr:
+				luminance = float64(yCbCr.Y[yCbCr.YOffset(x, y)])
+			case isGray:
+				luminance = float64(gray.Pix[gray.PixOffset(x, y)])
+			default:
+				r, g, b, _ := img.At(x, y).RGBA()
+				luminance = (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)) / 257
+			}
+
+			totals[row*width+column] += luminance
+			counts[row*width+column]++
+		}
+	}
+
+	for index := range totals {
+		if counts[index] > 0 {
+			totals[index] /= counts[index]
+		}
+	}
+
+	return totals
+}
+
+// Distance is the number of bits which differ between two hashes
+func Distance(left, right uint64) int {
+	return bits.OnesCount64(left ^ right)
+}
+
+// BKTree finds hashes within a Hamming distance of another without comparing against every hash.
+// See https://en.wikipedia.org/wiki/BK-tree
+type BKTree struct {
+	root *bkNode
+}
+
+type bkNode struct {
+	hash     uint64
+	ids      []uint
+	children map[int]*bkNode
+}
+
+// Add stores an ID against a hash
+func (t *BKTree) Add(hash uint64, id uint) {
+	if t.root == nil {
+		t.root = &bkNode{hash: hash, ids: []uint{id}, children: map[int]*bkNode{}}
+		return
+	}
+
+	node := t.root
+
+	for {
+		distance := Distance(hash, node.hash)
+
+		if distance == 0 {
+			node.ids = append(node.ids, id)
+			return
+		}
+
+		child, found := node.children[distance]
+
+		if !found {
+			node.children[distance] = &bkNode{hash: hash, ids: []uint{id}, children: map[int]*bkNode{}}
+			return
+		}
+
+		node = child
+	}
+}
+
+// Find returns the IDs of every hash within maxDistance of a hash, sorted
+func (t *BKTree) Find(hash uint64, maxDistance int) []uint {
+	var ids []uint
+
+	if t.root == nil {
+		return ids
+	}
+
+	nodes := []*bkNode{t.root}
+
+	for len(nodes) > 0 {
+		node := nodes[len(nodes)-1]
+		nodes = nodes[:len(nodes)-1]
+
+		distance := Distance(hash, node.hash)
+
+		if distance <= maxDistance {
+			ids = append(ids, node.ids...)
+		}
+
+		// By the triangle inequality, only these children can be close enough
+		for childDistance, child := range node.children {
+			if childDistance >= distance-maxDistance && childDistance <= distance+maxDistance {
+				nodes = append(nodes, child)
+			}
+		}
+	}
+
+	slices.Sort(ids)
+	return ids
+}
@@ -0,0 +1,77 @@
+package imagehash
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// drawScene draws a picture which looks the same at any size
+func drawScene(width, height int, inverted bool) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			value := uint8((x*255/width + y*128/height) % 256)
+
+			// A circle in the middle
+			dx, dy := x-width/2, y-height/2
+
+			if dx*dx*height*height+dy*dy*width*width < width*width*height*height/16 {
+				value = 255 - value
+			}
+
+			if inverted {
+				value = 255 - value
+			}
+
+			img.Set(x, y, color.RGBA{R: value, G: value / 2, B: 255 - value, A: 255})
+		}
+	}
+
+	return img
+}
+
+func TestDHash(t *testing.T) {
+	large := DHash(drawScene(640, 480, false))
+	small := DHash(drawScene(160, 120, false))
+	different := DHash(drawScene(640, 480, true))
+
+	assert.LessOrEqual(t, Distance(large, small), 4)
+	assert.Greater(t, Distance(large, different), 32)
+}
+
+func TestHashFileShouldRejectUnsupportedTypes(t *testing.T) {
+	_, err := HashFile("../test/data/a/file.md", "text/plain")
+	assert.ErrorIs(t, err, ErrUnsupportedType)
+
+	hash, err := HashFile("../test/data/a/b/4276652.png", "image/png")
+	assert.NoError(t, err)
+	assert.NotZero(t, hash)
+}
+
+func TestHashShouldRejectImagesWithTooManyPixels(t *testing.T) {
+	// Only the header of a GIF of 65535 by 65535 pixels, which is never decoded
+	header := []byte("GIF89a\xff\xff\xff\xff\x00\x00\x00")
+
+	_, err := Hash(bytes.NewReader(header), "image/gif")
+	assert.ErrorIs(t, err, ErrTooLarge)
+}
+
+func TestBKTree(t *testing.T) {
+	tree := &BKTree{}
+	assert.Empty(t, tree.Find(0, 64))
+
+	tree.Add(0b0000, 1)
+	tree.Add(0b0001, 2)
+	tree.Add(0b0011, 3)
+	tree.Add(0b1111, 4)
+	tree.Add(0b0000, 5)
+
+	assert.Equal(t, []uint{1, 5}, tree.Find(0, 0))
+	assert.Equal(t, []uint{1, 2, 3, 5}, tree.Find(0, 2))
+	assert.Equal(t, []uint{3, 4}, tree.Find(0b0111, 1))
+	assert.Equal(t, []uint{1, 2, 3, 4, 5}, tree.Find(0, 64))
+}
@@ -0,0 +1,51 @@
+package magic
+
+import "strings"
+
+// compressedTypes are already compressed, so compressing them again saves next to nothing
+var compressedTypes = map[string]bool{
+	"application/epub+zip":                            true,
+	"application/gzip":                                true,
+	"application/java-archive":                        true,
+	"application/ogg":                                 true,
+	"application/vnd.android.package-archive":         true,
+	"application/vnd.debian.binary-package":           true,
+	"application/vnd.ms-cab-compressed":               true,
+	"application/vnd.oasis.opendocument.presentation": true,
+	"application/vnd.oasis.opendocument.spreadsheet":  true,
+	"application/vnd.oasis.opendocument.text":         true,
+	"application/vnd.rar":                             true,
+	"application/x-7z-compressed":                     true,
+	"application/x-bzip2":                             true,
+	"application/x-gzip":                              true,
+	"application/x-lz4":                               true,
+	"application/x-lzip":                              true,
+	"application/x-lzma":                              true,
+	"application/x-rar":                               true,
+	"application/x-rpm":                               true,
+	"application/x-xz":                                true,
+	"application/zip":                                 true,
+	"application/zstd":                                true,
+	"audio/flac":                                      true,
+	"audio/mpeg":                                      true,
+	"audio/ogg":                                       true,
+	"audio/x-hx-aac-adts":                             true,
+	"audio/x-m4a":                                     true,
+	"font/woff":                                       true,
+	"font/woff2":                                      true,
+	"image/avif":                                      true,
+	"image/gif":                                       true,
+	"image/heic":                                      true,
+	"image/jpeg":                                      true,
+	"image/jxl":                                       true,
+	"image/png":                                       true,
+	"image/webp":                                      true,
+}
+
+// IsCompressed is true for MIME types whose contents are already compressed. Every video format in use is, as are
+// office documents, which are zip files underneath.
+func IsCompressed(mimeType string) bool {
+	return compressedTypes[mimeType] ||
+		strings.HasPrefix(mimeType, "video/") ||
+		strings.HasPrefix(mimeType, "application/vnd.openxmlformats-officedocument.")
+}
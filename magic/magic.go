@@ -0,0 +1,313 @@
+package magic
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path"
+	"unicode/utf8"
+)
+
+// HeaderSize is how much of a file is read to detect its type
+const HeaderSize = 3072
+
+const (
+	Empty       = "inode/x-empty"
+	OctetStream = "application/octet-stream"
+	TextPlain   = "text/plain"
+)
+
+// The MIME types are those given by the file command where possible, so that catalogs typed by either are comparable
+type matcher struct {
+	mime  string
+	match func(header []byte) bool
+}
+
+var matchers = []matcher{
+	// Images
+	{"image/png", prefix(0, "\x89PNG\r\n\x1a\n")},
+	{"image/jpeg", prefix(0, "\xff\xd8\xff")},
+	{"image/gif", anyOf(prefix(0, "GIF87a"), prefix(0, "GIF89a"))},
+	{"image/webp", allOf(prefix(0, "RIFF"), prefix(8, "WEBP"))},
+	{"image/x-canon-cr2", allOf(prefix(0, "II*\x00"), prefix(8, "CR\x02"))},
+	{"image/tiff", anyOf(prefix(0, "II*\x00"), prefix(0, "MM\x00*"))},
+	{"image/heic", isoBrand("heic", "heix", "heim", "heis", "mif1", "msf1")},
+	{"image/avif", isoBrand("avif", "avis")},
+	{"image/jxl", anyOf(prefix(0, "\xff\x0a"), prefix(0, "\x00\x00\x00\x0cJXL \x0d\x0a\x87\x0a"))},
+	{"image/vnd.adobe.photoshop", prefix(0, "8BPS")},
+	{"image/vnd.microsoft.icon", prefix(0, "\x00\x00\x01\x00")},
+	{"image/bmp", allOf(prefix(0, "BM"), prefix(6, "\x00\x00\x00\x00"))},
+
+	// Video
+	{"video/quicktime", isoBrand("qt  ")},
+	{"video/3gpp", isoBrand("3gp4", "3gp5", "3gp6", "3ge6", "3gg6")},
+	{"audio/x-m4a", isoBrand("M4A ", "M4B ")},
+	{"video/mp4", isoBrand("isom", "iso2", "iso4", "iso5", "iso6", "mp41", "mp42", "avc1", "dash", "M4V ", "MSNV")},
+	{"video/webm", allOf(prefix(0, "\x1a\x45\xdf\xa3"), contains("webm"))},
+	{"video/x-matroska", prefix(0, "\x1a\x45\xdf\xa3")},
+	{"video/x-msvideo", allOf(prefix(0, "RIFF"), prefix(8, "AVI "))},
+	{"video/x-flv", prefix(0, "FLV\x01")},
+	{"video/x-ms-asf", prefix(0, "\x30\x26\xb2\x75\x8e\x66\xcf\x11")},
+	{"video/mpeg", anyOf(prefix(0, "\x00\x00\x01\xba"), prefix(0, "\x00\x00\x01\xb3"))},
+	{"video/mp2t", allOf(prefix(0, "\x47"), prefix(188, "\x47"), prefix(376, "\x47"))},
+	{"video/ogg", allOf(prefix(0, "OggS"), contains("\x80theora"))},
+
+	// Audio
+	{"audio/ogg", allOf(prefix(0, "OggS"), anyOf(contains("OpusHead"), contains("\x01vorbis")))},
+	{"application/ogg", prefix(0, "OggS")},
+	{"audio/flac", prefix(0, "fLaC")},
+	{"audio/x-wav", allOf(prefix(0, "RIFF"), prefix(8, "WAVE"))},
+	{"audio/x-aiff", allOf(prefix(0, "FORM"), anyOf(prefix(8, "AIFF"), prefix(8, "AIFC")))},
+	{"audio/midi", prefix(0, "MThd")},
+	{"audio/mpeg", anyOf(prefix(0, "ID3"), mpegAudioFrame)},
+	{"audio/x-hx-aac-adts", anyOf(prefix(0, "\xff\xf1"), prefix(0, "\xff\xf9"))},
+
+	// Archives and compression
+	{"application/zip", prefix(0, "PK\x03\x04")}, // See detectZip for formats built on zip
+	{"application/zip", anyOf(prefix(0, "PK\x05\x06"), prefix(0, "PK\x07\x08"))},
+	{"application/gzip", prefix(0, "\x1f\x8b")},
+	{"application/x-bzip2", prefix(0, "BZh")},
+	{"application/x-xz", prefix(0, "\xfd7zXZ\x00")},
+	{"application/x-7z-compressed", prefix(0, "7z\xbc\xaf\x27\x1c")},
+	{"application/x-rar", prefix(0, "Rar!\x1a\x07")},
+	{"application/zstd", prefix(0, "\x28\xb5\x2f\xfd")},
+	{"application/x-lz4", prefix(0, "\x04\x22\x4d\x18")},
+	{"application/x-tar", anyOf(prefix(257, "ustar\x00"), prefix(257, "ustar  \x00"))},
+	{"application/vnd.ms-cab-compressed", prefix(0, "MSCF\x00\x00\x00\x00")},
+	{"application/vnd.debian.binary-package", prefix(0, "!<arch>\ndebian")},
+	{"application/x-archive", prefix(0, "!<arch>\n")},
+	{"application/x-rpm", prefix(0, "\xed\xab\xee\xdb")},
+
+	// Documents
+	{"application/pdf", prefix(0, "%PDF-")},
+	{"application/x-ole-storage", prefix(0, "\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1")},
+	{"application/vnd.sqlite3", prefix(0, "SQLite format 3\x00")},
+	{"application/postscript", prefix(0, "%!PS")},
+	{"text/rtf", prefix(0, "{\\rtf")},
+
+	// Executables
+	{"application/x-executable", elfType(2)},
+	{"application/x-sharedlib", elfType(3)},
+	{"application/x-object", elfType(1)},
+	{"application/x-coredump", elfType(4)},
+	{"application/x-mach-binary", anyOf(prefix(0, "\xfe\xed\xfa\xce"), prefix(0, "\xfe\xed\xfa\xcf"), prefix(0, "\xce\xfa\xed\xfe"), prefix(0, "\xcf\xfa\xed\xfe"), machOFatBinary)},
+	{"application/x-java-applet", prefix(0, "\xca\xfe\xba\xbe")},
+	{"application/vnd.microsoft.portable-executable", portableExecutable},
+	{"application/x-dosexec", prefix(0, "MZ")},
+	{"application/wasm", prefix(0, "\x00asm")},
+
+	// Fonts
+	{"font/woff", prefix(0, "wOFF")},
+	{"font/woff2", prefix(0, "wOF2")},
+	{"font/sfnt", anyOf(prefix(0, "\x00\x01\x00\x00\x00"), prefix(0, "OTTO"), prefix(0, "true"))},
+}
+
+// Text formats are only considered once the header is known to be text
+var textMatchers = []matcher{
+	{"image/svg+xml", contains("<svg")},
+	{"text/xml", prefix(0, "<?xml")},
+	{"text/html", anyOf(prefixFold("<!doctype html"), prefixFold("<html"))},
+	{"text/x-shellscript", anyOf(prefix(0, "#!/bin/sh"), prefix(0, "#!/bin/bash"), prefix(0, "#!/usr/bin/env bash"), prefix(0, "#!/bin/zsh"))},
+	{"text/x-script.python", anyOf(prefix(0, "#!/usr/bin/python"), prefix(0, "#!/usr/bin/env python"))},
+}
+
+// DetectFile reads the start of a file to work out its MIME type
+func DetectFile(filePath string) (string, error) {
+	file, err := os.Open(path.Clean(filePath))
+
+	if err != nil {
+		return "", err
+	}
+
+	defer file.Close()
+
+	header := make([]byte, HeaderSize)
+	size, err := io.ReadFull(file, header)
+
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+
+	return Detect(header[:size]), nil
+}
+
+// Detect works out a MIME type from the start of a file
+func Detect(header []byte) string {
+	if len(header) == 0 {
+		return Empty
+	}
+
+	// UTF-16 text would otherwise be mistaken for an MP3 frame
+	if bytes.HasPrefix(header, []byte("\xff\xfe")) || bytes.HasPrefix(header, []byte("\xfe\xff")) {
+		return TextPlain
+	}
+
+	for _, m := range matchers {
+		if !m.match(header) {
+			continue
+		}
+
+		if m.mime == "application/zip" {
+			return detectZip(header)
+		}
+
+		return m.mime
+	}
+
+	if !isText(header) {
+		return OctetStream
+	}
+
+	for _, m := range textMatchers {
+		if m.match(header) {
+			return m.mime
+		}
+	}
+
+	return TextPlain
+}
+
+// detectZip recognises the formats which are zip files underneath from the names of their first entries
+func detectZip(header []byte) string {
+	// ODF and EPUB store their MIME type uncompressed as the first entry
+	if prefix(30, "mimetype")(header) {
+		mimeType := header[38:]
+		end := bytes.Index(mimeType, []byte("PK"))
+
+		if end > 0 {
+			return string(mimeType[:end])
+		}
+	}
+
+	switch {
+	case bytes.Contains(header, []byte("word/")):
+		return "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+	case bytes.Contains(header, []byte("xl/")):
+		return "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+	case bytes.Contains(header, []byte("ppt/")):
+		return "application/vnd.openxmlformats-officedocument.presentationml.presentation"
+	case bytes.Contains(header, []byte("META-INF/MANIFEST.MF")):
+		return "application/java-archive"
+	case bytes.Contains(header, []byte("AndroidManifest.xml")):
+		return "application/vnd.android.package-archive"
+	}
+
+	return "application/zip"
+}
+
+// isText is true if the header is UTF-8 without the control characters binary files are full of
+func isText(header []byte) bool {
+	// The header may end part way through a character
+	for trim := 0; trim < utf8.UTFMax && !utf8.Valid(header); trim++ {
+		header = header[:len(header)-1]
+	}
+
+	if !utf8.Valid(header) {
+		return false
+	}
+
+	for _, b := range header {
+		if b < 0x20 && b != '\t' && b != '\n' && b != '\r' && b != '\f' && b != '\b' && b != 0x1b {
+			return false
+		}
+	}
+
+	return true
+}
+
+func prefix(offset int, magic string) func(header []byte) bool {
+	return func(header []byte) bool {
+		return len(header) >= offset+len(magic) && string(header[offset:offset+len(magic)]) == magic
+	}
+}
+
+func prefixFold(magic string) func(header []byte) bool {
+	return func(header []byte) bool {
+		trimmed := bytes.TrimLeft(header, " \t\r\n")
+		return len(trimmed) >= len(magic) && bytes.EqualFold(trimmed[:len(magic)], []byte(magic))
+	}
+}
+
+func contains(magic string) func(header []byte) bool {
+	return func(header []byte) bool {
+		return bytes.Contains(header, []byte(magic))
+	}
+}
+
+func anyOf(matches ...func(header []byte) bool) func(header []byte) bool {
+	return func(header []byte) bool {
+		for _, match := range matches {
+			if match(header) {
+				return true
+			}
+		}
+
+		return false
+	}
+}
+
+func allOf(matches ...func(header []byte) bool) func(header []byte) bool {
+	return func(header []byte) bool {
+		for _, match := range matches {
+			if !match(header) {
+				return false
+			}
+		}
+
+		return true
+	}
+}
+
+// isoBrand matches the major brand of an ISO base media file (MP4, QuickTime, HEIF...)
+func isoBrand(brands ...string) func(header []byte) bool {
+	return func(header []byte) bool {
+		if !prefix(4, "ftyp")(header) || len(header) < 12 {
+			return false
+		}
+
+		for _, brand := range brands {
+			if string(header[8:12]) == brand {
+				return true
+			}
+		}
+
+		return false
+	}
+}
+
+func elfType(objectType uint16) func(header []byte) bool {
+	return func(header []byte) bool {
+		if !prefix(0, "\x7fELF")(header) || len(header) < 18 {
+			return false
+		}
+
+		byteOrder := binary.ByteOrder(binary.LittleEndian)
+
+		if header[5] == 2 {
+			byteOrder = binary.BigEndian
+		}
+
+		return byteOrder.Uint16(header[16:18]) == objectType
+	}
+}
+
+// machOFatBinary shares its magic number with Java class files, which have a much larger version number where the architecture count would be
+func machOFatBinary(header []byte) bool {
+	return prefix(0, "\xca\xfe\xba\xbe")(header) && len(header) >= 8 && binary.BigEndian.Uint32(header[4:8]) < 20
+}
+
+// mpegAudioFrame matches an MPEG audio frame header without an ID3 tag
+func mpegAudioFrame(header []byte) bool {
+	return len(header) >= 2 && header[0] == 0xff && header[1]&0xe0 == 0xe0 && header[1]&0x06 != 0
+}
+
+func portableExecutable(header []byte) bool {
+	if !prefix(0, "MZ")(header) || len(header) < 0x40 {
+		return false
+	}
+
+	offset := int(binary.LittleEndian.Uint32(header[0x3c:0x40]))
+
+	return offset >= 0 && prefix(offset, "PE\x00\x00")(header)
+}
@@ -0,0 +1,82 @@
+package magic
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestDetectFile(t *testing.T) {
+	expected := map[string]string{
+		"../test/data/a/file.md":        TextPlain,
+		"../test/data/a/b/4276652.png":  "image/png",
+		"../test/data/a/b/c/.gitignore": Empty,
+	}
+
+	for filePath, mimeType := range expected {
+		result, err := DetectFile(filePath)
+		assert.NoError(t, err)
+		assert.Equal(t, mimeType, result, filePath)
+	}
+
+	_, err := DetectFile("../test/data/a/missing")
+	assert.Error(t, err)
+}
+
+func TestDetect(t *testing.T) {
+	tar := make([]byte, 512)
+	copy(tar[257:], "ustar\x00")
+
+	elf := []byte("\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x03\x00")
+
+	pe := make([]byte, 0x84)
+	copy(pe, "MZ")
+	pe[0x3c] = 0x80
+	copy(pe[0x80:], "PE\x00\x00")
+
+	expected := map[string][]byte{
+		"image/jpeg":                  []byte("\xff\xd8\xff\xe0\x00\x10JFIF"),
+		"image/gif":                   []byte("GIF89a\x01\x00"),
+		"image/webp":                  []byte("RIFF\x00\x00\x00\x00WEBPVP8 "),
+		"image/heic":                  []byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00"),
+		"video/mp4":                   []byte("\x00\x00\x00\x20ftypisom\x00\x00\x02\x00"),
+		"video/quicktime":             []byte("\x00\x00\x00\x14ftypqt  \x00\x00\x00\x00"),
+		"video/x-matroska":            []byte("\x1a\x45\xdf\xa3\x93\x42\x82\x88matroska"),
+		"video/webm":                  []byte("\x1a\x45\xdf\xa3\x9f\x42\x82\x84webm"),
+		"audio/mpeg":                  []byte("ID3\x03\x00\x00\x00"),
+		"audio/flac":                  []byte("fLaC\x00\x00\x00\x22"),
+		"audio/x-wav":                 []byte("RIFF\x24\x00\x00\x00WAVEfmt "),
+		"application/zip":             []byte("PK\x03\x04\x14\x00\x00\x00\x08\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x05\x00\x00\x00hello"),
+		"application/epub+zip":        []byte("PK\x03\x04\x0a\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x08\x00\x00\x00mimetypeapplication/epub+zipPK\x03\x04"),
+		"application/gzip":            []byte("\x1f\x8b\x08\x00"),
+		"application/x-7z-compressed": []byte("7z\xbc\xaf\x27\x1c\x00\x04"),
+		"application/x-tar":           tar,
+		"application/pdf":             []byte("%PDF-1.7\n"),
+		"application/vnd.sqlite3":     []byte("SQLite format 3\x00\x10\x00"),
+		"application/x-sharedlib":     elf,
+		"application/x-mach-binary":   []byte("\xcf\xfa\xed\xfe\x07\x00\x00\x01"),
+		"application/x-java-applet":   []byte("\xca\xfe\xba\xbe\x00\x00\x00\x34"),
+		"application/vnd.microsoft.portable-executable": pe,
+		TextPlain:            []byte("\xff\xfeh\x00i\x00"),
+		"text/html":          []byte("<!DOCTYPE html>\n<html>"),
+		"text/x-shellscript": []byte("#!/bin/sh\necho hello\n"),
+		OctetStream:          []byte("\x00\x01\x02\x03\xfe"),
+		Empty:                {},
+	}
+
+	for mimeType, header := range expected {
+		assert.Equal(t, mimeType, Detect(header), mimeType)
+	}
+
+	// An empty zip file is too short to have any entries
+	assert.Equal(t, "application/zip", Detect([]byte("PK\x05\x06\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00")))
+}
+
+func TestIsCompressed(t *testing.T) {
+	assert.True(t, IsCompressed("image/jpeg"))
+	assert.True(t, IsCompressed("video/mp4"))
+	assert.True(t, IsCompressed("application/vnd.openxmlformats-officedocument.wordprocessingml.document"))
+	assert.False(t, IsCompressed(TextPlain))
+	assert.False(t, IsCompressed("image/bmp"))
+	assert.False(t, IsCompressed("audio/x-wav"))
+	assert.False(t, IsCompressed(Empty))
+}
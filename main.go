@@ -12,6 +12,7 @@ import (
 	"math"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -19,20 +20,20 @@ import (
 //goland:noinspection GoUnnecessarilyExportedIdentifiers
 var AppVersion = "6.0"
 
-var usageText = "Usage: ./data-tools command.\nAvailable commands:\n  crawl\n  hash\n  zap\n  unzap\n  merge_zaps\n  clear_empty_folders\n  integrity\n  hash_file\n"
+var usageText = "Usage: ./data-tools command.\nAvailable commands:\n  crawl\n  recrawl\n  hash\n  zap\n  unzap\n  quarantine\n  merge_zaps\n  relayout\n  clear_empty_folders\n  duplicate_folders\n  similar_images\n  integrity\n  hash_file\n"
 
 //go:embed config.yaml
 var defaultConfigData []byte
 
 func main() {
-	sanityCheckOSRequirements()
-
 	c, err := config.Load(defaultConfigData)
 
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	sanityCheckOSRequirements(c)
+
 	err = utils.SetupLogger(c.LogFilePath)
 
 	if err != nil {
@@ -53,7 +54,7 @@ func main() {
 	utils.ConsoleAndLogPrintf("Data Tools version %s%s. Using %s for file operations and batches of %s", AppVersion, debugFormat, utils.Pluralize("thread", ctx.Config.MaxConcurrentFileOperations), humanize.Comma(ctx.Config.BatchSize))
 
 	if len(os.Args) < 2 {
-		utils.ConsoleAndLogPrintf(fmt.Sprintf("A command must be specified. %s", usageText))
+		utils.ConsoleAndLogPrintf("A command must be specified. %s", usageText)
 		return
 	}
 
@@ -77,11 +78,11 @@ func main() {
 	utils.ConsoleAndLogPrintf("Finished in %s", formattedDuration)
 }
 
-func sanityCheckOSRequirements() {
-	requiredPrograms := []string{
-		"/bin/mv",
-		"/bin/cp",
-		"/usr/bin/file",
+func sanityCheckOSRequirements(c *config.Config) {
+	var requiredPrograms []string
+
+	if c.FileTypeBackend == FileTypeBackendFile {
+		requiredPrograms = append(requiredPrograms, fileCommandPath)
 	}
 
 	for _, requiredProgram := range requiredPrograms {
@@ -93,59 +94,187 @@ func sanityCheckOSRequirements() {
 	}
 }
 
+// parseArguments separates "--flag" style options from the positional arguments that follow the command
+func parseArguments(arguments []string) ([]string, map[string]bool) {
+	var positional []string
+	flags := map[string]bool{}
+
+	for _, argument := range arguments {
+		if strings.HasPrefix(argument, "--") {
+			flags[strings.ToLower(argument)] = true
+		} else {
+			positional = append(positional, argument)
+		}
+	}
+
+	return positional, flags
+}
+
 func (ctx *Context) runCommand(command string) error {
+	args, flags := parseArguments(os.Args[2:])
+
 	switch command {
 	case "crawl":
-		if len(os.Args) != 3 {
+		if len(args) != 1 {
 			log.Fatal("add_root requires a root path.")
 		}
 
-		return ctx.Crawl(os.Args[2])
+		return ctx.Crawl(args[0])
+
+	case "recrawl":
+		if len(args) != 1 {
+			log.Fatal("recrawl requires a root path.")
+		}
+
+		return ctx.ReCrawl(args[0])
 
 	case "hash":
+		ctx.IgnoreHashCache = flags["--no-cache"]
 		return ctx.HashFiles()
 
 	case "zap":
-		return ctx.Zap(false)
+		if flags["--dry-run"] {
+			if len(args) > 1 {
+				log.Fatal("zap --dry-run accepts an optional plan file path.")
+			}
+
+			planPath := ""
+
+			if len(args) == 1 {
+				planPath = args[0]
+			}
+
+			return ctx.ZapPlan(planPath)
+		}
+
+		return ctx.Zap()
 
 	case "unzap":
-		if len(os.Args) != 4 {
+		if flags["--in-place"] {
+			if len(args) != 1 {
+				log.Fatal("unzap --in-place requires a source path.")
+			}
+
+			return ctx.MaterialiseSymlinks(args[0], !flags["--no-metadata"])
+		}
+
+		if len(args) != 2 {
 			log.Fatal("unzap requires source and destination paths.")
 		}
 
-		return ctx.UnZap(os.Args[2], os.Args[3])
+		return ctx.UnZap(args[0], args[1], !flags["--no-metadata"])
+
+	case "quarantine":
+		if len(args) == 0 {
+			log.Fatal("quarantine requires a subcommand: list, restore or purge.")
+		}
+
+		switch strings.ToLower(args[0]) {
+		case "list":
+			return ctx.ListQuarantine()
+
+		case "restore":
+			var quarantinedFileIDs []uint
+
+			for _, arg := range args[1:] {
+				quarantinedFileID, err := strconv.ParseUint(arg, 10, 64)
+
+				if err != nil {
+					log.Fatalf("Invalid quarantined file ID \"%s\"", arg)
+				}
+
+				quarantinedFileIDs = append(quarantinedFileIDs, uint(quarantinedFileID))
+			}
+
+			return ctx.RestoreQuarantine(quarantinedFileIDs)
+
+		case "purge":
+			return ctx.PurgeQuarantine(flags["--all"])
+		}
+
+		log.Fatalf("Unknown quarantine subcommand \"%s\". Available subcommands: list, restore, purge.", args[0])
 
 	case "merge_zaps":
-		if len(os.Args) != 4 {
+		if len(args) != 2 {
 			log.Fatal("merge_zaps requires source and destination paths.")
 		}
 
-		return MergeZaps(os.Args[2], os.Args[3])
+		return ctx.MergeZaps(args[0], args[1])
+
+	case "relayout":
+		return ctx.Relayout()
 
 	case "clear_empty_folders":
-		if len(os.Args) != 3 {
+		if len(args) != 1 {
 			log.Fatal("clear_empty_folders requires a path.")
 		}
 
-		return ClearEmptyFolders([]string{os.Args[2]})
+		return ClearEmptyFolders([]string{args[0]})
+
+	case "duplicate_folders":
+		return ctx.DuplicateFolders(flags["--ignore-names"])
+
+	case "similar_images":
+		if len(args) > 1 {
+			log.Fatal("similar_images accepts an optional max distance.")
+		}
+
+		maxDistance := int(ctx.Config.SimilarImagesMaxDistance)
+
+		if len(args) == 1 {
+			var err error
+			maxDistance, err = strconv.Atoi(args[0])
+
+			if err != nil || maxDistance < 0 || maxDistance > 64 {
+				log.Fatal("similar_images max distance must be between 0 and 64.")
+			}
+		}
+
+		return ctx.SimilarImages(maxDistance)
 
 	case "integrity":
-		return ctx.ZapDBIntegrityTestBySize()
+		if flags["--orphans"] {
+			return ctx.ZapOrphans(flags["--adopt"], flags["--gc"])
+		}
+
+		var err error
+
+		if flags["--deep"] {
+			err = ctx.ZapScrub()
+		} else {
+			err = ctx.ZapDBIntegrityTestBySize()
+		}
+
+		if err != nil {
+			return err
+		}
+
+		return ctx.LinkIntegrityTest()
 
 	case "hash_file":
-		if len(os.Args) != 3 {
-			log.Fatal("hash_file requires a file path.")
+		if len(args) < 1 || len(args) > 2 {
+			log.Fatalf("hash_file requires a file path, optionally followed by a hash algorithm: %s.", strings.Join(crypto.Algorithms, ", "))
 		}
 
-		filePath, err := filepath.Abs(os.Args[2])
+		filePath, err := filepath.Abs(args[0])
+
+		if err != nil {
+			return err
+		}
+
+		hasher, err := ctx.getHasher()
+
+		if len(args) == 2 {
+			hasher, err = crypto.NewHasher(strings.ToLower(args[1]))
+		}
 
 		if err != nil {
 			return err
 		}
 
-		utils.ConsoleAndLogPrintf("Hashing \"%s\"", filePath)
+		utils.ConsoleAndLogPrintf("Hashing \"%s\" with %s", filePath, hasher.Algorithm)
 
-		hash, err := crypto.HashFile(filePath)
+		hash, err := hasher.HashFile(filePath)
 
 		if err != nil {
 			utils.ConsoleAndLogPrintf("Error: Could not hash file \"%s\": %v", filePath, err)
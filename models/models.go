@@ -1,12 +1,28 @@
 package models
 
-import "gorm.io/gorm"
+import (
+	"gorm.io/gorm"
+	"time"
+)
 
+// PathHash identifies the contents of a folder tree, from the names and hashes of everything in it
 type PathHash struct {
-	ID      uint   `gorm:"primarykey"`
-	Hash    string `gorm:"unique"`
-	Ignored bool
-	Size    *uint
+	ID          uint   `gorm:"primarykey"`
+	Hash        string `gorm:"unique"`
+	ContentHash string `gorm:"index"` // As Hash, but ignoring the names of files and folders
+	Ignored     bool
+	Size        *uint
+}
+
+// Metadata is captured from the filesystem during crawl
+type Metadata struct {
+	ModTime    *time.Time
+	AccessTime *time.Time
+	Mode       *uint32
+	UID        *uint32
+	GID        *uint32 `gorm:"column:gid"`
+	Inode      *uint64
+	DeviceID   *uint64
 }
 
 type Path struct {
@@ -20,6 +36,7 @@ type Path struct {
 	PathHash       *PathHash
 	Ignored        bool
 	Size           *uint
+	Metadata       `gorm:"embedded"`
 	DeletedAt      gorm.DeletedAt
 }
 
@@ -29,29 +46,76 @@ type FileType struct {
 }
 
 type FileHash struct {
-	ID         uint   `gorm:"primarykey"`
-	Hash       string `gorm:"unique"`
-	Ignored    bool
-	Size       *uint
-	FileTypeID *uint
-	FileType   *FileType
-	Zapped     bool
+	ID                   uint   `gorm:"primarykey"`
+	Hash                 string `gorm:"unique"`
+	Algorithm            string `gorm:"default:blake2b-512"` // Catalogs from before algorithms were recorded are all BLAKE2b-512
+	Ignored              bool
+	Size                 *uint
+	FileTypeID           *uint
+	FileType             *FileType
+	CanonicalFileID      *uint // The file kept to represent this hash when ZAP-ping
+	Zapped               bool
+	StoredSize           *uint  // The size in the ZAP folder, which differs from Size when compressed or in chunks
+	PerceptualHash       *int64 // The difference hash of an image, see imagehash.DHash
+	PerceptualHashFailed bool   // The image could not be decoded, so it is not tried again
+	Corrupt              bool   // The copy in the ZAP folder did not match the hash when last scrubbed
 }
 
 type File struct {
-	ID         uint `gorm:"primarykey"`
-	PathID     uint
-	Path       Path
-	Level      uint
-	FileHashID *uint
-	FileHash   *FileHash
-	Name       string
-	Size       *uint
-	FileTypeID *uint
-	FileType   *FileType
-	Ignored    bool
-	Zapped     bool
-	DeletedAt  gorm.DeletedAt
+	ID           uint `gorm:"primarykey"`
+	PathID       uint
+	Path         Path
+	Level        uint
+	FileHashID   *uint
+	FileHash     *FileHash
+	Name         string
+	Size         *uint   `gorm:"index"`
+	PartialHash  *string // Only computed for files whose size is not unique, see hash_prefilter
+	HashDeferred bool    // The file cannot be a duplicate, so it is only fully hashed when needed
+	Metadata     `gorm:"embedded"`
+	FileTypeID   *uint
+	FileType     *FileType
+	Ignored      bool
+	Zapped       bool
+	LinkType     *string // How this file has been replaced by a link to the canonical copy, if at all
+	LinkedFileID *uint
+	HashMismatch bool // The contents were found to have changed since hashing when verifying before removal
+	Restored     bool // Put back from quarantine, so ZAP leaves it where it is
+	DeletedAt    gorm.DeletedAt
+}
+
+// QuarantinedFile is a duplicate which has been moved into the quarantine folder rather than deleted, or a file from
+// the ZAP folder which was not in the DB, in which case FileID is nil
+type QuarantinedFile struct {
+	gorm.Model
+	FileID         *uint
+	File           File
+	OriginalPath   string
+	QuarantinePath string
+	Size           *uint
+	ExpiresAt      time.Time
+}
+
+// HashCacheEntry remembers the hash of a file by its inode, so that the file need not be read again while its size and
+// modification time are unchanged
+type HashCacheEntry struct {
+	ID        uint   `gorm:"primarykey"`
+	DeviceID  uint64 `gorm:"uniqueIndex:idx_hash_cache_entry"`
+	Inode     uint64 `gorm:"uniqueIndex:idx_hash_cache_entry"`
+	Algorithm string `gorm:"uniqueIndex:idx_hash_cache_entry"`
+	Size      uint
+	ModTimeNs int64
+	Hash      string
+	FileType  string
+}
+
+// Scrub records how far integrity --deep has got, so that a scrub which was stopped can carry on where it left off
+type Scrub struct {
+	gorm.Model
+	LastFileHashID uint // Every ZAP-ped hash up to this one has been checked
+	CorruptCount   uint
+	MissingCount   uint
+	FinishedAt     *time.Time
 }
 
 type Note struct {
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"data-tools/blobstore"
+	"data-tools/models"
+	"data-tools/utils"
+	"errors"
+	"fmt"
+	"github.com/dustin/go-humanize"
+	"gorm.io/gorm"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// quarantineFile moves a duplicate into the quarantine folder under its original absolute path, returning where it was moved to
+func (ctx *Context) quarantineFile(file ZapResult) (*models.QuarantinedFile, error) {
+	quarantineBasePath, err := filepath.Abs(ctx.Config.QuarantinePath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(file.AbsolutePath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	quarantinePath := path.Join(quarantineBasePath, file.AbsolutePath)
+
+	// The same path may have been quarantined before, e.g. after a recrawl
+	if IsFile(quarantinePath) {
+		quarantinePath = fmt.Sprintf("%s.%d", quarantinePath, file.FileID)
+	}
+
+	err = osMkdirAll(path.Dir(quarantinePath))
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = osMove(file.AbsolutePath, quarantinePath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	size := uint(info.Size())
+
+	return &models.QuarantinedFile{
+		FileID:         &file.FileID,
+		OriginalPath:   file.AbsolutePath,
+		QuarantinePath: quarantinePath,
+		Size:           &size,
+		ExpiresAt:      time.Now().AddDate(0, 0, int(ctx.Config.QuarantineRetentionDays)),
+	}, nil
+}
+
+// quarantineBlob moves a file out of the ZAP folder into the quarantine folder, under its path in the ZAP folder or, if
+// that is not on the local filesystem, its location, returning where it was moved to
+func (ctx *Context) quarantineBlob(blobs blobstore.BlobStore, name string) (*models.QuarantinedFile, error) {
+	quarantineBasePath, err := filepath.Abs(ctx.Config.QuarantinePath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := blobs.Stat(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	location := blobs.Location(name)
+	quarantinePath := path.Join(quarantineBasePath, strings.Replace(location, "://", "/", 1))
+
+	if IsFile(quarantinePath) {
+		quarantinePath = fmt.Sprintf("%s.%d", quarantinePath, time.Now().UnixNano())
+	}
+
+	err = osMkdirAll(path.Dir(quarantinePath))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if local, isLocal := blobs.(*blobstore.Local); isLocal {
+		err = osMove(local.Path(name), quarantinePath)
+	} else {
+		err = copyBlobToFile(blobs, name, quarantinePath)
+
+		if err == nil {
+			err = blobs.Delete(name)
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	storedSize := uint(size)
+
+	return &models.QuarantinedFile{
+		OriginalPath:   location,
+		QuarantinePath: quarantinePath,
+		Size:           &storedSize,
+		ExpiresAt:      time.Now().AddDate(0, 0, int(ctx.Config.QuarantineRetentionDays)),
+	}, nil
+}
+
+func copyBlobToFile(blobs blobstore.BlobStore, name, filePath string) error {
+	reader, err := blobs.Get(name)
+
+	if err != nil {
+		return err
+	}
+
+	defer reader.Close()
+
+	file, err := os.OpenFile(path.Clean(filePath), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(file, reader)
+	closeErr := file.Close()
+
+	if err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		_ = os.Remove(filePath)
+		return err
+	}
+
+	return nil
+}
+
+// ListQuarantine prints every file in quarantine
+func (ctx *Context) ListQuarantine() error {
+	var quarantinedFiles []models.QuarantinedFile
+	result := ctx.DB.Order("id").Find(&quarantinedFiles)
+
+	if result.Error != nil {
+		return result.Error
+	}
+
+	totalSize := uint64(0)
+
+	for _, file := range quarantinedFiles {
+		size := uint64(0)
+
+		if file.Size != nil {
+			size = uint64(*file.Size)
+		}
+
+		totalSize += size
+		utils.ConsoleAndLogPrintf("%d: \"%s\" (%s), quarantined %s, expires %s", file.ID, file.OriginalPath, humanize.Bytes(size), humanize.Time(file.CreatedAt), humanize.Time(file.ExpiresAt))
+	}
+
+	utils.ConsoleAndLogPrintf("%s in quarantine (%s)", utils.Pluralize("file", int64(len(quarantinedFiles))), humanize.Bytes(totalSize))
+	return nil
+}
+
+// RestoreQuarantine moves quarantined files back to where they were found. If no IDs are specified every file is restored.
+func (ctx *Context) RestoreQuarantine(quarantinedFileIDs []uint) error {
+	var quarantinedFiles []models.QuarantinedFile
+	query := ctx.DB.Order("id")
+
+	if len(quarantinedFileIDs) > 0 {
+		query = query.Where("id IN ?", quarantinedFileIDs)
+	}
+
+	result := query.Find(&quarantinedFiles)
+
+	if result.Error != nil {
+		return result.Error
+	}
+
+	restoredFileCount := int64(0)
+
+	for _, file := range quarantinedFiles {
+		// Such as a file from a ZAP folder kept in S3
+		if !filepath.IsAbs(file.OriginalPath) {
+			log.Printf("Not restoring \"%s\" because it was not on the local filesystem", file.OriginalPath)
+			continue
+		}
+
+		if !IsFile(file.QuarantinePath) {
+			log.Printf("Not restoring \"%s\" because \"%s\" was not found", file.OriginalPath, file.QuarantinePath)
+			continue
+		}
+
+		_, err := os.Lstat(file.OriginalPath)
+
+		if err == nil || !os.IsNotExist(err) {
+			log.Printf("Not restoring \"%s\" because something already exists there", file.OriginalPath)
+			continue
+		}
+
+		err = osMkdirAll(path.Dir(file.OriginalPath))
+
+		if err != nil {
+			return err
+		}
+
+		err = osMove(file.QuarantinePath, file.OriginalPath)
+
+		if err != nil {
+			return err
+		}
+
+		// The file was wanted back, so later ZAPs leave it where it is rather than quarantining it again
+		err = ctx.DB.Transaction(func(tx *gorm.DB) error {
+			if file.FileID != nil {
+				fileUpdateResult := tx.Model(&models.File{}).Where("id = ?", *file.FileID).Updates(map[string]interface{}{
+					"zapped":   false,
+					"restored": true,
+				})
+
+				if fileUpdateResult.Error != nil {
+					return fileUpdateResult.Error
+				}
+			}
+
+			return tx.Delete(&file).Error
+		})
+
+		if err != nil {
+			return err
+		}
+
+		restoredFileCount++
+	}
+
+	utils.ConsoleAndLogPrintf("Restored %s", utils.Pluralize("file", restoredFileCount))
+
+	return ctx.clearEmptyQuarantineFolders()
+}
+
+// PurgeQuarantine permanently deletes quarantined files whose retention period has passed, or every quarantined file if all is set
+func (ctx *Context) PurgeQuarantine(all bool) error {
+	var quarantinedFiles []models.QuarantinedFile
+	query := ctx.DB.Order("id")
+
+	if !all {
+		query = query.Where("expires_at <= ?", time.Now())
+	}
+
+	result := query.Find(&quarantinedFiles)
+
+	if result.Error != nil {
+		return result.Error
+	}
+
+	purgedBytes := uint64(0)
+
+	for _, file := range quarantinedFiles {
+		err := os.Remove(file.QuarantinePath)
+
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		result = ctx.DB.Delete(&file)
+
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if result.RowsAffected != 1 {
+			return errors.New("could not delete quarantined file from db")
+		}
+
+		if file.Size != nil {
+			purgedBytes += uint64(*file.Size)
+		}
+	}
+
+	utils.ConsoleAndLogPrintf("Purged %s (%s)", utils.Pluralize("file", int64(len(quarantinedFiles))), humanize.Bytes(purgedBytes))
+
+	return ctx.clearEmptyQuarantineFolders()
+}
+
+func (ctx *Context) clearEmptyQuarantineFolders() error {
+	if len(ctx.Config.QuarantinePath) == 0 {
+		return nil
+	}
+
+	return ClearEmptyFolders([]string{ctx.Config.QuarantinePath})
+}
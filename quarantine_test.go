@@ -0,0 +1,82 @@
+//go:build integration
+// +build integration
+
+package main
+
+import (
+	"data-tools/config"
+	"data-tools/models"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestZapShouldQuarantineDuplicates(t *testing.T) {
+	tempTestDataPath := createTempTestDataPath(t)
+	defer os.RemoveAll(tempTestDataPath)
+
+	c := &config.Config{
+		DBPath:                      path.Join(tempTestDataPath, "db.db"),
+		BatchSize:                   5,
+		MaxConcurrentFileOperations: 2,
+		ZapDataPath:                 path.Join(tempTestDataPath, "ZAP"),
+		QuarantinePath:              path.Join(tempTestDataPath, "QUARANTINE"),
+		QuarantineRetentionDays:     30,
+	}
+
+	ctx := &Context{
+		Config: c,
+		DB:     initDb(c),
+	}
+
+	dataPath := path.Join(tempTestDataPath, "a")
+	err := ctx.Crawl(dataPath)
+	assert.NoError(t, err)
+
+	err = ctx.HashFiles()
+	assert.NoError(t, err)
+
+	err = ctx.Zap()
+	assert.NoError(t, err)
+
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM quarantined_files WHERE deleted_at IS NULL", 2)
+
+	var quarantinedFiles []models.QuarantinedFile
+	result := ctx.DB.Order("id").Find(&quarantinedFiles)
+	assert.NoError(t, result.Error)
+
+	for _, file := range quarantinedFiles {
+		assert.False(t, IsFile(file.OriginalPath))
+		assert.True(t, IsFile(file.QuarantinePath))
+		assert.Equal(t, path.Join(c.QuarantinePath, file.OriginalPath), file.QuarantinePath)
+	}
+
+	err = ctx.ListQuarantine()
+	assert.NoError(t, err)
+
+	// Restoring puts the file back
+	err = ctx.RestoreQuarantine([]uint{quarantinedFiles[0].ID})
+	assert.NoError(t, err)
+	assert.True(t, IsFile(quarantinedFiles[0].OriginalPath))
+	assert.False(t, IsFile(quarantinedFiles[0].QuarantinePath))
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM quarantined_files WHERE deleted_at IS NULL", 1)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM files WHERE zapped = 0 AND restored = 1", 1)
+
+	// and the next ZAP leaves it there
+	err = ctx.Zap()
+	assert.NoError(t, err)
+	assert.True(t, IsFile(quarantinedFiles[0].OriginalPath))
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM quarantined_files WHERE deleted_at IS NULL", 1)
+
+	// Nothing has expired yet
+	err = ctx.PurgeQuarantine(false)
+	assert.NoError(t, err)
+	assert.True(t, IsFile(quarantinedFiles[1].QuarantinePath))
+
+	err = ctx.PurgeQuarantine(true)
+	assert.NoError(t, err)
+	assert.False(t, IsFile(quarantinedFiles[1].QuarantinePath))
+	assert.False(t, IsDir(c.QuarantinePath))
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM quarantined_files WHERE deleted_at IS NULL", 0)
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"data-tools/models"
+	"data-tools/utils"
+	"errors"
+	"gorm.io/gorm"
+	"io/fs"
+	"path/filepath"
+)
+
+type CrawledPath struct {
+	PathID       uint
+	ParentPathID *uint
+	Level        uint
+	Name         string
+	Ignored      bool
+	models.Metadata
+	absolutePath string // These are not exported to prevent GORM from trying to map them
+	seen         bool
+}
+
+type CrawledFile struct {
+	FileID   uint
+	PathID   uint
+	Name     string
+	Size     *uint
+	Ignored  bool
+	Zapped   bool
+	LinkType *string
+	models.Metadata
+	seen bool // This is not exported to prevent GORM from trying to map it
+}
+
+func (ctx *Context) ReCrawl(rootPath string) error {
+	absoluteRootPath, err := filepath.Abs(rootPath)
+
+	if err != nil {
+		return ErrCouldNotResolvePath
+	}
+
+	if !IsDir(absoluteRootPath) {
+		return ErrCouldNotResolvePath
+	}
+
+	var rootPathModel models.Path
+	result := ctx.DB.Where("name = ? AND parent_path_id IS NULL", absoluteRootPath).First(&rootPathModel)
+
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			utils.ConsoleAndLogPrintf("\"%s\" has not been crawled yet. Use crawl to add it.", absoluteRootPath)
+			return ErrPathNotAdded
+		}
+
+		return result.Error
+	}
+
+	utils.ConsoleAndLogPrintf("Re-crawling \"%s\"", absoluteRootPath)
+	return ctx.recrawlRootPath(rootPathModel)
+}
+
+// getPathTree returns every path beneath (and including) a root path, with their absolute paths resolved
+func (ctx *Context) getPathTree(rootPathID uint) ([]CrawledPath, map[uint]*CrawledPath, error) {
+	var paths []CrawledPath
+	result := ctx.DB.Raw(QueryGetPathTree(), rootPathID).Scan(&paths)
+
+	if result.Error != nil {
+		return nil, nil, result.Error
+	}
+
+	pathsByID := map[uint]*CrawledPath{}
+
+	// Parents are always returned before children
+	for index := range paths {
+		p := &paths[index]
+
+		if p.ParentPathID == nil {
+			p.absolutePath = p.Name
+		} else {
+			p.absolutePath = filepath.Join(pathsByID[*p.ParentPathID].absolutePath, p.Name)
+		}
+
+		pathsByID[p.PathID] = p
+	}
+
+	return paths, pathsByID, nil
+}
+
+func (ctx *Context) recrawlRootPath(rootPath models.Path) error {
+	paths, pathsByID, err := ctx.getPathTree(rootPath.ID)
+
+	if err != nil {
+		return err
+	}
+
+	var files []CrawledFile
+	result := ctx.DB.Raw(QueryGetFilesInPathTree(), rootPath.ID).Scan(&files)
+
+	if result.Error != nil {
+		return result.Error
+	}
+
+	pathsByAbsolutePath := map[string]*CrawledPath{}
+
+	for _, p := range pathsByID {
+		pathsByAbsolutePath[p.absolutePath] = p
+	}
+
+	filesByAbsolutePath := map[string]*CrawledFile{}
+
+	for index := range files {
+		f := &files[index]
+		filesByAbsolutePath[filepath.Join(pathsByID[f.PathID].absolutePath, f.Name)] = f
+	}
+
+	rootPathSeparatorCount := getPathSeparatorCount(rootPath.Name)
+	newPathCount := int64(0)
+	newFileCount := int64(0)
+	changedFileCount := int64(0)
+	removedFileCount := int64(0)
+
+	err = ctx.DB.Transaction(func(tx *gorm.DB) error {
+		err := filepath.WalkDir(rootPath.Name, func(thisPath string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			levelCalculationAsInt := getPathSeparatorCount(thisPath) - rootPathSeparatorCount
+
+			// Ensure we have not wrapped around for uint conversion, prevent CWE-190
+			if levelCalculationAsInt < 0 {
+				return nil
+			}
+
+			currentLevel := uint(levelCalculationAsInt)
+
+			if d.IsDir() {
+				if currentLevel > 0 && utils.IsInArray(d.Name(), ctx.Config.FolderNamesToIgnore) {
+					return filepath.SkipDir
+				}
+
+				existingPath, found := pathsByAbsolutePath[thisPath]
+
+				if found && existingPath.Ignored {
+					existingPath.seen = true
+					return filepath.SkipDir
+				}
+
+				info, err := d.Info()
+
+				if err != nil {
+					return err
+				}
+
+				metadata := GetMetadata(info)
+
+				if found {
+					existingPath.seen = true
+
+					if !metadataChanged(existingPath.Metadata, metadata) {
+						return nil
+					}
+
+					result := tx.Model(&models.Path{}).Where("id = ?", existingPath.PathID).Updates(models.Path{Metadata: metadata})
+
+					if result.Error != nil {
+						return result.Error
+					}
+
+					return nil
+				}
+
+				parentPath := pathsByAbsolutePath[filepath.Dir(thisPath)]
+
+				pathModel := models.Path{
+					ParentPathID: &parentPath.PathID,
+					Name:         d.Name(),
+					Level:        currentLevel,
+					Metadata:     metadata,
+				}
+
+				result := tx.Create(&pathModel)
+
+				if result.Error != nil {
+					return result.Error
+				}
+
+				newPath := &CrawledPath{
+					PathID:       pathModel.ID,
+					ParentPathID: pathModel.ParentPathID,
+					Level:        pathModel.Level,
+					Name:         pathModel.Name,
+					absolutePath: thisPath,
+					seen:         true,
+				}
+
+				pathsByID[newPath.PathID] = newPath
+				pathsByAbsolutePath[thisPath] = newPath
+				newPathCount++
+
+				return nil
+			}
+
+			if utils.IsInArray(d.Name(), ctx.Config.FileNamesToIgnore) {
+				return nil
+			}
+
+			existingFile, found := filesByAbsolutePath[thisPath]
+
+			// ZAPped files are tracked by the ZAP store so we leave them alone, as we do ignored files. Hardlinked files
+			// have the metadata of their canonical copy on disk rather than their own, and are checked by the link
+			// integrity test instead.
+			isHardlinked := found && existingFile.LinkType != nil && *existingFile.LinkType == LinkTypeHardlink
+
+			// A regular file at the path of a ZAPped file is not the symlink left by ZAP, so it has been restored or
+			// recreated since and is indexed afresh
+			if found && existingFile.Zapped && d.Type().IsRegular() {
+				info, err := d.Info()
+
+				if err != nil {
+					return err
+				}
+
+				result := tx.Model(&models.File{}).Where("id = ?", existingFile.FileID).Updates(map[string]interface{}{
+					"zapped":         false,
+					"link_type":      nil,
+					"linked_file_id": nil,
+					"file_hash_id":   nil,
+					"size":           nil,
+					"file_type_id":   nil,
+					"partial_hash":   nil,
+					"hash_deferred":  false,
+					"hash_mismatch":  false,
+				})
+
+				if result.Error != nil {
+					return result.Error
+				}
+
+				result = tx.Model(&models.File{}).Where("id = ?", existingFile.FileID).Updates(models.File{Metadata: GetMetadata(info)})
+
+				if result.Error != nil {
+					return result.Error
+				}
+
+				existingFile.Zapped = false
+				existingFile.seen = true
+				newFileCount++
+				return nil
+			}
+
+			if found && (existingFile.Zapped || existingFile.Ignored || isHardlinked) {
+				existingFile.seen = true
+				return nil
+			}
+
+			info, err := d.Info()
+
+			if err != nil {
+				return err
+			}
+
+			metadata := GetMetadata(info)
+
+			if !found {
+				result := tx.Create(&models.File{
+					PathID:   pathsByAbsolutePath[filepath.Dir(thisPath)].PathID,
+					Name:     d.Name(),
+					Level:    currentLevel,
+					Metadata: metadata,
+				})
+
+				if result.Error != nil {
+					return result.Error
+				}
+
+				newFileCount++
+				return nil
+			}
+
+			existingFile.seen = true
+
+			// Nothing to do
+			if !metadataChanged(existingFile.Metadata, metadata) {
+				return nil
+			}
+
+			result := tx.Model(&models.File{}).Where("id = ?", existingFile.FileID).Updates(models.File{Metadata: metadata})
+
+			if result.Error != nil {
+				return result.Error
+			}
+
+			if result.RowsAffected != 1 {
+				return errors.New("could not update file in db")
+			}
+
+			sizeChanged := existingFile.Size != nil && int64(*existingFile.Size) != info.Size()
+			modTimeChanged := existingFile.ModTime != nil && !existingFile.ModTime.Equal(*metadata.ModTime)
+
+			if !sizeChanged && !modTimeChanged {
+				return nil
+			}
+
+			// Reset the file so that hash will process it again
+			result = tx.Model(&models.File{}).Where("id = ?", existingFile.FileID).Updates(map[string]interface{}{
+				"file_hash_id": nil,
+				"size":         nil,
+				"file_type_id": nil,
+				"partial_hash": nil,
+			})
+
+			if result.Error != nil {
+				return result.Error
+			}
+
+			changedFileCount++
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		// The paths of ZAPped files are expected to have been removed from disk, so we keep them
+		pathIDsToKeep := map[uint]bool{}
+		var removedFileIDs []uint
+
+		for _, f := range files {
+			if f.Zapped {
+				for pathID := &f.PathID; pathID != nil; pathID = pathsByID[*pathID].ParentPathID {
+					pathIDsToKeep[*pathID] = true
+				}
+			}
+
+			if !f.seen && !f.Zapped && !f.Ignored {
+				removedFileIDs = append(removedFileIDs, f.FileID)
+			}
+		}
+
+		var removedPathIDs []uint
+
+		for _, p := range paths {
+			if !p.seen && !p.Ignored && !pathIDsToKeep[p.PathID] {
+				removedPathIDs = append(removedPathIDs, p.PathID)
+			}
+		}
+
+		removedFileCount = int64(len(removedFileIDs))
+
+		err = DealWithNotFoundFiles(tx, removedFileIDs)
+
+		if err != nil {
+			return err
+		}
+
+		return dealWithNotFoundPaths(tx, removedPathIDs)
+	})
+
+	// Output a summary
+	if err == nil {
+		utils.ConsoleAndLogPrintf("Found %s and %s. %s changed and %s removed", utils.Pluralize("new path", newPathCount), utils.Pluralize("new file", newFileCount), utils.Pluralize("file", changedFileCount), utils.Pluralize("file", removedFileCount))
+	}
+
+	return err
+}
+
+func dealWithNotFoundPaths(tx *gorm.DB, notFoundPathIDs []uint) error {
+	if len(notFoundPathIDs) > 0 {
+		notFoundPathResult := tx.Where("id IN ?", notFoundPathIDs).Delete(&models.Path{})
+
+		if notFoundPathResult.Error != nil {
+			return notFoundPathResult.Error
+		}
+
+		if notFoundPathResult.RowsAffected != int64(len(notFoundPathIDs)) {
+			return errors.New("could not delete paths from db")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"data-tools/config"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestReCrawlShouldPickUpNewChangedAndRemovedFiles(t *testing.T) {
+	tempTestDataPath := createTempTestDataPath(t)
+	defer os.RemoveAll(tempTestDataPath)
+
+	c := &config.Config{
+		DBPath:                      path.Join(tempTestDataPath, "db.db"),
+		BatchSize:                   2,
+		MaxConcurrentFileOperations: 2,
+	}
+
+	ctx := &Context{
+		Config: c,
+		DB:     initDb(c),
+	}
+
+	dataPath := path.Join(tempTestDataPath, "a")
+	err := ctx.Crawl(dataPath)
+	assert.NoError(t, err)
+
+	err = ctx.Crawl(dataPath)
+	assert.ErrorIs(t, err, ErrPathAlreadyAdded)
+
+	// Pretend the files have been hashed so that a change in size can be detected
+	result := ctx.DB.Exec("UPDATE files SET size = 29 WHERE name = 'j.txt'")
+	assert.NoError(t, result.Error)
+
+	err = os.WriteFile(path.Join(dataPath, "b", "j.txt"), []byte("changed"), 0600)
+	assert.NoError(t, err)
+
+	err = os.Remove(path.Join(dataPath, "file.md"))
+	assert.NoError(t, err)
+
+	err = os.RemoveAll(path.Join(dataPath, "b", "c"))
+	assert.NoError(t, err)
+
+	err = os.MkdirAll(path.Join(dataPath, "d"), 0750)
+	assert.NoError(t, err)
+
+	err = os.WriteFile(path.Join(dataPath, "d", "new.txt"), []byte("new"), 0600)
+	assert.NoError(t, err)
+
+	err = ctx.ReCrawl(dataPath)
+	assert.NoError(t, err)
+
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM files WHERE deleted_at IS NULL", 4)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM files WHERE deleted_at IS NOT NULL", 2)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM files WHERE deleted_at IS NULL AND size IS NULL AND name IN ('j.txt', 'new.txt')", 2)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM paths WHERE deleted_at IS NULL", 4)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM paths WHERE deleted_at IS NOT NULL AND name = 'c'", 1)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM files WHERE deleted_at IS NULL AND mod_time IS NOT NULL AND mode IS NOT NULL", 4)
+
+	// Nothing has changed since
+	err = ctx.ReCrawl(dataPath)
+	assert.NoError(t, err)
+
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM files WHERE deleted_at IS NULL", 4)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM paths WHERE deleted_at IS NULL", 4)
+}
+
+func TestReCrawlShouldErrorIfThePathHasNotBeenAdded(t *testing.T) {
+	tempTestDataPath := createTempTestDataPath(t)
+	defer os.RemoveAll(tempTestDataPath)
+
+	c := &config.Config{
+		DBPath: path.Join(tempTestDataPath, "db.db"),
+	}
+
+	ctx := &Context{
+		Config: c,
+		DB:     initDb(c),
+	}
+
+	err := ctx.ReCrawl(path.Join(tempTestDataPath, "a"))
+	assert.ErrorIs(t, err, ErrPathNotAdded)
+}
+
+func TestReCrawlShouldPickUpFilesRecreatedWhereZappedFilesWere(t *testing.T) {
+	tempTestDataPath := createTempTestDataPath(t)
+	defer os.RemoveAll(tempTestDataPath)
+
+	c := &config.Config{
+		DBPath:                      path.Join(tempTestDataPath, "db.db"),
+		BatchSize:                   2,
+		MaxConcurrentFileOperations: 2,
+	}
+
+	ctx := &Context{
+		Config: c,
+		DB:     initDb(c),
+	}
+
+	dataPath := path.Join(tempTestDataPath, "a")
+	err := ctx.Crawl(dataPath)
+	assert.NoError(t, err)
+
+	// Pretend both copies of file.md have been hashed and ZAPped
+	result := ctx.DB.Exec("UPDATE files SET size = 6, zapped = 1 WHERE name = 'file.md'")
+	assert.NoError(t, result.Error)
+
+	err = os.Remove(path.Join(dataPath, "file.md"))
+	assert.NoError(t, err)
+
+	err = os.Remove(path.Join(dataPath, "a", "file.md"))
+	assert.NoError(t, err)
+
+	err = os.WriteFile(path.Join(dataPath, "file.md"), []byte("recreated"), 0600)
+	assert.NoError(t, err)
+
+	err = ctx.ReCrawl(dataPath)
+	assert.NoError(t, err)
+
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM files WHERE deleted_at IS NULL AND name = 'file.md'", 2)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM files WHERE deleted_at IS NULL AND name = 'file.md' AND zapped = 1", 1)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM files WHERE deleted_at IS NULL AND name = 'file.md' AND zapped = 0 AND size IS NULL AND level = 1", 1)
+}
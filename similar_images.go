@@ -0,0 +1,257 @@
+package main
+
+import (
+	"data-tools/imagehash"
+	"data-tools/utils"
+	"errors"
+	"github.com/dustin/go-humanize"
+	"github.com/schollz/progressbar/v3"
+	"gorm.io/gorm"
+	"io/fs"
+	"log"
+	"slices"
+)
+
+type ImageToHash struct {
+	FileHashID   uint
+	Hash         string
+	Zapped       bool
+	FileType     string
+	FileID       *uint
+	AbsolutePath *string
+}
+
+type SimilarImage struct {
+	FileHashID     uint
+	PerceptualHash int64
+	Size           uint
+	AbsolutePath   string
+	Distance       int // From the first image in the group
+}
+
+// hashImages computes the perceptual hash of every image once, so that similar_images can find images which look the
+// same but are not identical
+func (ctx *Context) hashImages() error {
+	supportedTypes := imagehash.SupportedTypes()
+
+	var count int64 = 0
+	result := ctx.DB.Raw(QueryCountImagesToPerceptuallyHash(), supportedTypes).Scan(&count)
+
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if count == 0 {
+		return nil
+	}
+
+	utils.ConsoleAndLogPrintf("Perceptually hashing %s", utils.Pluralize("image", count))
+	bar := progressbar.Default(count)
+	var folder *zapFolder
+
+	for {
+		var images []ImageToHash
+		result := ctx.DB.Raw(QueryGetImagesToPerceptuallyHashWithLimit(), supportedTypes, ctx.Config.BatchSize).Scan(&images)
+
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if len(images) == 0 {
+			return nil
+		}
+
+		// The ZAP folder is only opened when needed, as it may be encrypted
+		if folder == nil && slices.ContainsFunc(images, func(image ImageToHash) bool { return image.Zapped }) {
+			var err error
+			folder, err = ctx.openZapFolder(ctx.Config.ZapDataPath)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		perceptualHashes := map[uint]int64{}
+		var failedFileHashIDs []uint
+		var notFoundFileIDs []uint
+
+		orchestrator := utils.NewTaskOrchestrator(bar, len(images), ctx.Config.MaxConcurrentFileOperations)
+
+		for _, image := range images {
+			orchestrator.StartTask()
+
+			go func(image ImageToHash) {
+				defer orchestrator.FinishTask()
+
+				perceptualHash, err := ctx.hashImage(folder, image)
+
+				orchestrator.Lock()
+				defer orchestrator.Unlock()
+
+				// Another copy of the image will be tried next time
+				if errors.Is(err, fs.ErrNotExist) && !image.Zapped && image.FileID != nil {
+					log.Printf("Ignoring not-found file \"%s\"", *image.AbsolutePath)
+					notFoundFileIDs = append(notFoundFileIDs, *image.FileID)
+					return
+				}
+
+				// Marked as failed, so that it is not read again only to be skipped
+				if errors.Is(err, imagehash.ErrTooLarge) {
+					log.Printf("Skipping perceptually hashing image with hash %s: %v", image.Hash, err)
+					failedFileHashIDs = append(failedFileHashIDs, image.FileHashID)
+					return
+				}
+
+				if err != nil {
+					log.Printf("Error: Could not perceptually hash image with hash %s: %v", image.Hash, err)
+					failedFileHashIDs = append(failedFileHashIDs, image.FileHashID)
+					return
+				}
+
+				// SQLite integers are signed, so the bits are stored as they are
+				perceptualHashes[image.FileHashID] = int64(perceptualHash) // #nosec G115
+			}(image)
+		}
+
+		orchestrator.WaitForTasks()
+
+		err := ctx.DB.Transaction(func(tx *gorm.DB) error {
+			for fileHashID, perceptualHash := range perceptualHashes {
+				result := tx.Exec("UPDATE file_hashes SET perceptual_hash = ? WHERE id = ?", perceptualHash, fileHashID)
+
+				if result.Error != nil {
+					return result.Error
+				}
+			}
+
+			if len(failedFileHashIDs) > 0 {
+				result := tx.Exec("UPDATE file_hashes SET perceptual_hash_failed = 1 WHERE id IN ?", failedFileHashIDs)
+
+				if result.Error != nil {
+					return result.Error
+				}
+			}
+
+			return DealWithNotFoundFiles(tx, notFoundFileIDs)
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// hashImage reads an image from the ZAP folder if it has been ZAP-ped there, otherwise from one of its copies
+func (ctx *Context) hashImage(folder *zapFolder, image ImageToHash) (uint64, error) {
+	if image.Zapped {
+		reader, err := folder.openFile(image.Hash)
+
+		if err != nil {
+			return 0, err
+		}
+
+		defer reader.Close()
+
+		return imagehash.Hash(reader, image.FileType)
+	}
+
+	if image.AbsolutePath == nil {
+		return 0, errors.New("no copies of the image were found")
+	}
+
+	return imagehash.HashFile(*image.AbsolutePath, image.FileType)
+}
+
+// SimilarImages reports groups of images whose perceptual hashes are within the configured distance of each other, for
+// them to be reviewed. Nothing is ZAP-ped.
+func (ctx *Context) SimilarImages(maxDistance int) error {
+	if !ctx.Config.PerceptualHash {
+		utils.ConsoleAndLogPrintf("perceptual_hash is disabled, so only images hashed while it was enabled are compared. Enable it and run hash to include the rest.")
+	}
+
+	groups, err := ctx.findSimilarImages(maxDistance)
+
+	if err != nil {
+		return err
+	}
+
+	for _, group := range groups {
+		utils.ConsoleAndLogPrintf("%s similar images:", humanize.Comma(int64(len(group))))
+
+		for _, image := range group {
+			utils.ConsoleAndLogPrintf("  %s (%s, distance %d)", image.AbsolutePath, humanize.Bytes(uint64(image.Size)), image.Distance)
+		}
+	}
+
+	utils.ConsoleAndLogPrintf("Found %s of similar images within a distance of %d", utils.Pluralize("group", int64(len(groups))), maxDistance)
+	return nil
+}
+
+// findSimilarImages groups images which are within maxDistance of any other image in the group
+func (ctx *Context) findSimilarImages(maxDistance int) ([][]SimilarImage, error) {
+	var images []SimilarImage
+	result := ctx.DB.Raw(QueryGetPerceptuallyHashedImages()).Scan(&images)
+
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	tree := &imagehash.BKTree{}
+
+	for index, image := range images {
+		tree.Add(uint64(image.PerceptualHash), uint(index)) // #nosec G115
+	}
+
+	// Union-find, so that chains of similar images end up in one group
+	parents := make([]int, len(images))
+
+	for index := range parents {
+		parents[index] = index
+	}
+
+	var findRoot func(index int) int
+	findRoot = func(index int) int {
+		if parents[index] != index {
+			parents[index] = findRoot(parents[index])
+		}
+
+		return parents[index]
+	}
+
+	for index, image := range images {
+		for _, match := range tree.Find(uint64(image.PerceptualHash), maxDistance) { // #nosec G115
+			left, right := findRoot(index), findRoot(int(match))
+
+			// The lowest index is kept as the root so that groups are in a deterministic order
+			if left < right {
+				parents[right] = left
+			} else if right < left {
+				parents[left] = right
+			}
+		}
+	}
+
+	var roots []int
+	members := map[int][]SimilarImage{}
+
+	for index, image := range images {
+		root := findRoot(index)
+
+		if _, found := members[root]; !found {
+			roots = append(roots, root)
+		}
+
+		image.Distance = imagehash.Distance(uint64(images[root].PerceptualHash), uint64(image.PerceptualHash)) // #nosec G115
+		members[root] = append(members[root], image)
+	}
+
+	var groups [][]SimilarImage
+
+	for _, root := range roots {
+		if len(members[root]) > 1 {
+			groups = append(groups, members[root])
+		}
+	}
+
+	return groups, nil
+}
@@ -0,0 +1,82 @@
+//go:build integration
+// +build integration
+
+package main
+
+import (
+	"data-tools/config"
+	"github.com/stretchr/testify/assert"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestSimilarImages(t *testing.T) {
+	tempTestDataPath := createTempTestDataPath(t)
+	defer os.RemoveAll(tempTestDataPath)
+
+	c := &config.Config{
+		DBPath:                      path.Join(tempTestDataPath, "db.db"),
+		BatchSize:                   5,
+		MaxConcurrentFileOperations: 2,
+		ZapDataPath:                 path.Join(tempTestDataPath, "ZAP"),
+		PerceptualHash:              true,
+		HashPrefilter:               true, // The images are not duplicates, so would otherwise not be hashed
+	}
+
+	ctx := &Context{
+		Config: c,
+		DB:     initDb(c),
+	}
+
+	// Save the test image again at half the size, as a JPEG
+	dataPath := path.Join(tempTestDataPath, "a")
+	original, err := os.Open(path.Join(dataPath, "b", "4276652.png"))
+	assert.NoError(t, err)
+
+	img, err := png.Decode(original)
+	assert.NoError(t, err)
+	assert.NoError(t, original.Close())
+
+	bounds := img.Bounds()
+	resized := image.NewRGBA(image.Rect(0, 0, bounds.Dx()/2, bounds.Dy()/2))
+
+	for y := 0; y < bounds.Dy()/2; y++ {
+		for x := 0; x < bounds.Dx()/2; x++ {
+			resized.Set(x, y, img.At(bounds.Min.X+x*2, bounds.Min.Y+y*2))
+		}
+	}
+
+	resizedPath := path.Join(dataPath, "resized.jpg")
+	resizedFile, err := os.Create(resizedPath)
+	assert.NoError(t, err)
+	assert.NoError(t, jpeg.Encode(resizedFile, resized, &jpeg.Options{Quality: 70}))
+	assert.NoError(t, resizedFile.Close())
+
+	// Images which cannot be decoded are only tried once
+	assert.NoError(t, os.WriteFile(path.Join(dataPath, "broken.png"), []byte("\x89PNG\r\n\x1a\nbroken"), 0644))
+
+	err = ctx.Crawl(dataPath)
+	assert.NoError(t, err)
+
+	err = ctx.HashFiles()
+	assert.NoError(t, err)
+
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes WHERE perceptual_hash IS NOT NULL", 2)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes WHERE perceptual_hash_failed = 1", 1)
+
+	groups, err := ctx.findSimilarImages(10)
+	assert.NoError(t, err)
+	assert.Len(t, groups, 1)
+	assert.Len(t, groups[0], 2)
+	assert.Equal(t, 0, groups[0][0].Distance)
+	assert.ElementsMatch(t, []string{path.Join(dataPath, "b", "4276652.png"), resizedPath}, []string{groups[0][0].AbsolutePath, groups[0][1].AbsolutePath})
+
+	// The images are not identical, so a distance of 0 does not group them
+	groups, err = ctx.findSimilarImages(0)
+	assert.NoError(t, err)
+	assert.Empty(t, groups)
+}
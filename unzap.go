@@ -1,6 +1,7 @@
 package main
 
 import (
+	"data-tools/models"
 	"data-tools/utils"
 	"github.com/dustin/go-humanize"
 	"github.com/schollz/progressbar/v3"
@@ -10,7 +11,13 @@ import (
 	"path/filepath"
 )
 
-func (ctx *Context) UnZap(sourcePath, outputPath string) error {
+type UnZapResult struct {
+	ZapResult
+	Corrupt bool
+	models.Metadata
+}
+
+func (ctx *Context) UnZap(sourcePath, outputPath string, restoreMetadata bool) error {
 	_, err := os.Stat(outputPath)
 
 	// We expect the output directory to be empty
@@ -47,6 +54,23 @@ SELECT (SELECT COUNT(*) FROM file_hashes WHERE size IS NOT NULL AND ignored = 0
 		return err
 	}
 
+	folder, err := ctx.openZapFolder(sourcePath)
+
+	if err != nil {
+		return err
+	}
+
+	var corruptCount int64
+	result = ctx.DB.Model(&models.FileHash{}).Where("zapped = 1 AND ignored = 0 AND corrupt = 1").Count(&corruptCount)
+
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if corruptCount > 0 {
+		utils.ConsoleAndLogPrintf("Skipping the files of %s which are corrupt in the ZAP folder. Replace them from a backup and run integrity --deep to un-ZAP them.", utils.Pluralize("hash", corruptCount))
+	}
+
 	percentage := 100 - ((float64(info.TotalFileSize-info.UniqueHashTotalFileSize) / float64(info.TotalFileSize)) * 100)
 	utils.ConsoleAndLogPrintf("Un-ZAPing %s to %s (%.2f%%) at \"%s\"", humanize.Bytes(info.TotalFileSize-info.UniqueHashTotalFileSize), humanize.Bytes(info.TotalFileSize), percentage, destinationAbsolutePath)
 
@@ -57,7 +81,7 @@ SELECT (SELECT COUNT(*) FROM file_hashes WHERE size IS NOT NULL AND ignored = 0
 
 	// Do batches until there are no more
 	for {
-		var fileHashesToUnZap []ZapResult
+		var fileHashesToUnZap []UnZapResult
 		result = ctx.DB.Raw(QueryGetZappedFileHashesToUnZapWithLimit(), processedFileIds, ctx.Config.BatchSize).Scan(&fileHashesToUnZap)
 
 		if result.Error != nil {
@@ -66,7 +90,7 @@ SELECT (SELECT COUNT(*) FROM file_hashes WHERE size IS NOT NULL AND ignored = 0
 
 		// Have we finished?
 		if len(fileHashesToUnZap) == 0 {
-			return nil
+			break
 		}
 
 		err = createFolders(destinationAbsolutePath, fileHashesToUnZap)
@@ -81,16 +105,74 @@ SELECT (SELECT COUNT(*) FROM file_hashes WHERE size IS NOT NULL AND ignored = 0
 
 		for _, fileHash := range fileHashesToUnZap {
 			orchestrator.StartTask()
-			go ctx.unZapFile(orchestrator, &processedFileIds, sourcePath, destinationAbsolutePath, &fileHash, &notFoundFileIDs)
+			go ctx.unZapFile(orchestrator, &processedFileIds, folder, destinationAbsolutePath, &fileHash, restoreMetadata, &notFoundFileIDs)
 		}
 
 		orchestrator.WaitForTasks()
 
-		return DealWithNotFoundFiles(ctx.DB, notFoundFileIDs)
+		err = DealWithNotFoundFiles(ctx.DB, notFoundFileIDs)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if !restoreMetadata {
+		return nil
+	}
+
+	// Restoring files changes the modification time of their folders, so folders are done last
+	return ctx.restoreFolderMetadata(destinationAbsolutePath)
+}
+
+func (ctx *Context) restoreFolderMetadata(destinationAbsolutePath string) error {
+	utils.ConsoleAndLogPrintf("Restoring folder metadata")
+
+	var rootPathIDs []uint
+	result := ctx.DB.Model(&models.Path{}).Where("parent_path_id IS NULL AND ignored = 0").Order("id").Pluck("id", &rootPathIDs)
+
+	if result.Error != nil {
+		return result.Error
+	}
+
+	folderMetadata := map[string]models.Metadata{}
+	var folderPaths []string
+
+	for _, rootPathID := range rootPathIDs {
+		_, pathsByID, err := ctx.getPathTree(rootPathID)
+
+		if err != nil {
+			return err
+		}
+
+		for _, p := range pathsByID {
+			folderPath := path.Join(destinationAbsolutePath, p.absolutePath)
+
+			// Empty folders are not created when un-ZAPping
+			if !IsDir(folderPath) {
+				continue
+			}
+
+			folderMetadata[folderPath] = p.Metadata
+			folderPaths = append(folderPaths, folderPath)
+		}
+	}
+
+	// Children first, so that restrictive permissions on a parent do not get in the way
+	sortFilePathsByLongest(folderPaths)
+
+	for _, folderPath := range folderPaths {
+		err := ApplyMetadata(folderPath, folderMetadata[folderPath])
+
+		if err != nil {
+			log.Printf("Could not restore metadata of folder \"%s\": %v", folderPath, err)
+		}
 	}
+
+	return nil
 }
 
-func createFolders(destinationAbsolutePath string, fileHashesToUnZap []ZapResult) error {
+func createFolders(destinationAbsolutePath string, fileHashesToUnZap []UnZapResult) error {
 	var resolvedPaths []string
 
 	for _, file := range fileHashesToUnZap {
@@ -110,12 +192,9 @@ func createFolders(destinationAbsolutePath string, fileHashesToUnZap []ZapResult
 	return nil
 }
 
-func (ctx *Context) unZapFile(orchestrator *utils.TaskOrchestrator, processedFileIds *[]uint, zapSourcePath, destinationAbsolutePath string, file *ZapResult, notFoundFileIDs *[]uint) {
-	hexFileName := DecodeHash(file.Hash)
-	sourceFilePath := path.Join(zapSourcePath, FormatRelativeZapFilePathFromHash(hexFileName))
-
+func (ctx *Context) unZapFile(orchestrator *utils.TaskOrchestrator, processedFileIds *[]uint, folder *zapFolder, destinationAbsolutePath string, file *UnZapResult, restoreMetadata bool, notFoundFileIDs *[]uint) {
 	// If the file does not exist we can ignore it
-	if !IsFile(sourceFilePath) {
+	if _, err := folder.statFile(file.Hash); err != nil {
 		orchestrator.Lock()
 		log.Printf("Ignoring not-found file \"%s\"", file.AbsolutePath)
 		*processedFileIds = append(*processedFileIds, file.FileID)
@@ -126,15 +205,34 @@ func (ctx *Context) unZapFile(orchestrator *utils.TaskOrchestrator, processedFil
 		return
 	}
 
+	// A corrupt file would be restored as something else
+	if file.Corrupt {
+		orchestrator.Lock()
+		log.Printf("Not un-ZAP-ping \"%s\" because its copy in the ZAP folder is corrupt", file.AbsolutePath)
+		*processedFileIds = append(*processedFileIds, file.FileID)
+		orchestrator.Unlock()
+
+		orchestrator.FinishTask()
+		return
+	}
+
 	destinationFilePath := path.Join(destinationAbsolutePath, file.AbsolutePath)
 
 	// un-ZAP to a non-zap location, e.g. expand to some location on disk
-	_, err := CopyOrMoveFile(sourceFilePath, destinationFilePath, false, false)
+	err := folder.copyFile(file.Hash, destinationFilePath)
 
 	if err != nil {
 		log.Panic(err)
 	}
 
+	if restoreMetadata {
+		err = ApplyMetadata(destinationFilePath, file.Metadata)
+
+		if err != nil {
+			log.Printf("Could not restore metadata of file \"%s\": %v", destinationFilePath, err)
+		}
+	}
+
 	orchestrator.Lock()
 	*processedFileIds = append(*processedFileIds, file.FileID)
 	orchestrator.Unlock()
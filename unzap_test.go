@@ -0,0 +1,76 @@
+//go:build integration
+// +build integration
+
+package main
+
+import (
+	"data-tools/config"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestUnZapShouldRestoreMetadata(t *testing.T) {
+	tempTestDataPath := createTempTestDataPath(t)
+	defer os.RemoveAll(tempTestDataPath)
+
+	c := &config.Config{
+		DBPath:                      path.Join(tempTestDataPath, "db.db"),
+		BatchSize:                   2,
+		MaxConcurrentFileOperations: 2,
+		ZapDataPath:                 path.Join(tempTestDataPath, "ZAP"),
+	}
+
+	ctx := &Context{
+		Config: c,
+		DB:     initDb(c),
+	}
+
+	dataPath := path.Join(tempTestDataPath, "a")
+	modTime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+
+	err := os.Chtimes(path.Join(dataPath, "b", "j.txt"), modTime, modTime)
+	assert.NoError(t, err)
+
+	err = os.Chmod(path.Join(dataPath, "b", "j.txt"), 0640)
+	assert.NoError(t, err)
+
+	err = os.Chtimes(path.Join(dataPath, "b"), modTime, modTime)
+	assert.NoError(t, err)
+
+	err = ctx.Crawl(dataPath)
+	assert.NoError(t, err)
+
+	err = ctx.HashFiles()
+	assert.NoError(t, err)
+
+	err = ctx.Zap()
+	assert.NoError(t, err)
+
+	outputPath := path.Join(tempTestDataPath, "output")
+	err = ctx.UnZap(c.ZapDataPath, outputPath, true)
+	assert.NoError(t, err)
+
+	// All batches should have been un-ZAPped
+	_, fileCount := getFolderAndFileTotalCount(t, outputPath)
+	assert.Equal(t, 5, fileCount)
+
+	info, err := os.Stat(path.Join(outputPath, dataPath, "b", "j.txt"))
+	assert.NoError(t, err)
+	assert.True(t, modTime.Equal(info.ModTime()))
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+
+	info, err = os.Stat(path.Join(outputPath, dataPath, "b"))
+	assert.NoError(t, err)
+	assert.True(t, modTime.Equal(info.ModTime()))
+
+	outputPath = path.Join(tempTestDataPath, "output-without-metadata")
+	err = ctx.UnZap(c.ZapDataPath, outputPath, false)
+	assert.NoError(t, err)
+
+	info, err = os.Stat(path.Join(outputPath, dataPath, "b", "j.txt"))
+	assert.NoError(t, err)
+	assert.False(t, modTime.Equal(info.ModTime()))
+}
@@ -4,41 +4,71 @@ import (
 	"data-tools/models"
 	"data-tools/utils"
 	"errors"
-	"fmt"
 	"github.com/schollz/progressbar/v3"
 	"gorm.io/gorm"
 	"log"
 	"os"
 	"path"
-	"path/filepath"
 )
 
 type ZapResult struct {
 	FileHashID   uint
 	Hash         string
 	FileID       uint
+	FileType     *string
 	AbsolutePath string
 }
 
-func (ctx *Context) Zap(safeMode bool) error {
+func (ctx *Context) Zap() error {
+	// Files which cannot be duplicates still need a hash to be named in the ZAP folder
+	if !ctx.isLinkMode() {
+		err := ctx.hashDeferredFiles()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	utils.ConsoleAndLogPrintf("Selecting the copy of each file to keep...")
+	err := ctx.selectCanonicalFiles(ctx.recordCanonicalFiles)
+
+	if err != nil {
+		return err
+	}
+
+	if ctx.isLinkMode() {
+		utils.ConsoleAndLogPrintf("Replacing duplicate files with %ss...", ctx.Config.ZapMode)
+		return ctx.linkDuplicates(ctx.Config.ZapMode)
+	}
+
 	utils.ConsoleAndLogPrintf("Moving unique files to ZAP folder...")
-	err := ctx.moveUniqueFilesToZapFolder(safeMode)
+	err = ctx.moveUniqueFilesToZapFolder()
 
 	if err != nil {
 		return err
 	}
 
-	utils.ConsoleAndLogPrintf("Deleting duplicate files...")
-	err = ctx.deleteDuplicates(safeMode)
+	if ctx.Config.ZapMode == LinkTypeSymlink {
+		utils.ConsoleAndLogPrintf("Replacing duplicate files with symlinks...")
+	} else {
+		utils.ConsoleAndLogPrintf("Deleting duplicate files...")
+	}
+
+	err = ctx.deleteDuplicates()
 
 	if err != nil {
 		return err
 	}
 
-	return ctx.removeEmptyZappedFolders(safeMode)
+	// Symlinks are left where the files were, so no folders will have been emptied
+	if ctx.Config.ZapMode == LinkTypeSymlink {
+		return nil
+	}
+
+	return ctx.removeEmptyZappedFolders()
 }
 
-func (ctx *Context) moveUniqueFilesToZapFolder(safeMode bool) error {
+func (ctx *Context) moveUniqueFilesToZapFolder() error {
 	utils.ConsoleAndLogPrintf("Acquiring data...")
 	total, batches, err := ctx.GetBatchesOfIDs(QueryGetFileIdsToZap(), "f")
 
@@ -51,13 +81,7 @@ func (ctx *Context) moveUniqueFilesToZapFolder(safeMode bool) error {
 		return nil
 	}
 
-	outputPathAbs, err := filepath.Abs(ctx.Config.ZapDataPath)
-
-	if err != nil {
-		return err
-	}
-
-	err = createZapDirectoryStructure(outputPathAbs)
+	store, err := ctx.newZapStore(ctx.Config.ZapDataPath)
 
 	if err != nil {
 		return err
@@ -78,12 +102,13 @@ func (ctx *Context) moveUniqueFilesToZapFolder(safeMode bool) error {
 		var zappedFileHashIds []uint
 		var zappedFileIds []uint
 		var notFoundFileIDs []uint
+		storedSizes := map[uint]uint{}
 
 		orchestrator := utils.NewTaskOrchestrator(bar, len(fileHashesToZap), ctx.Config.MaxConcurrentFileOperations)
 
 		for _, fileHash := range fileHashesToZap {
 			orchestrator.StartTask()
-			go ctx.zapFile(orchestrator, safeMode, outputPathAbs, fileHash, &zappedFileHashIds, &zappedFileIds, &notFoundFileIDs)
+			go ctx.zapFile(orchestrator, store, fileHash, &zappedFileHashIds, &zappedFileIds, &notFoundFileIDs, storedSizes)
 		}
 
 		orchestrator.WaitForTasks()
@@ -103,6 +128,12 @@ func (ctx *Context) moveUniqueFilesToZapFolder(safeMode bool) error {
 				}
 			}
 
+			err := updateFileHashesByID(tx, "stored_size", storedSizes)
+
+			if err != nil {
+				return err
+			}
+
 			if len(zappedFileIds) > 0 {
 				zapFileError := zapFilesInDB(tx, zappedFileIds)
 
@@ -111,6 +142,14 @@ func (ctx *Context) moveUniqueFilesToZapFolder(safeMode bool) error {
 				}
 			}
 
+			if ctx.Config.ZapMode == LinkTypeSymlink {
+				symlinkFileError := symlinkFilesInDB(tx, zappedFileIds)
+
+				if symlinkFileError != nil {
+					return symlinkFileError
+				}
+			}
+
 			return DealWithNotFoundFiles(tx, notFoundFileIDs)
 		})
 
@@ -119,6 +158,7 @@ func (ctx *Context) moveUniqueFilesToZapFolder(safeMode bool) error {
 		}
 	}
 
+	store.printStats()
 	return nil
 }
 
@@ -156,7 +196,7 @@ func DealWithNotFoundFiles(tx *gorm.DB, notFoundFileIDs []uint) error {
 	return nil
 }
 
-func (ctx *Context) zapFile(orchestrator *utils.TaskOrchestrator, safeMode bool, zapBasePath string, file ZapResult, zappedFileHashIds, zappedFileIds, notFoundFileIDs *[]uint) {
+func (ctx *Context) zapFile(orchestrator *utils.TaskOrchestrator, store *zapStore, file ZapResult, zappedFileHashIds, zappedFileIds, notFoundFileIDs *[]uint, storedSizes map[uint]uint) {
 	// If the file does not exist we can ignore it
 	if !IsFile(file.AbsolutePath) {
 		orchestrator.Lock()
@@ -168,32 +208,51 @@ func (ctx *Context) zapFile(orchestrator *utils.TaskOrchestrator, safeMode bool,
 		return
 	}
 
-	// Store as hex so this will work fine on case-insensitive filesystems
-	hexFileName := DecodeHash(file.Hash)
-	destinationPath := path.Join(zapBasePath, FormatRelativeZapFilePathFromHash(hexFileName))
-
-	// Only move if not in safe mode
-	move := !safeMode
-
-	// ZAP
-	success, err := CopyOrMoveFile(file.AbsolutePath, destinationPath, move, true)
+	// ZAP, in chunks or compressed if configured to
+	success, storedSize, err := store.store(file)
 
 	if err != nil {
 		log.Fatalf("Could not ZAP file \"%s\": %v", file.AbsolutePath, err)
 	}
 
+	if success && ctx.Config.ZapMode == LinkTypeSymlink {
+		// Symlinks can only be used with a local ZAP folder, which the config checks
+		zapFilePath, _ := store.folder.localPath(DecodeHash(file.Hash), "")
+		err = ctx.replaceWithSymlink(zapFilePath, file.AbsolutePath)
+
+		if err != nil {
+			log.Fatalf("Could not replace ZAP-ped file \"%s\" with a symlink: %v", file.AbsolutePath, err)
+		}
+	}
+
 	if success {
 		orchestrator.Lock()
 		*zappedFileHashIds = append(*zappedFileHashIds, file.FileHashID)
 		*zappedFileIds = append(*zappedFileIds, file.FileID)
+
+		if storedSize != nil {
+			storedSizes[file.FileHashID] = *storedSize
+		}
+
 		orchestrator.Unlock()
 	}
 
 	orchestrator.FinishTask()
 }
 
-func (ctx *Context) deleteDuplicates(safeMode bool) error {
+func (ctx *Context) deleteDuplicates() error {
 	utils.ConsoleAndLogPrintf("Acquiring data...")
+	var corruptDuplicateCount int64
+	result := ctx.DB.Raw(QueryCountDuplicatesOfCorruptHashes()).Scan(&corruptDuplicateCount)
+
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if corruptDuplicateCount > 0 {
+		utils.ConsoleAndLogPrintf("Keeping %s whose copy in the ZAP folder is corrupt. Use one to replace the corrupt copy, then run integrity --deep.", utils.Pluralize("duplicate file", corruptDuplicateCount))
+	}
+
 	total, batches, err := ctx.GetBatchesOfIDs(QueryGetDuplicateFileIdsToRemove(), "f")
 
 	if err != nil {
@@ -205,12 +264,23 @@ func (ctx *Context) deleteDuplicates(safeMode bool) error {
 		return nil
 	}
 
-	utils.ConsoleAndLogPrintf("Deleting %s in %s", utils.Pluralize("duplicate file", total), utils.Pluralize("batch", int64(len(batches))))
+	folder, err := ctx.openZapFolder(ctx.Config.ZapDataPath)
+
+	if err != nil {
+		return err
+	}
+
+	if len(ctx.Config.QuarantinePath) > 0 && ctx.Config.ZapMode != LinkTypeSymlink {
+		utils.ConsoleAndLogPrintf("Quarantining %s to \"%s\" in %s", utils.Pluralize("duplicate file", total), ctx.Config.QuarantinePath, utils.Pluralize("batch", int64(len(batches))))
+	} else {
+		utils.ConsoleAndLogPrintf("Deleting %s in %s", utils.Pluralize("duplicate file", total), utils.Pluralize("batch", int64(len(batches))))
+	}
 
 	bar := progressbar.Default(total)
+	changedFileCount := int64(0)
 
 	for _, batch := range batches {
-		var duplicateFilesToRemove []FileIdAndPath
+		var duplicateFilesToRemove []ZapResult
 		result := ctx.DB.Raw(QueryGetDuplicateFilesToRemove(), batch).Scan(&duplicateFilesToRemove)
 
 		if result.Error != nil {
@@ -221,10 +291,12 @@ func (ctx *Context) deleteDuplicates(safeMode bool) error {
 
 		var zappedFileIds []uint
 		var notFoundFileIDs []uint
+		var quarantinedFiles []*models.QuarantinedFile
+		var changedFileIDs []uint
 
 		for _, file := range duplicateFilesToRemove {
 			orchestrator.StartTask()
-			go ctx.deleteDuplicateFile(orchestrator, safeMode, file, &zappedFileIds, &notFoundFileIDs)
+			go ctx.deleteDuplicateFile(orchestrator, folder, file, &zappedFileIds, &notFoundFileIDs, &changedFileIDs, &quarantinedFiles)
 		}
 
 		orchestrator.WaitForTasks()
@@ -236,18 +308,72 @@ func (ctx *Context) deleteDuplicates(safeMode bool) error {
 				return zapFileError
 			}
 
+			if ctx.Config.ZapMode == LinkTypeSymlink {
+				symlinkFileError := symlinkFilesInDB(tx, zappedFileIds)
+
+				if symlinkFileError != nil {
+					return symlinkFileError
+				}
+			}
+
+			if len(quarantinedFiles) > 0 {
+				quarantineResult := tx.Create(quarantinedFiles)
+
+				if quarantineResult.Error != nil {
+					return quarantineResult.Error
+				}
+			}
+
+			hashMismatchError := flagHashMismatchesInDB(tx, changedFileIDs)
+
+			if hashMismatchError != nil {
+				return hashMismatchError
+			}
+
 			return DealWithNotFoundFiles(tx, notFoundFileIDs)
 		})
 
 		if transactionErr != nil {
 			return transactionErr
 		}
+
+		changedFileCount += int64(len(changedFileIDs))
+	}
+
+	if changedFileCount > 0 {
+		utils.ConsoleAndLogPrintf("Kept %s which changed since hashing. Run hash again to pick up the changes.", utils.Pluralize("file", changedFileCount))
 	}
 
 	return nil
 }
 
-func (ctx *Context) deleteDuplicateFile(orchestrator *utils.TaskOrchestrator, safeMode bool, file FileIdAndPath, zappedFileIds, notFoundFileIDs *[]uint) {
+// flagHashMismatchesInDB marks files whose contents no longer match their hash, and clears the hash so that they are hashed again
+func flagHashMismatchesInDB(tx *gorm.DB, changedFileIDs []uint) error {
+	if len(changedFileIDs) == 0 {
+		return nil
+	}
+
+	result := tx.Model(&models.File{}).Where("id IN ?", changedFileIDs).Updates(map[string]interface{}{
+		"hash_mismatch": true,
+		"file_hash_id":  nil,
+		"size":          nil,
+		"file_type_id":  nil,
+		"partial_hash":  nil,
+	})
+
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected != int64(len(changedFileIDs)) {
+		return errors.New("could not flag changed files in db")
+	}
+
+	// The cached hash is wrong if the contents changed without the size or modification time changing
+	return forgetCachedHashes(tx, changedFileIDs)
+}
+
+func (ctx *Context) deleteDuplicateFile(orchestrator *utils.TaskOrchestrator, folder *zapFolder, file ZapResult, zappedFileIds, notFoundFileIDs, changedFileIDs *[]uint, quarantinedFiles *[]*models.QuarantinedFile) {
 	// If the file does not exist we can ignore it
 	if !IsFile(file.AbsolutePath) {
 		orchestrator.Lock()
@@ -259,7 +385,41 @@ func (ctx *Context) deleteDuplicateFile(orchestrator *utils.TaskOrchestrator, sa
 		return
 	}
 
-	if !safeMode {
+	hexFileName := DecodeHash(file.Hash)
+
+	// The hash may be days old, so make sure the ZAP-ped copy really is the same before getting rid of the duplicate
+	if ctx.Config.VerifyBeforeDelete {
+		isSameContent, err := folder.compareWithFile(file.Hash, file.AbsolutePath)
+
+		if err != nil || !isSameContent {
+			orchestrator.Lock()
+			log.Printf("Not removing \"%s\" because it does not match \"%s\" (%v)", file.AbsolutePath, folder.location(hexFileName, ""), err)
+			*changedFileIDs = append(*changedFileIDs, file.FileID)
+			orchestrator.Unlock()
+
+			orchestrator.FinishTask()
+			return
+		}
+	}
+
+	if ctx.Config.ZapMode == LinkTypeSymlink {
+		zapFilePath, _ := folder.localPath(hexFileName, "")
+		err := ctx.replaceWithSymlink(zapFilePath, file.AbsolutePath)
+
+		if err != nil {
+			log.Fatalf("Could not replace duplicate file \"%s\" with a symlink: %v", file.AbsolutePath, err)
+		}
+	} else if len(ctx.Config.QuarantinePath) > 0 {
+		quarantinedFile, err := ctx.quarantineFile(file)
+
+		if err != nil {
+			log.Fatalf("Could not quarantine file \"%s\": %v", file.AbsolutePath, err)
+		}
+
+		orchestrator.Lock()
+		*quarantinedFiles = append(*quarantinedFiles, quarantinedFile)
+		orchestrator.Unlock()
+	} else {
 		err := os.Remove(file.AbsolutePath)
 
 		if err != nil && !os.IsNotExist(err) {
@@ -274,7 +434,7 @@ func (ctx *Context) deleteDuplicateFile(orchestrator *utils.TaskOrchestrator, sa
 	orchestrator.FinishTask()
 }
 
-func (ctx *Context) removeEmptyZappedFolders(safeMode bool) error {
+func (ctx *Context) removeEmptyZappedFolders() error {
 	utils.ConsoleAndLogPrintf("Deleting empty folders...")
 
 	var filesToProcess []string
@@ -297,49 +457,5 @@ func (ctx *Context) removeEmptyZappedFolders(safeMode bool) error {
 		}
 	}
 
-	if safeMode {
-		return nil
-	}
-
 	return ClearEmptyFolders(foldersToProcess)
 }
-
-// This will create 65,536 'buckets' in which to store the data from 00/00 to ff/ff
-func createZapDirectoryStructure(absoluteBasePath string) error {
-	info, err := os.Stat(absoluteBasePath)
-
-	// If a folder already exists at this location we assume the Zap structure has already been created
-	if info != nil || !os.IsNotExist(err) {
-		return err
-	}
-
-	utils.ConsoleAndLogPrintf("Creating ZAP data structure")
-
-	err = osMkdir(absoluteBasePath)
-
-	if err != nil {
-		return err
-	}
-
-	for level1 := 0; level1 < 0x100; level1++ {
-		level1Path := path.Join(absoluteBasePath, fmt.Sprintf("%02x", level1))
-
-		err = osMkdir(level1Path)
-
-		if err != nil {
-			return err
-		}
-
-		for level2 := 0; level2 < 0x100; level2++ {
-			level2Path := path.Join(level1Path, fmt.Sprintf("%02x", level2))
-
-			err = osMkdir(level2Path)
-
-			if err != nil {
-				return err
-			}
-		}
-	}
-
-	return nil
-}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"data-tools/chunker"
+	"data-tools/crypto"
+	"data-tools/utils"
+	"fmt"
+	"github.com/dustin/go-humanize"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// chunkManifestSuffix is added to the ZAP path of a file to give the path of its manifest, when it is stored in chunks
+const chunkManifestSuffix = ".chunks"
+
+// A chunkStore stores large files in the ZAP folder as content-defined chunks. Each chunk is stored once, named by its
+// hash like any other ZAP-ped file, and a manifest listing the chunks of a file is stored in place of the file.
+type chunkStore struct {
+	folder           *zapFolder
+	hasher           *crypto.Hasher
+	averageSize      int
+	minFileSize      int64
+	mutex            sync.Mutex
+	files            int64
+	bytes            uint64
+	newChunks        int64
+	newChunkBytes    uint64
+	reusedChunks     int64
+	reusedChunkBytes uint64
+}
+
+type chunkManifestEntry struct {
+	hash string
+	size int64
+}
+
+// newChunkStore returns nil unless chunking is enabled
+func (ctx *Context) newChunkStore(folder *zapFolder) (*chunkStore, error) {
+	if !ctx.Config.ZapChunking {
+		return nil, nil
+	}
+
+	hasher, err := ctx.getHasher()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &chunkStore{
+		folder:      folder,
+		hasher:      hasher,
+		averageSize: int(ctx.Config.ZapChunkSize),
+		minFileSize: ctx.Config.ZapChunkingMinFileSize,
+	}, nil
+}
+
+// store stores a file in chunks if it is large enough, returning false if it is not, and the bytes of new chunks
+func (s *chunkStore) store(filePath, hexFileName string) (bool, *uint, error) {
+	if s == nil {
+		return false, nil, nil
+	}
+
+	info, err := os.Stat(filePath)
+
+	if err != nil {
+		return false, nil, err
+	}
+
+	if info.Size() < s.minFileSize {
+		return false, nil, nil
+	}
+
+	newChunkBytes, err := s.storeFile(filePath, hexFileName)
+
+	if err != nil {
+		return false, nil, err
+	}
+
+	storedSize := uint(newChunkBytes)
+	return true, &storedSize, nil
+}
+
+// storeFile splits a file into chunks, stores those which are not already in the ZAP folder, then stores the manifest
+func (s *chunkStore) storeFile(filePath, hexFileName string) (uint64, error) {
+	file, err := os.Open(path.Clean(filePath))
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer file.Close()
+
+	fileChunker, err := chunker.New(bufio.NewReader(file), s.averageSize)
+
+	if err != nil {
+		return 0, err
+	}
+
+	var manifest strings.Builder
+	var fileBytes, newChunkBytes, reusedChunkBytes uint64
+	var newChunks, reusedChunks int64
+
+	for {
+		chunk, err := fileChunker.Next()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return 0, err
+		}
+
+		chunkHash := DecodeHash(s.hasher.HashBytes(chunk))
+
+		if s.folder.exists(chunkHash, "") {
+			reusedChunks++
+			reusedChunkBytes += uint64(len(chunk))
+		} else {
+			err = s.folder.write(chunkHash, "", func(w io.Writer) error {
+				_, err := w.Write(chunk)
+				return err
+			})
+
+			if err != nil {
+				return 0, err
+			}
+
+			newChunks++
+			newChunkBytes += uint64(len(chunk))
+		}
+
+		fileBytes += uint64(len(chunk))
+		manifest.WriteString(fmt.Sprintf("%s %d\n", chunkHash, len(chunk)))
+	}
+
+	err = s.folder.write(hexFileName, chunkManifestSuffix, func(w io.Writer) error {
+		_, err := io.WriteString(w, manifest.String())
+		return err
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	s.mutex.Lock()
+	s.files++
+	s.bytes += fileBytes
+	s.newChunks += newChunks
+	s.newChunkBytes += newChunkBytes
+	s.reusedChunks += reusedChunks
+	s.reusedChunkBytes += reusedChunkBytes
+	s.mutex.Unlock()
+
+	return newChunkBytes, nil
+}
+
+func (s *chunkStore) printStats() {
+	if s == nil || s.files == 0 {
+		return
+	}
+
+	utils.ConsoleAndLogPrintf("Stored %s (%s) in chunks: %s (%s) were new and %s (%s) were already stored", utils.Pluralize("file", s.files), humanize.Bytes(s.bytes), utils.Pluralize("chunk", s.newChunks), humanize.Bytes(s.newChunkBytes), utils.Pluralize("chunk", s.reusedChunks), humanize.Bytes(s.reusedChunkBytes))
+}
+
+func (f *zapFolder) readChunkManifest(hexFileName string) ([]chunkManifestEntry, error) {
+	return f.readChunkManifestBlob(f.blobName(hexFileName, chunkManifestSuffix))
+}
+
+// readChunkManifestBlob reads a manifest by its name in the blob store
+func (f *zapFolder) readChunkManifestBlob(name string) ([]chunkManifestEntry, error) {
+	reader, err := f.openBlob(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+
+	if err != nil {
+		return nil, err
+	}
+
+	manifestLocation := f.blobs.Location(name)
+	var entries []chunkManifestEntry
+
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if len(line) == 0 {
+			continue
+		}
+
+		fields := strings.Fields(line)
+
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid chunk manifest \"%s\"", manifestLocation)
+		}
+
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid chunk manifest \"%s\": %w", manifestLocation, err)
+		}
+
+		entries = append(entries, chunkManifestEntry{hash: fields[0], size: size})
+	}
+
+	return entries, nil
+}
+
+// chunkReader reads the chunks of a file one after another, only opening one at a time
+type chunkReader struct {
+	folder  *zapFolder
+	chunks  []chunkManifestEntry
+	current io.ReadCloser
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.chunks) == 0 {
+				return 0, io.EOF
+			}
+
+			chunk, err := r.folder.open(r.chunks[0].hash, "")
+
+			if err != nil {
+				return 0, err
+			}
+
+			r.current = chunk
+			r.chunks = r.chunks[1:]
+		}
+
+		read, err := r.current.Read(p)
+
+		if err == io.EOF {
+			_ = r.current.Close()
+			r.current = nil
+
+			if read == 0 {
+				continue
+			}
+
+			return read, nil
+		}
+
+		return read, err
+	}
+}
+
+func (r *chunkReader) Close() error {
+	if r.current == nil {
+		return nil
+	}
+
+	return r.current.Close()
+}
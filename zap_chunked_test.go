@@ -0,0 +1,175 @@
+//go:build integration
+// +build integration
+
+package main
+
+import (
+	"data-tools/blobstore"
+	"data-tools/config"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestZapShouldStoreLargeFilesInChunks(t *testing.T) {
+	tempTestDataPath := createTempTestDataPath(t)
+	defer os.RemoveAll(tempTestDataPath)
+
+	c := &config.Config{
+		DBPath:                      path.Join(tempTestDataPath, "db.db"),
+		BatchSize:                   2,
+		MaxConcurrentFileOperations: 2,
+		ZapDataPath:                 path.Join(tempTestDataPath, "ZAP"),
+		VerifyBeforeDelete:          true,
+		ZapChunking:                 true,
+		ZapChunkingMinFileSize:      64 * 1024,
+		ZapChunkSize:                1024,
+	}
+
+	ctx := &Context{
+		Config: c,
+		DB:     initDb(c),
+	}
+
+	// Two large files which only differ by a few bytes in the middle
+	dataPath := path.Join(tempTestDataPath, "a")
+	original := make([]byte, 256*1024)
+	rand.New(rand.NewSource(1)).Read(original)
+
+	edited := append([]byte{}, original[:100000]...)
+	edited = append(edited, []byte("an edit")...)
+	edited = append(edited, original[100000:]...)
+
+	assert.NoError(t, os.MkdirAll(path.Join(dataPath, "images"), 0755))
+	assert.NoError(t, os.WriteFile(path.Join(dataPath, "images", "original.img"), original, 0644))
+	assert.NoError(t, os.WriteFile(path.Join(dataPath, "images", "edited.img"), edited, 0644))
+
+	err := ctx.Crawl(dataPath)
+	assert.NoError(t, err)
+
+	err = ctx.HashFiles()
+	assert.NoError(t, err)
+
+	var hashes []string
+	result := ctx.DB.Raw("SELECT hash FROM file_hashes WHERE size >= ? ORDER BY id", c.ZapChunkingMinFileSize).Scan(&hashes)
+	assert.NoError(t, result.Error)
+	assert.Len(t, hashes, 3) // Including the PNG
+
+	err = ctx.Zap()
+	assert.NoError(t, err)
+
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM files WHERE zapped = 1", 7)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes WHERE zapped = 1", 5)
+
+	// Large files are only stored as manifests, small ones are stored whole
+	for _, hash := range hashes {
+		zapFilePath := path.Join(c.ZapDataPath, FormatRelativeZapFilePathFromHash(DecodeHash(hash)))
+		assert.False(t, IsFile(zapFilePath))
+		assert.True(t, IsFile(zapFilePath+chunkManifestSuffix))
+	}
+
+	var smallHash string
+	result = ctx.DB.Raw("SELECT hash FROM file_hashes WHERE size = 6").Scan(&smallHash)
+	assert.NoError(t, result.Error)
+	assert.True(t, IsFile(path.Join(c.ZapDataPath, FormatRelativeZapFilePathFromHash(DecodeHash(smallHash)))))
+
+	// Most chunks of the edited file are shared with the original
+	readManifestOfSize := func(size int) []chunkManifestEntry {
+		var hash string
+		result := ctx.DB.Raw("SELECT hash FROM file_hashes WHERE size = ?", size).Scan(&hash)
+		assert.NoError(t, result.Error)
+
+		chunks, err := (&zapFolder{blobs: blobstore.NewLocal(c.ZapDataPath)}).readChunkManifest(DecodeHash(hash))
+		assert.NoError(t, err)
+
+		return chunks
+	}
+
+	originalChunks := readManifestOfSize(len(original))
+	editedChunks := readManifestOfSize(len(edited))
+
+	sharedChunks := map[string]bool{}
+
+	for _, chunk := range originalChunks {
+		sharedChunks[chunk.hash] = true
+	}
+
+	unsharedCount := 0
+
+	for _, chunk := range editedChunks {
+		if !sharedChunks[chunk.hash] {
+			unsharedCount++
+		}
+	}
+
+	assert.Greater(t, len(editedChunks), 100)
+	assert.LessOrEqual(t, unsharedCount, 3)
+
+	// The integrity check finds every chunk
+	err = ctx.ZapDBIntegrityTestBySize()
+	assert.NoError(t, err)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes WHERE zapped = 1", 5)
+
+	outputPath := path.Join(tempTestDataPath, "output")
+	err = ctx.UnZap(c.ZapDataPath, outputPath, false)
+	assert.NoError(t, err)
+
+	_, fileCount := getFolderAndFileTotalCount(t, outputPath)
+	assert.Equal(t, 7, fileCount)
+
+	restored, err := os.ReadFile(path.Join(outputPath, dataPath, "images", "original.img"))
+	assert.NoError(t, err)
+	assert.Equal(t, original, restored)
+
+	restored, err = os.ReadFile(path.Join(outputPath, dataPath, "images", "edited.img"))
+	assert.NoError(t, err)
+	assert.Equal(t, edited, restored)
+
+	isSame, err := CompareFiles(path.Join(testDataPath, "a", "b", "4276652.png"), path.Join(outputPath, dataPath, "b", "4276652.png"))
+	assert.NoError(t, err)
+	assert.True(t, isSame)
+}
+
+func TestZapIntegrityShouldFindMissingChunks(t *testing.T) {
+	tempTestDataPath := createTempTestDataPath(t)
+	defer os.RemoveAll(tempTestDataPath)
+
+	c := &config.Config{
+		DBPath:                      path.Join(tempTestDataPath, "db.db"),
+		BatchSize:                   5,
+		MaxConcurrentFileOperations: 2,
+		ZapDataPath:                 path.Join(tempTestDataPath, "ZAP"),
+		ZapChunking:                 true,
+		ZapChunkingMinFileSize:      64 * 1024,
+		ZapChunkSize:                1024,
+	}
+
+	ctx := &Context{
+		Config: c,
+		DB:     initDb(c),
+	}
+
+	err := ctx.Crawl(path.Join(tempTestDataPath, "a"))
+	assert.NoError(t, err)
+
+	err = ctx.HashFiles()
+	assert.NoError(t, err)
+
+	err = ctx.Zap()
+	assert.NoError(t, err)
+
+	var pngHash string
+	result := ctx.DB.Raw("SELECT hash FROM file_hashes WHERE size = 255630").Scan(&pngHash)
+	assert.NoError(t, result.Error)
+
+	chunks, err := (&zapFolder{blobs: blobstore.NewLocal(c.ZapDataPath)}).readChunkManifest(DecodeHash(pngHash))
+	assert.NoError(t, err)
+	assert.NoError(t, os.Remove(path.Join(c.ZapDataPath, FormatRelativeZapFilePathFromHash(chunks[len(chunks)/2].hash))))
+
+	err = ctx.ZapDBIntegrityTestBySize()
+	assert.NoError(t, err)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes WHERE zapped = 1", 2)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes WHERE zapped = 0 AND size = 255630", 1)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"data-tools/magic"
+	"data-tools/utils"
+	"errors"
+	"fmt"
+	"github.com/dustin/go-humanize"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"os"
+	"path"
+	"sync"
+)
+
+// compressedSuffix is added to the ZAP path of a file when it is stored compressed
+const compressedSuffix = ".zst"
+
+// compressionSampleSize is how much of the start of a larger file is compressed to tell if the rest is worth compressing
+const compressionSampleSize = 128 * 1024
+
+var errNotSmaller = errors.New("compressing did not make the file smaller")
+
+// A compressor stores files in the ZAP folder compressed with zstd
+type compressor struct {
+	mutex           sync.Mutex
+	files           int64
+	bytes           uint64
+	compressedBytes uint64
+}
+
+// newCompressor returns nil unless compression is enabled
+func (ctx *Context) newCompressor() *compressor {
+	if !ctx.Config.ZapCompression {
+		return nil
+	}
+
+	return &compressor{}
+}
+
+// store compresses a file into the ZAP folder, returning false if it should be stored as it is instead
+func (c *compressor) store(folder *zapFolder, filePath, hexFileName string, fileType *string) (bool, *uint, error) {
+	if c == nil || (fileType != nil && magic.IsCompressed(*fileType)) {
+		return false, nil, nil
+	}
+
+	size, compressedSize, err := compressFile(folder, filePath, hexFileName)
+
+	if errors.Is(err, errNotSmaller) {
+		return false, nil, nil
+	}
+
+	if err != nil {
+		return false, nil, err
+	}
+
+	c.mutex.Lock()
+	c.files++
+	c.bytes += uint64(size)
+	c.compressedBytes += uint64(compressedSize)
+	c.mutex.Unlock()
+
+	storedSize := uint(compressedSize)
+	return true, &storedSize, nil
+}
+
+func (c *compressor) printStats() {
+	if c == nil || c.files == 0 {
+		return
+	}
+
+	utils.ConsoleAndLogPrintf("Compressed %s from %s to %s", utils.Pluralize("file", c.files), humanize.Bytes(c.bytes), humanize.Bytes(c.compressedBytes))
+}
+
+// compressFile stores a compressed copy of a file, returning the sizes before and after. Nothing is stored if the
+// copy would not be smaller.
+func compressFile(folder *zapFolder, filePath, hexFileName string) (int64, int64, error) {
+	file, err := os.Open(path.Clean(filePath))
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	defer file.Close()
+
+	info, err := file.Stat()
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// Files which do not compress, such as archives not recognised by their type, would otherwise be compressed in full
+	// only to be thrown away
+	if info.Size() > compressionSampleSize {
+		isSmaller, err := compressSample(file)
+
+		if err != nil {
+			return 0, 0, err
+		}
+
+		if !isSmaller {
+			return info.Size(), 0, errNotSmaller
+		}
+	}
+
+	counter := &countingWriter{}
+
+	err = folder.write(hexFileName, compressedSuffix, func(w io.Writer) error {
+		counter.writer = w
+		encoder, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+
+		if err != nil {
+			return err
+		}
+
+		// Recording the size lets it be checked without decompressing
+		encoder.ResetContentSize(counter, info.Size())
+
+		_, err = io.Copy(encoder, file)
+		closeErr := encoder.Close()
+
+		if err == nil {
+			err = closeErr
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if counter.count >= info.Size() {
+			return errNotSmaller
+		}
+
+		return nil
+	})
+
+	return info.Size(), counter.count, err
+}
+
+// compressSample returns true if the start of a file is smaller compressed, leaving the file to be read from the start
+func compressSample(file *os.File) (bool, error) {
+	sample := make([]byte, compressionSampleSize)
+	read, err := io.ReadFull(file, sample)
+
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return false, err
+	}
+
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+
+	if err != nil {
+		return false, err
+	}
+
+	compressed := encoder.EncodeAll(sample[:read], nil)
+	err = encoder.Close()
+
+	if err != nil {
+		return false, err
+	}
+
+	_, err = file.Seek(0, io.SeekStart)
+
+	if err != nil {
+		return false, err
+	}
+
+	return len(compressed) < read, nil
+}
+
+type countingWriter struct {
+	writer io.Writer
+	count  int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	written, err := w.writer.Write(p)
+	w.count += int64(written)
+
+	return written, err
+}
+
+// compressedReader decompresses a file as it is read
+type compressedReader struct {
+	*zstd.Decoder
+	reader io.ReadCloser
+}
+
+func newCompressedReader(reader io.ReadCloser) (io.ReadCloser, error) {
+	decoder, err := zstd.NewReader(reader, zstd.WithDecoderConcurrency(1))
+
+	if err != nil {
+		_ = reader.Close()
+		return nil, err
+	}
+
+	return &compressedReader{Decoder: decoder, reader: reader}, nil
+}
+
+func (r *compressedReader) Close() error {
+	r.Decoder.Close()
+	return r.reader.Close()
+}
+
+// readCompressedSize returns the size of compressed data before it was compressed, as recorded by compressFile
+func readCompressedSize(reader io.Reader) (int64, error) {
+	header := make([]byte, zstd.HeaderMaxSize)
+	read, err := io.ReadFull(reader, header)
+
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return 0, err
+	}
+
+	var frameHeader zstd.Header
+	err = frameHeader.Decode(header[:read])
+
+	if err != nil {
+		return 0, fmt.Errorf("invalid compressed file: %w", err)
+	}
+
+	if !frameHeader.HasFCS {
+		return 0, errors.New("compressed file does not record its size")
+	}
+
+	return int64(frameHeader.FrameContentSize), nil // #nosec G115
+}
@@ -0,0 +1,160 @@
+//go:build integration
+// +build integration
+
+package main
+
+import (
+	"data-tools/blobstore"
+	"data-tools/config"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestZapShouldCompressFiles(t *testing.T) {
+	tempTestDataPath := createTempTestDataPath(t)
+	defer os.RemoveAll(tempTestDataPath)
+
+	c := &config.Config{
+		DBPath:                      path.Join(tempTestDataPath, "db.db"),
+		BatchSize:                   2,
+		MaxConcurrentFileOperations: 2,
+		ZapDataPath:                 path.Join(tempTestDataPath, "ZAP"),
+		VerifyBeforeDelete:          true,
+		ZapCompression:              true,
+	}
+
+	ctx := &Context{
+		Config: c,
+		DB:     initDb(c),
+	}
+
+	dataPath := path.Join(tempTestDataPath, "a")
+	logContents := []byte(strings.Repeat("2001-02-03 04:05:06 Something happened\n", 1000))
+	assert.NoError(t, os.WriteFile(path.Join(dataPath, "app.log"), logContents, 0644))
+	assert.NoError(t, os.WriteFile(path.Join(dataPath, "b", "app.log"), logContents, 0644))
+
+	err := ctx.Crawl(dataPath)
+	assert.NoError(t, err)
+
+	err = ctx.HashFiles()
+	assert.NoError(t, err)
+
+	err = ctx.Zap()
+	assert.NoError(t, err)
+
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM files WHERE zapped = 1", 7)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes WHERE zapped = 1", 4)
+
+	zapFilePathOfSize := func(size int) string {
+		var hash string
+		result := ctx.DB.Raw("SELECT hash FROM file_hashes WHERE size = ?", size).Scan(&hash)
+		assert.NoError(t, result.Error)
+
+		return path.Join(c.ZapDataPath, FormatRelativeZapFilePathFromHash(DecodeHash(hash)))
+	}
+
+	// The log is compressed, the PNG is already compressed and the small file would not be any smaller
+	assert.True(t, IsFile(zapFilePathOfSize(len(logContents))+compressedSuffix))
+	assert.False(t, IsFile(zapFilePathOfSize(len(logContents))))
+	assert.True(t, IsFile(zapFilePathOfSize(255630)))
+	assert.True(t, IsFile(zapFilePathOfSize(6)))
+
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes WHERE stored_size < size", 1)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes WHERE stored_size = size", 3)
+
+	// The integrity check reads the size from the compressed file
+	err = ctx.ZapDBIntegrityTestBySize()
+	assert.NoError(t, err)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes WHERE zapped = 1", 4)
+
+	outputPath := path.Join(tempTestDataPath, "output")
+	err = ctx.UnZap(c.ZapDataPath, outputPath, false)
+	assert.NoError(t, err)
+
+	_, fileCount := getFolderAndFileTotalCount(t, outputPath)
+	assert.Equal(t, 7, fileCount)
+
+	restored, err := os.ReadFile(path.Join(outputPath, dataPath, "b", "app.log"))
+	assert.NoError(t, err)
+	assert.Equal(t, logContents, restored)
+}
+
+func TestZapShouldNotCompressFilesWhichDoNotStartSmaller(t *testing.T) {
+	tempTestDataPath := createTempTestDataPath(t)
+	defer os.RemoveAll(tempTestDataPath)
+
+	c := &config.Config{
+		DBPath:                      path.Join(tempTestDataPath, "db.db"),
+		BatchSize:                   2,
+		MaxConcurrentFileOperations: 2,
+		ZapDataPath:                 path.Join(tempTestDataPath, "ZAP"),
+		ZapCompression:              true,
+	}
+
+	ctx := &Context{
+		Config: c,
+		DB:     initDb(c),
+	}
+
+	// Random data which no type is recognised for, followed by data which would compress well
+	contents := make([]byte, compressionSampleSize)
+	_, err := rand.New(rand.NewSource(1)).Read(contents)
+	assert.NoError(t, err)
+	contents = append(contents, make([]byte, 4*compressionSampleSize)...)
+
+	dataPath := path.Join(tempTestDataPath, "a")
+	assert.NoError(t, os.WriteFile(path.Join(dataPath, "random.bin"), contents, 0644))
+
+	err = ctx.Crawl(dataPath)
+	assert.NoError(t, err)
+
+	err = ctx.HashFiles()
+	assert.NoError(t, err)
+
+	err = ctx.Zap()
+	assert.NoError(t, err)
+
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes WHERE zapped = 1", 4)
+
+	// Only the start of the file is compressed to decide
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes WHERE size = "+strconv.Itoa(len(contents))+" AND stored_size = size", 1)
+
+	_, fileCount := getFolderAndFileTotalCount(t, c.ZapDataPath)
+	assert.Equal(t, 5, fileCount) // The files and layout.json
+
+	err = ctx.ZapDBIntegrityTestBySize()
+	assert.NoError(t, err)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes WHERE zapped = 1", 4)
+}
+
+func TestMergeZapsShouldOnlyStoreEachFileOnce(t *testing.T) {
+	tempTestDataPath := createEmptyTempTestDataPath(t)
+	defer os.RemoveAll(tempTestDataPath)
+
+	source := blobstore.NewLocal(path.Join(tempTestDataPath, "source"))
+	destination := blobstore.NewLocal(path.Join(tempTestDataPath, "destination"))
+	sourcePath := path.Join(source.BasePath(), "ab", "cd")
+	destinationPath := path.Join(destination.BasePath(), "ab", "cd")
+	assert.NoError(t, os.MkdirAll(sourcePath, 0755))
+	assert.NoError(t, os.MkdirAll(destinationPath, 0755))
+
+	// Stored compressed in one and whole in the other
+	assert.NoError(t, os.WriteFile(path.Join(sourcePath, "ef"+compressedSuffix), []byte("compressed"), 0644))
+	assert.NoError(t, os.WriteFile(path.Join(destinationPath, "ef"), []byte("whole"), 0644))
+	assert.NoError(t, os.WriteFile(path.Join(sourcePath, "01"+compressedSuffix), []byte("compressed"), 0644))
+	assert.NoError(t, os.WriteFile(path.Join(sourcePath, ".data-tools-123"), []byte("partial"), 0644))
+
+	err := mergeZaps(source, destination)
+	assert.NoError(t, err)
+
+	assert.False(t, IsFile(path.Join(sourcePath, "ef"+compressedSuffix)))
+	assert.False(t, IsFile(path.Join(destinationPath, "ef"+compressedSuffix)))
+	assert.True(t, IsFile(path.Join(destinationPath, "ef")))
+	assert.True(t, IsFile(path.Join(destinationPath, "01"+compressedSuffix)))
+	assert.False(t, IsFile(path.Join(destinationPath, ".data-tools-123")))
+}
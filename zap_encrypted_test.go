@@ -0,0 +1,132 @@
+//go:build integration
+// +build integration
+
+package main
+
+import (
+	"data-tools/config"
+	"data-tools/crypto"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestZapShouldEncryptFiles(t *testing.T) {
+	tempTestDataPath := createTempTestDataPath(t)
+	defer os.RemoveAll(tempTestDataPath)
+
+	t.Setenv(zapPassphraseVariable, "correct horse battery staple")
+
+	c := &config.Config{
+		DBPath:                      path.Join(tempTestDataPath, "db.db"),
+		BatchSize:                   2,
+		MaxConcurrentFileOperations: 2,
+		ZapDataPath:                 path.Join(tempTestDataPath, "ZAP"),
+		VerifyBeforeDelete:          true,
+		ZapEncryption:               true,
+		ZapCompression:              true,
+	}
+
+	ctx := &Context{
+		Config: c,
+		DB:     initDb(c),
+	}
+
+	dataPath := path.Join(tempTestDataPath, "a")
+	logContents := []byte(strings.Repeat("2001-02-03 04:05:06 Something happened\n", 1000))
+	assert.NoError(t, os.WriteFile(path.Join(dataPath, "app.log"), logContents, 0644))
+
+	err := ctx.Crawl(dataPath)
+	assert.NoError(t, err)
+
+	err = ctx.HashFiles()
+	assert.NoError(t, err)
+
+	err = ctx.Zap()
+	assert.NoError(t, err)
+
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes WHERE zapped = 1", 4)
+	assert.True(t, IsFile(path.Join(c.ZapDataPath, encryptionParametersFileName)))
+
+	folder, err := ctx.openZapFolder(c.ZapDataPath)
+	assert.NoError(t, err)
+
+	var hashes []string
+	result := ctx.DB.Raw("SELECT hash FROM file_hashes").Scan(&hashes)
+	assert.NoError(t, result.Error)
+
+	// Files are not named by their hashes, and cannot be read without the key
+	for _, hash := range hashes {
+		hexFileName := DecodeHash(hash)
+		assert.False(t, IsFile(path.Join(c.ZapDataPath, FormatRelativeZapFilePathFromHash(hexFileName))))
+		assert.True(t, folder.isStored(hexFileName))
+	}
+
+	var smallFileHash string
+	result = ctx.DB.Raw("SELECT hash FROM file_hashes WHERE size = 6").Scan(&smallFileHash)
+	assert.NoError(t, result.Error)
+
+	smallFilePath, _ := folder.localPath(DecodeHash(smallFileHash), "")
+	encrypted, err := os.ReadFile(smallFilePath)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(encrypted), "# File")
+
+	err = ctx.ZapDBIntegrityTestBySize()
+	assert.NoError(t, err)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes WHERE zapped = 1", 4)
+
+	outputPath := path.Join(tempTestDataPath, "output")
+	err = ctx.UnZap(c.ZapDataPath, outputPath, false)
+	assert.NoError(t, err)
+
+	_, fileCount := getFolderAndFileTotalCount(t, outputPath)
+	assert.Equal(t, 6, fileCount)
+
+	restored, err := os.ReadFile(path.Join(outputPath, dataPath, "app.log"))
+	assert.NoError(t, err)
+	assert.Equal(t, logContents, restored)
+
+	t.Setenv(zapPassphraseVariable, "wrong")
+	_, err = ctx.openZapFolder(c.ZapDataPath)
+	assert.ErrorIs(t, err, crypto.ErrWrongKey)
+}
+
+func TestZapShouldNotEncryptFolderWithUnencryptedFiles(t *testing.T) {
+	tempTestDataPath := createTempTestDataPath(t)
+	defer os.RemoveAll(tempTestDataPath)
+
+	keyFilePath := path.Join(tempTestDataPath, "key")
+	assert.NoError(t, os.WriteFile(keyFilePath, []byte("secret"), 0600))
+
+	c := &config.Config{
+		DBPath:                      path.Join(tempTestDataPath, "db.db"),
+		BatchSize:                   2,
+		MaxConcurrentFileOperations: 2,
+		ZapDataPath:                 path.Join(tempTestDataPath, "ZAP"),
+		VerifyBeforeDelete:          true,
+		ZapEncryptionKeyFile:        keyFilePath,
+	}
+
+	ctx := &Context{
+		Config: c,
+		DB:     initDb(c),
+	}
+
+	dataPath := path.Join(tempTestDataPath, "a")
+	err := ctx.Crawl(dataPath)
+	assert.NoError(t, err)
+
+	err = ctx.HashFiles()
+	assert.NoError(t, err)
+
+	err = ctx.Zap()
+	assert.NoError(t, err)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes WHERE zapped = 1", 3)
+
+	c.ZapEncryption = true
+	_, err = ctx.newZapStore(c.ZapDataPath)
+	assert.ErrorIs(t, err, ErrZapFolderNotEncrypted)
+	assert.False(t, IsFile(path.Join(c.ZapDataPath, encryptionParametersFileName)))
+}
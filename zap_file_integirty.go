@@ -4,16 +4,13 @@ import (
 	"data-tools/models"
 	"data-tools/utils"
 	"errors"
+	"gorm.io/gorm"
+	"io/fs"
 	"log"
-	"os"
-	"path"
 )
 
-// TODO: file integrity check on the zap folder. Do the hashes match the filenames
-
-// first check sizes with os.Stat call against DB, first pass is this.
-// Then we can check the actual hashes
-
+// ZapDBIntegrityTestBySize is a quick check of the ZAP folder, comparing the size of every file with the DB. Run
+// ZapScrub to check that their contents still match their hashes.
 func (ctx *Context) ZapDBIntegrityTestBySize() error {
 	hashes := make(map[string]int64)
 
@@ -49,7 +46,13 @@ ORDER BY    id -- for deterministic result order
 	}
 
 	utils.ConsoleAndLogPrintf("Checking %d hashes", len(hashes))
-	notFoundHashes, err := AssertHashesInZapPath(ctx.Config.ZapDataPath, hashes)
+	folder, err := ctx.openZapFolder(ctx.Config.ZapDataPath)
+
+	if err != nil {
+		return err
+	}
+
+	notFoundHashes, err := AssertHashesInZapPath(folder, hashes)
 
 	if err != nil {
 		return err
@@ -76,34 +79,125 @@ ORDER BY    id -- for deterministic result order
 	return nil
 }
 
-func AssertHashesInZapPath(zapPath string, hashes map[string]int64) ([]string, error) {
+func AssertHashesInZapPath(folder *zapFolder, hashes map[string]int64) ([]string, error) {
 	var notFoundHashes []string
 
 	for hash, size := range hashes {
 		hexFileName := DecodeHash(hash)
-		filePath := path.Join(zapPath, FormatRelativeZapFilePathFromHash(hexFileName))
 
-		stat, err := os.Stat(filePath)
+		// Files stored in chunks are only found when every chunk is
+		zapFileSize, err := folder.statFile(hash)
 
-		if os.IsNotExist(err) {
-			log.Printf("Hash not found in ZAP folder: %s", hexFileName)
+		if errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Hash not found in ZAP folder: %s (%v)", hexFileName, err)
 			notFoundHashes = append(notFoundHashes, hash)
 			continue
 		} else if err != nil {
 			return nil, err
 		}
 
-		if stat == nil {
-			log.Printf("Stat is nil: %s", hexFileName)
+		if zapFileSize != size {
+			log.Printf("Hash size mismatch: expected %d, got %d for hash %s", size, zapFileSize, hexFileName)
 			notFoundHashes = append(notFoundHashes, hash)
-			continue
 		}
+	}
 
-		if stat.Size() != size {
-			log.Printf("Hash size mismatch: expected %d, got %d for hash %s", size, stat.Size(), hexFileName)
-			notFoundHashes = append(notFoundHashes, hash)
+	return notFoundHashes, nil
+}
+
+// LinkIntegrityTest checks that files which were replaced by links still point at their canonical copy.
+// Broken links are reset in the DB so that the next ZAP will link them again.
+func (ctx *Context) LinkIntegrityTest() error {
+	total, batches, err := ctx.GetBatchesOfIDs(QueryGetLinkedFileIds(), "f")
+
+	if err != nil {
+		return err
+	}
+
+	if len(batches) == 0 {
+		return nil
+	}
+
+	utils.ConsoleAndLogPrintf("Checking %s", utils.Pluralize("linked file", total))
+
+	var brokenFileIDs []uint
+	var folder *zapFolder
+
+	for _, batch := range batches {
+		var linkedFiles []LinkResult
+		result := ctx.DB.Raw(QueryGetLinkedFiles(), batch).Scan(&linkedFiles)
+
+		if result.Error != nil {
+			return result.Error
+		}
+
+		var canonicalFileIDs []uint
+
+		for _, file := range linkedFiles {
+			canonicalFileIDs = append(canonicalFileIDs, file.LinkedFileID)
+		}
+
+		canonicalFilePaths, err := ctx.getFilePaths(canonicalFileIDs)
+
+		if err != nil {
+			return err
+		}
+
+		for _, file := range linkedFiles {
+			// The ZAP folder is only opened when needed, as it may be encrypted
+			if folder == nil && *file.LinkType == LinkTypeSymlink {
+				folder, err = ctx.openZapFolder(ctx.Config.ZapDataPath)
+
+				if err != nil {
+					return err
+				}
+			}
+
+			if !ctx.isLinkIntact(folder, file, canonicalFilePaths[file.LinkedFileID]) {
+				log.Printf("Link is broken: \"%s\"", file.AbsolutePath)
+				brokenFileIDs = append(brokenFileIDs, file.FileID)
+			}
 		}
 	}
 
-	return notFoundHashes, nil
+	if len(brokenFileIDs) == 0 {
+		return nil
+	}
+
+	utils.ConsoleAndLogPrintf("Updating DB with %s", utils.Pluralize("broken link", int64(len(brokenFileIDs))))
+
+	return ctx.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.File{}).Where("id IN ?", brokenFileIDs).Updates(map[string]interface{}{
+			"link_type":      nil,
+			"linked_file_id": nil,
+		})
+
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if result.RowsAffected != int64(len(brokenFileIDs)) {
+			return errors.New("unable to update links")
+		}
+
+		return nil
+	})
+}
+
+func (ctx *Context) isLinkIntact(folder *zapFolder, file LinkResult, canonicalFilePath string) bool {
+	filePath := file.AbsolutePath
+
+	switch *file.LinkType {
+	case LinkTypeHardlink:
+		intact, err := isSameFile(filePath, canonicalFilePath)
+		return err == nil && intact
+	case LinkTypeReflink:
+		// Blocks are only shared until either file is written to, so the best we can do is check the contents still match
+		intact, err := CompareFiles(filePath, canonicalFilePath)
+		return err == nil && intact
+	case LinkTypeSymlink:
+		return ctx.isSymlinkIntact(folder, filePath, file.Hash)
+	}
+
+	return false
 }
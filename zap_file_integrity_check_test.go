@@ -5,6 +5,7 @@ package main
 
 import (
 	"data-tools/config"
+	"data-tools/models"
 	"github.com/stretchr/testify/assert"
 	"os"
 	"path"
@@ -37,7 +38,7 @@ func TestZapFileIntegrity(t *testing.T) {
 	err = ctx.HashFiles()
 	assert.NoError(t, err)
 
-	err = ctx.Zap(false)
+	err = ctx.Zap()
 	assert.NoError(t, err)
 
 	folderCount, fileCount := getFolderAndFileTotalCount(t, dataPath)
@@ -68,3 +69,158 @@ func TestZapFileIntegrity(t *testing.T) {
 
 	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes WHERE zapped = 1", 1)
 }
+
+func TestZapScrub(t *testing.T) {
+	tempTestDataPath := createTempTestDataPath(t)
+	defer os.RemoveAll(tempTestDataPath)
+
+	c := &config.Config{
+		DBPath:                      path.Join(tempTestDataPath, "db.db"),
+		BatchSize:                   1,
+		MaxConcurrentFileOperations: 2,
+		ZapDataPath:                 path.Join(tempTestDataPath, "ZAP"),
+	}
+
+	ctx := &Context{
+		Config: c,
+		DB:     initDb(c),
+	}
+
+	err := ctx.Crawl(path.Join(tempTestDataPath, "a"))
+	assert.NoError(t, err)
+
+	err = ctx.HashFiles()
+	assert.NoError(t, err)
+
+	err = ctx.Zap()
+	assert.NoError(t, err)
+
+	zapFileOfSize := func(size int) (uint, string) {
+		var fileHash models.FileHash
+		result := ctx.DB.Where("size = ?", size).First(&fileHash)
+		assert.NoError(t, result.Error)
+
+		return fileHash.ID, path.Join(c.ZapDataPath, FormatRelativeZapFilePathFromHash(DecodeHash(fileHash.Hash)))
+	}
+
+	err = ctx.ZapScrub()
+	assert.NoError(t, err)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes WHERE corrupt = 1", 0)
+
+	// Corrupt a file without changing its size, which only a scrub notices
+	_, corruptedFilePath := zapFileOfSize(6)
+	assert.NoError(t, os.WriteFile(corruptedFilePath, []byte("# Fill"), 0600))
+
+	err = ctx.ZapDBIntegrityTestBySize()
+	assert.NoError(t, err)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes WHERE zapped = 1", 3)
+
+	err = ctx.ZapScrub()
+	assert.NoError(t, err)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes WHERE corrupt = 1 AND size = 6", 1)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes WHERE zapped = 1", 3)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM scrubs WHERE finished_at IS NOT NULL AND corrupt_count = 1", 1)
+
+	// Missing files are no longer ZAP-ped
+	_, missingFilePath := zapFileOfSize(255630)
+	assert.NoError(t, os.Remove(missingFilePath))
+
+	err = ctx.ZapScrub()
+	assert.NoError(t, err)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes WHERE zapped = 1", 2)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes WHERE corrupt = 1", 1)
+
+	// A scrub which was stopped carries on after the last hash it checked
+	assert.NoError(t, os.WriteFile(corruptedFilePath, []byte("# File"), 0600))
+	corruptedFileHashID, _ := zapFileOfSize(6)
+	result := ctx.DB.Create(&models.Scrub{LastFileHashID: corruptedFileHashID})
+	assert.NoError(t, result.Error)
+
+	err = ctx.ZapScrub()
+	assert.NoError(t, err)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes WHERE corrupt = 1", 1)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM scrubs WHERE finished_at IS NULL", 0)
+
+	// Once a good copy is back, the next scrub marks it as intact again
+	err = ctx.ZapScrub()
+	assert.NoError(t, err)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes WHERE corrupt = 1", 0)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM scrubs", 5)
+}
+
+func TestZapShouldKeepDuplicatesOfCorruptHashes(t *testing.T) {
+	tempTestDataPath := createTempTestDataPath(t)
+	defer os.RemoveAll(tempTestDataPath)
+
+	c := &config.Config{
+		DBPath:                      path.Join(tempTestDataPath, "db.db"),
+		BatchSize:                   2,
+		MaxConcurrentFileOperations: 2,
+		ZapDataPath:                 path.Join(tempTestDataPath, "ZAP"),
+	}
+
+	ctx := &Context{
+		Config: c,
+		DB:     initDb(c),
+	}
+
+	dataPath := path.Join(tempTestDataPath, "a")
+
+	err := ctx.Crawl(dataPath)
+	assert.NoError(t, err)
+
+	err = ctx.HashFiles()
+	assert.NoError(t, err)
+
+	err = ctx.Zap()
+	assert.NoError(t, err)
+
+	var corruptHash string
+	result := ctx.DB.Raw("SELECT hash FROM file_hashes WHERE size = 6").Scan(&corruptHash)
+	assert.NoError(t, result.Error)
+	corruptedFilePath := path.Join(c.ZapDataPath, FormatRelativeZapFilePathFromHash(DecodeHash(corruptHash)))
+	assert.NoError(t, os.WriteFile(corruptedFilePath, []byte("# Fill"), 0600))
+
+	err = ctx.ZapScrub()
+	assert.NoError(t, err)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes WHERE corrupt = 1", 1)
+
+	// A good copy turns up after the scrub
+	duplicateFilePath := path.Join(dataPath, "new.md")
+	assert.NoError(t, os.WriteFile(duplicateFilePath, []byte("# File"), 0644))
+
+	err = ctx.ReCrawl(dataPath)
+	assert.NoError(t, err)
+
+	err = ctx.HashFiles()
+	assert.NoError(t, err)
+
+	err = ctx.Zap()
+	assert.NoError(t, err)
+
+	assert.True(t, IsFile(duplicateFilePath))
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM files WHERE zapped = 0 AND deleted_at IS NULL", 1)
+
+	// Only the files which are not corrupt are un-ZAP-ped
+	outputPath := path.Join(tempTestDataPath, "output")
+	err = ctx.UnZap(c.ZapDataPath, outputPath, false)
+	assert.NoError(t, err)
+
+	_, fileCount := getFolderAndFileTotalCount(t, outputPath)
+	assert.Equal(t, 2, fileCount)
+
+	// Once the corrupt copy has been replaced, the duplicate can go
+	contents, err := os.ReadFile(duplicateFilePath)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(corruptedFilePath, contents, 0600))
+
+	err = ctx.ZapScrub()
+	assert.NoError(t, err)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes WHERE corrupt = 1", 0)
+
+	err = ctx.Zap()
+	assert.NoError(t, err)
+
+	assert.False(t, IsFile(duplicateFilePath))
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM files WHERE zapped = 0 AND deleted_at IS NULL", 0)
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"data-tools/models"
+	"data-tools/utils"
+	"errors"
+	"github.com/dustin/go-humanize"
+	"github.com/schollz/progressbar/v3"
+	"gorm.io/gorm"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+const LinkTypeHardlink = "hardlink"
+
+type LinkResult struct {
+	FileID       uint
+	LinkedFileID uint
+	LinkType     *string
+	Hash         string
+	AbsolutePath string
+}
+
+type LinkedFile struct {
+	FileID         uint
+	LinkedFileID   uint
+	ReclaimedBytes uint64
+}
+
+// linkDuplicates keeps the folder structure in place, replacing each duplicate with a link to its canonical copy
+func (ctx *Context) linkDuplicates(linkType string) error {
+	utils.ConsoleAndLogPrintf("Acquiring data...")
+	total, batches, err := ctx.GetBatchesOfIDs(QueryGetDuplicateFileIdsToLink(), "f")
+
+	if err != nil {
+		return err
+	}
+
+	if len(batches) == 0 {
+		utils.ConsoleAndLogPrintf("No duplicate files to link. Have you already hashed?")
+		return nil
+	}
+
+	utils.ConsoleAndLogPrintf("Linking %s in %s", utils.Pluralize("duplicate file", total), utils.Pluralize("batch", int64(len(batches))))
+
+	bar := progressbar.Default(total)
+	linkedFileCount := int64(0)
+	reclaimedBytes := uint64(0)
+
+	for _, batch := range batches {
+		var duplicateFilesToLink []LinkResult
+		result := ctx.DB.Raw(QueryGetDuplicateFilesToLink(), batch).Scan(&duplicateFilesToLink)
+
+		if result.Error != nil {
+			return result.Error
+		}
+
+		var canonicalFileIDs []uint
+
+		for _, file := range duplicateFilesToLink {
+			canonicalFileIDs = append(canonicalFileIDs, file.LinkedFileID)
+		}
+
+		canonicalFilePaths, err := ctx.getFilePaths(canonicalFileIDs)
+
+		if err != nil {
+			return err
+		}
+
+		var linkedFiles []LinkedFile
+		notFoundFileIDs := map[uint]bool{}
+
+		orchestrator := utils.NewTaskOrchestrator(bar, len(duplicateFilesToLink), ctx.Config.MaxConcurrentFileOperations)
+
+		for _, file := range duplicateFilesToLink {
+			orchestrator.StartTask()
+			go ctx.linkDuplicateFile(orchestrator, linkType, file, canonicalFilePaths[file.LinkedFileID], &linkedFiles, notFoundFileIDs)
+		}
+
+		orchestrator.WaitForTasks()
+
+		transactionErr := ctx.DB.Transaction(func(tx *gorm.DB) error {
+			for _, linkedFile := range linkedFiles {
+				fileUpdateResult := tx.Where("id = ?", linkedFile.FileID).Updates(models.File{
+					LinkType:     &linkType,
+					LinkedFileID: &linkedFile.LinkedFileID,
+				})
+
+				if fileUpdateResult.Error != nil {
+					return fileUpdateResult.Error
+				}
+
+				if fileUpdateResult.RowsAffected != 1 {
+					return errors.New("could not link file in db")
+				}
+			}
+
+			var notFoundFileIDsToDelete []uint
+
+			for fileID := range notFoundFileIDs {
+				notFoundFileIDsToDelete = append(notFoundFileIDsToDelete, fileID)
+			}
+
+			return DealWithNotFoundFiles(tx, notFoundFileIDsToDelete)
+		})
+
+		if transactionErr != nil {
+			return transactionErr
+		}
+
+		linkedFileCount += int64(len(linkedFiles))
+
+		for _, linkedFile := range linkedFiles {
+			reclaimedBytes += linkedFile.ReclaimedBytes
+		}
+	}
+
+	utils.ConsoleAndLogPrintf("Linked %s, reclaiming %s", utils.Pluralize("duplicate file", linkedFileCount), humanize.Bytes(reclaimedBytes))
+	return nil
+}
+
+func (ctx *Context) linkDuplicateFile(orchestrator *utils.TaskOrchestrator, linkType string, file LinkResult, canonicalFilePath string, linkedFiles *[]LinkedFile, notFoundFileIDs map[uint]bool) {
+	if len(canonicalFilePath) == 0 {
+		log.Printf("Not linking \"%s\" because the path of its canonical copy could not be resolved", file.AbsolutePath)
+		orchestrator.FinishTask()
+		return
+	}
+
+	// If either file does not exist we can ignore it
+	for fileID, filePath := range map[uint]string{file.FileID: file.AbsolutePath, file.LinkedFileID: canonicalFilePath} {
+		if !IsFile(filePath) {
+			orchestrator.Lock()
+			log.Printf("Ignoring not-found file \"%s\"", filePath)
+			notFoundFileIDs[fileID] = true
+			orchestrator.Unlock()
+
+			orchestrator.FinishTask()
+			return
+		}
+	}
+
+	reclaimedBytes, err := replaceWithLink(linkType, canonicalFilePath, file.AbsolutePath, ctx.Config.VerifyBeforeDelete)
+
+	if isLinkUnsupported(err) {
+		log.Printf("Not linking \"%s\" to \"%s\" because the filesystem does not support it: %v", file.AbsolutePath, canonicalFilePath, err)
+		orchestrator.FinishTask()
+		return
+	}
+
+	if errors.Is(err, ErrFileContentsDiffer) {
+		log.Printf("Not linking \"%s\" to \"%s\" because their contents differ. Have they changed since hashing?", file.AbsolutePath, canonicalFilePath)
+		orchestrator.FinishTask()
+		return
+	}
+
+	if err != nil {
+		log.Fatalf("Could not link file \"%s\" to \"%s\": %v", file.AbsolutePath, canonicalFilePath, err)
+	}
+
+	// The metadata of the duplicate is kept, so that it can be restored as it was when unlinked
+	orchestrator.Lock()
+	*linkedFiles = append(*linkedFiles, LinkedFile{
+		FileID:         file.FileID,
+		LinkedFileID:   file.LinkedFileID,
+		ReclaimedBytes: reclaimedBytes,
+	})
+	orchestrator.Unlock()
+
+	orchestrator.FinishTask()
+}
+
+// replaceWithLink returns the number of bytes reclaimed by linking the duplicate to the canonical file
+func replaceWithLink(linkType, canonicalFilePath, duplicateFilePath string, verifyBeforeLink bool) (uint64, error) {
+	switch linkType {
+	case LinkTypeHardlink:
+		return replaceWithHardlink(canonicalFilePath, duplicateFilePath, verifyBeforeLink)
+	case LinkTypeReflink:
+		return replaceWithReflink(canonicalFilePath, duplicateFilePath)
+	}
+
+	return 0, errors.New("link type not implemented")
+}
+
+// replaceWithHardlink links to the canonical file alongside the duplicate first, then renames over the duplicate so that it is never missing.
+// With verifyBeforeLink, the contents are compared first, as the hashes may be days old.
+func replaceWithHardlink(canonicalFilePath, duplicateFilePath string, verifyBeforeLink bool) (uint64, error) {
+	info, err := os.Stat(duplicateFilePath)
+
+	if err != nil {
+		return 0, err
+	}
+
+	alreadyLinked, err := isSameFile(canonicalFilePath, duplicateFilePath)
+
+	if err != nil {
+		return 0, err
+	}
+
+	// Nothing to do
+	if alreadyLinked {
+		return 0, nil
+	}
+
+	if verifyBeforeLink {
+		isSameContent, err := CompareFiles(canonicalFilePath, duplicateFilePath)
+
+		if err != nil {
+			return 0, err
+		}
+
+		if !isSameContent {
+			return 0, ErrFileContentsDiffer
+		}
+	}
+
+	temporaryFilePath, err := temporaryPathAlongside(duplicateFilePath, ".data-tools-link")
+
+	if err != nil {
+		return 0, err
+	}
+
+	err = os.Link(canonicalFilePath, temporaryFilePath)
+
+	if err != nil {
+		return 0, err
+	}
+
+	err = os.Rename(temporaryFilePath, duplicateFilePath)
+
+	if err != nil {
+		_ = os.Remove(temporaryFilePath)
+		return 0, err
+	}
+
+	return uint64(info.Size()), nil
+}
+
+// temporaryPathAlongside returns an unused path in the same folder as filePath, so that whatever is put there can be
+// renamed over filePath. It is unique so that a leftover from an interrupted run cannot get in the way.
+func temporaryPathAlongside(filePath, suffix string) (string, error) {
+	file, err := os.CreateTemp(filepath.Dir(filePath), filepath.Base(filePath)+".*"+suffix)
+
+	if err != nil {
+		return "", err
+	}
+
+	temporaryFilePath := file.Name()
+	_ = file.Close()
+
+	err = os.Remove(temporaryFilePath)
+
+	if err != nil {
+		return "", err
+	}
+
+	return temporaryFilePath, nil
+}
+
+func isSameFile(left, right string) (bool, error) {
+	leftInfo, err := os.Stat(left)
+
+	if err != nil {
+		return false, err
+	}
+
+	rightInfo, err := os.Stat(right)
+
+	if err != nil {
+		return false, err
+	}
+
+	return os.SameFile(leftInfo, rightInfo), nil
+}
+
+func (ctx *Context) getFilePaths(fileIDs []uint) (map[uint]string, error) {
+	type FilePath struct {
+		FileID       uint
+		AbsolutePath *string
+	}
+
+	var filePaths []FilePath
+	result := ctx.DB.Raw(QueryGetFilePaths(), fileIDs).Scan(&filePaths)
+
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	output := map[uint]string{}
+
+	for _, filePath := range filePaths {
+		// The path could not be resolved
+		if filePath.AbsolutePath == nil {
+			continue
+		}
+
+		output[filePath.FileID] = *filePath.AbsolutePath
+	}
+
+	return output, nil
+}
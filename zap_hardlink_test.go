@@ -0,0 +1,151 @@
+//go:build integration
+// +build integration
+
+package main
+
+import (
+	"data-tools/config"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestZapHardlinkShouldLinkDuplicates(t *testing.T) {
+	tempTestDataPath := createTempTestDataPath(t)
+	defer os.RemoveAll(tempTestDataPath)
+
+	c := &config.Config{
+		DBPath:                      path.Join(tempTestDataPath, "db.db"),
+		BatchSize:                   5,
+		MaxConcurrentFileOperations: 2,
+		ZapDataPath:                 path.Join(tempTestDataPath, "ZAP"),
+		ZapMode:                     LinkTypeHardlink,
+	}
+
+	ctx := &Context{
+		Config: c,
+		DB:     initDb(c),
+	}
+
+	dataPath := path.Join(tempTestDataPath, "a")
+	err := ctx.Crawl(dataPath)
+	assert.NoError(t, err)
+
+	err = ctx.HashFiles()
+	assert.NoError(t, err)
+
+	var inodes []uint64
+	result := ctx.DB.Raw("SELECT inode FROM files ORDER BY id").Scan(&inodes)
+	assert.NoError(t, result.Error)
+
+	err = ctx.Zap()
+	assert.NoError(t, err)
+
+	// Nothing is moved into the ZAP store
+	folderCount, fileCount := getFolderAndFileTotalCount(t, dataPath)
+	assert.Equal(t, 3, folderCount)
+	assert.Equal(t, 5, fileCount)
+	assert.False(t, IsDir(c.ZapDataPath))
+
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM files WHERE link_type = 'hardlink'", 2)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM files WHERE zapped = 1", 0)
+
+	for _, duplicatePath := range []string{path.Join(dataPath, "a", "file.md"), path.Join(dataPath, "b", "j.txt")} {
+		isLinked, err := isSameFile(path.Join(dataPath, "file.md"), duplicatePath)
+		assert.NoError(t, err)
+		assert.True(t, isLinked)
+	}
+
+	// The duplicates keep their own metadata
+	var linkedInodes []uint64
+	result = ctx.DB.Raw("SELECT inode FROM files ORDER BY id").Scan(&linkedInodes)
+	assert.NoError(t, result.Error)
+	assert.Equal(t, inodes, linkedInodes)
+
+	// Linking again should be a no-op
+	err = ctx.Zap()
+	assert.NoError(t, err)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM files WHERE link_type = 'hardlink'", 2)
+
+	// Being linked is not a change
+	err = ctx.ReCrawl(dataPath)
+	assert.NoError(t, err)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM files WHERE file_hash_id IS NULL", 0)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM files WHERE link_type = 'hardlink'", 2)
+
+	// Breaking the link should be picked up by the integrity check
+	duplicateFilePath := path.Join(dataPath, "b", "j.txt")
+	content, err := os.ReadFile(duplicateFilePath)
+	assert.NoError(t, err)
+	assert.NoError(t, os.Remove(duplicateFilePath))
+	assert.NoError(t, os.WriteFile(duplicateFilePath, content, 0644))
+
+	err = ctx.LinkIntegrityTest()
+	assert.NoError(t, err)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM files WHERE link_type IS NOT NULL", 1)
+}
+
+func TestZapHardlinkShouldVerifyBeforeLinking(t *testing.T) {
+	tempTestDataPath := createTempTestDataPath(t)
+	defer os.RemoveAll(tempTestDataPath)
+
+	c := &config.Config{
+		DBPath:                      path.Join(tempTestDataPath, "db.db"),
+		BatchSize:                   5,
+		MaxConcurrentFileOperations: 2,
+		ZapDataPath:                 path.Join(tempTestDataPath, "ZAP"),
+		ZapMode:                     LinkTypeHardlink,
+		VerifyBeforeDelete:          true,
+	}
+
+	ctx := &Context{
+		Config: c,
+		DB:     initDb(c),
+	}
+
+	dataPath := path.Join(tempTestDataPath, "a")
+	err := ctx.Crawl(dataPath)
+	assert.NoError(t, err)
+
+	err = ctx.HashFiles()
+	assert.NoError(t, err)
+
+	// Changed since hashing, without the size changing
+	changedFilePath := path.Join(dataPath, "b", "j.txt")
+	assert.NoError(t, os.WriteFile(changedFilePath, []byte("# Edit"), 0644))
+
+	err = ctx.Zap()
+	assert.NoError(t, err)
+
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM files WHERE link_type = 'hardlink'", 1)
+
+	isLinked, err := isSameFile(path.Join(dataPath, "file.md"), changedFilePath)
+	assert.NoError(t, err)
+	assert.False(t, isLinked)
+
+	content, err := os.ReadFile(changedFilePath)
+	assert.NoError(t, err)
+	assert.Equal(t, "# Edit", string(content))
+}
+
+func TestZapHardlinkShouldNotBeStoppedByTheLeftoversOfAnInterruptedRun(t *testing.T) {
+	tempTestDataPath := createTempTestDataPath(t)
+	defer os.RemoveAll(tempTestDataPath)
+
+	canonicalFilePath := path.Join(tempTestDataPath, "a", "file.md")
+	duplicateFilePath := path.Join(tempTestDataPath, "a", "a", "file.md")
+	assert.NoError(t, os.WriteFile(duplicateFilePath+".data-tools-link", []byte("# Fi"), 0644))
+
+	reclaimedBytes, err := replaceWithHardlink(canonicalFilePath, duplicateFilePath, true)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(6), reclaimedBytes)
+
+	isLinked, err := isSameFile(canonicalFilePath, duplicateFilePath)
+	assert.NoError(t, err)
+	assert.True(t, isLinked)
+
+	// Nothing else is left behind
+	_, fileCount := getFolderAndFileTotalCount(t, path.Join(tempTestDataPath, "a", "a"))
+	assert.Equal(t, 2, fileCount)
+}
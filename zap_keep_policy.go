@@ -0,0 +1,160 @@
+package main
+
+import (
+	"cmp"
+	"data-tools/utils"
+	"gorm.io/gorm"
+	"strings"
+	"time"
+)
+
+type CanonicalFileCandidate struct {
+	FileID       uint
+	FileHashID   uint
+	ModTime      *time.Time
+	AbsolutePath *string
+}
+
+// A keepPolicy returns a negative number if the left file should be kept, a positive number if the right file should be kept or zero if it has no preference
+type keepPolicy func(left, right *CanonicalFileCandidate) int
+
+// selectCanonicalFiles decides which file is kept to represent each hash that has not yet been ZAPped, a batch of
+// hashes at a time, passing file IDs keyed by file hash ID to useBatch
+func (ctx *Context) selectCanonicalFiles(useBatch func(canonicalFiles map[uint]uint) error) error {
+	policies := ctx.getKeepPolicies()
+	total, batches, err := ctx.GetBatchesOfIDs(QueryGetFileHashIdsToSelectCanonicalFile(), "fh")
+
+	if err != nil {
+		return err
+	}
+
+	utils.ConsoleAndLogPrintf("Choosing between the copies of %s in %s", utils.Pluralize("hash", total), utils.Pluralize("batch", int64(len(batches))))
+
+	for _, batch := range batches {
+		var candidates []CanonicalFileCandidate
+		result := ctx.DB.Raw(QueryGetCanonicalFileCandidates(), batch).Scan(&candidates)
+
+		if result.Error != nil {
+			return result.Error
+		}
+
+		canonicalFiles := map[uint]*CanonicalFileCandidate{}
+
+		for index := range candidates {
+			candidate := &candidates[index]
+
+			// The path could not be resolved, so this file will be skipped
+			if candidate.AbsolutePath == nil {
+				continue
+			}
+
+			existing, found := canonicalFiles[candidate.FileHashID]
+
+			if !found || preferFile(policies, candidate, existing) {
+				canonicalFiles[candidate.FileHashID] = candidate
+			}
+		}
+
+		output := map[uint]uint{}
+
+		for fileHashID, candidate := range canonicalFiles {
+			output[fileHashID] = candidate.FileID
+		}
+
+		err = useBatch(output)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// recordCanonicalFiles records the canonical copy of a batch of hashes
+func (ctx *Context) recordCanonicalFiles(canonicalFiles map[uint]uint) error {
+	return ctx.DB.Transaction(func(tx *gorm.DB) error {
+		return updateFileHashesByID(tx, "canonical_file_id", canonicalFiles)
+	})
+}
+
+// preferFile returns true if the candidate should be kept instead of the existing file. Ties keep the first file crawled.
+func preferFile(policies []keepPolicy, candidate, existing *CanonicalFileCandidate) bool {
+	for _, policy := range policies {
+		preference := policy(candidate, existing)
+
+		if preference != 0 {
+			return preference < 0
+		}
+	}
+
+	return candidate.FileID < existing.FileID
+}
+
+func (ctx *Context) getKeepPolicies() []keepPolicy {
+	var policies []keepPolicy
+
+	for _, policyName := range ctx.Config.ZapKeepPolicies {
+		switch policyName {
+		case "oldest":
+			policies = append(policies, keepOldest)
+		case "shortest_path":
+			policies = append(policies, keepShortestPath)
+		case "preferred_root":
+			policies = append(policies, ctx.keepPreferredRoot)
+		case "path_pattern":
+			policies = append(policies, ctx.keepPreferredPathPattern)
+		}
+	}
+
+	return policies
+}
+
+func keepOldest(left, right *CanonicalFileCandidate) int {
+	if left.ModTime == nil || right.ModTime == nil {
+		// Prefer the file we know about
+		return cmp.Compare(rankNil(left.ModTime == nil), rankNil(right.ModTime == nil))
+	}
+
+	return left.ModTime.Compare(*right.ModTime)
+}
+
+func keepShortestPath(left, right *CanonicalFileCandidate) int {
+	return cmp.Compare(len(*left.AbsolutePath), len(*right.AbsolutePath))
+}
+
+func (ctx *Context) keepPreferredRoot(left, right *CanonicalFileCandidate) int {
+	rank := func(absolutePath string) int {
+		for index, rootPath := range ctx.Config.ZapPreferredRoots {
+			if strings.HasPrefix(absolutePath, strings.TrimSuffix(rootPath, "/")+"/") {
+				return index
+			}
+		}
+
+		return len(ctx.Config.ZapPreferredRoots)
+	}
+
+	return cmp.Compare(rank(*left.AbsolutePath), rank(*right.AbsolutePath))
+}
+
+func (ctx *Context) keepPreferredPathPattern(left, right *CanonicalFileCandidate) int {
+	rank := func(absolutePath string) int {
+		for index, pattern := range ctx.Config.ZapPreferredPathPatterns {
+			if pattern.MatchString(absolutePath) {
+				return index
+			}
+		}
+
+		return len(ctx.Config.ZapPreferredPathPatterns)
+	}
+
+	return cmp.Compare(rank(*left.AbsolutePath), rank(*right.AbsolutePath))
+}
+
+func rankNil(isNil bool) int {
+	if isNil {
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"data-tools/config"
+	"github.com/stretchr/testify/assert"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func newCanonicalFileCandidate(fileID uint, absolutePath string, modTime time.Time) *CanonicalFileCandidate {
+	return &CanonicalFileCandidate{
+		FileID:       fileID,
+		FileHashID:   1,
+		ModTime:      &modTime,
+		AbsolutePath: &absolutePath,
+	}
+}
+
+func TestKeepPolicies(t *testing.T) {
+	older := newCanonicalFileCandidate(2, "/backup/photos/2001/a.jpg", time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC))
+	newer := newCanonicalFileCandidate(1, "/photos/a.jpg", time.Date(2002, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	ctx := &Context{
+		Config: &config.Config{},
+	}
+
+	// By default the first file crawled is kept
+	assert.True(t, preferFile(ctx.getKeepPolicies(), newer, older))
+	assert.False(t, preferFile(ctx.getKeepPolicies(), older, newer))
+
+	ctx.Config.ZapKeepPolicies = []string{"oldest"}
+	assert.True(t, preferFile(ctx.getKeepPolicies(), older, newer))
+
+	ctx.Config.ZapKeepPolicies = []string{"shortest_path", "oldest"}
+	assert.True(t, preferFile(ctx.getKeepPolicies(), newer, older))
+
+	ctx.Config.ZapKeepPolicies = []string{"preferred_root", "shortest_path"}
+	ctx.Config.ZapPreferredRoots = []string{"/backup/"}
+	assert.True(t, preferFile(ctx.getKeepPolicies(), older, newer))
+
+	ctx.Config.ZapKeepPolicies = []string{"path_pattern", "preferred_root"}
+	ctx.Config.ZapPreferredPathPatterns = []*regexp.Regexp{regexp.MustCompile(`^/photos/`)}
+	assert.True(t, preferFile(ctx.getKeepPolicies(), newer, older))
+
+	// Files without a modification time are not preferred
+	older.ModTime = nil
+	ctx.Config.ZapKeepPolicies = []string{"oldest"}
+	assert.True(t, preferFile(ctx.getKeepPolicies(), newer, older))
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"data-tools/blobstore"
+	"data-tools/utils"
+	"errors"
+	"fmt"
+	"github.com/schollz/progressbar/v3"
+	"log"
+)
+
+var errStopListing = errors.New("stop listing")
+
+// zapLayout is the layout new ZAP folders are given
+func (ctx *Context) zapLayout() blobstore.Layout {
+	layout := blobstore.DefaultLayout
+
+	if ctx.Config.ZapLayoutDepth != 0 {
+		layout.Depth = int(ctx.Config.ZapLayoutDepth)
+	}
+
+	if ctx.Config.ZapLayoutWidth != 0 {
+		layout.Width = int(ctx.Config.ZapLayoutWidth)
+	}
+
+	return layout
+}
+
+// recordZapLayout records the layout of a ZAP folder the first time anything is ZAP-ped to it. Empty folders are given
+// the configured layout, and folders from before layouts were recorded keep the default one.
+func (ctx *Context) recordZapLayout(folder *zapFolder) error {
+	manifest, err := blobstore.ReadManifest(folder.blobs)
+
+	if err != nil {
+		return err
+	}
+
+	if manifest == nil {
+		isEmpty, err := isBlobStoreEmpty(folder.blobs)
+
+		if err != nil {
+			return err
+		}
+
+		manifest = blobstore.NewManifest(blobstore.DefaultLayout)
+
+		if isEmpty {
+			manifest.Layout = ctx.zapLayout()
+		}
+
+		err = blobstore.WriteManifest(folder.blobs, manifest)
+
+		if err != nil {
+			return err
+		}
+
+		folder.blobs = folder.blobs.WithLayout(manifest.Layout)
+	}
+
+	if manifest.Layout != ctx.zapLayout() {
+		utils.ConsoleAndLogPrintf("The layout of the ZAP folder is %s rather than the configured %s. Run relayout to change it.", manifest.Layout, ctx.zapLayout())
+	}
+
+	return nil
+}
+
+func isBlobStoreEmpty(blobs blobstore.BlobStore) (bool, error) {
+	err := blobs.List(func(name string, size int64) error {
+		return errStopListing
+	})
+
+	if errors.Is(err, errStopListing) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// Relayout moves the files in the ZAP folder into the configured layout, pointing the symlinks created by the symlink
+// ZAP mode at where their files have moved to. The manifest records the layout being moved
+// to until every file has been moved, so that nothing else uses the folder in the meantime, and so that an interrupted
+// relayout can be finished by running it again.
+func (ctx *Context) Relayout() error {
+	blobs, err := ctx.newBlobStore(ctx.Config.ZapDataPath)
+
+	if err != nil {
+		return err
+	}
+
+	manifest, err := blobstore.ReadManifest(blobs)
+
+	if err != nil {
+		return err
+	}
+
+	if manifest == nil {
+		manifest = blobstore.NewManifest(blobstore.DefaultLayout)
+	}
+
+	layout := ctx.zapLayout()
+
+	if manifest.RelayoutTo != nil {
+		layout = *manifest.RelayoutTo
+
+		if layout != ctx.zapLayout() {
+			utils.ConsoleAndLogPrintf("Finishing moving the ZAP folder to the layout %s. Run relayout again afterwards to move it to the configured layout.", layout)
+		}
+	}
+
+	if manifest.Layout == layout {
+		utils.ConsoleAndLogPrintf("The ZAP folder already has the layout %s", layout)
+		return nil
+	}
+
+	manifest.RelayoutTo = &layout
+	err = blobstore.WriteManifest(blobs, manifest)
+
+	if err != nil {
+		return err
+	}
+
+	source := blobs.WithLayout(manifest.Layout)
+	destination := blobs.WithLayout(layout)
+
+	utils.ConsoleAndLogPrintf("Acquiring data...")
+	var names []string
+
+	err = source.List(func(name string, size int64) error {
+		names = append(names, name)
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	utils.ConsoleAndLogPrintf("Moving %s from the layout %s to %s", utils.Pluralize("file", int64(len(names))), manifest.Layout, layout)
+
+	bar := progressbar.Default(int64(len(names)))
+	orchestrator := utils.NewTaskOrchestrator(bar, len(names), ctx.Config.MaxConcurrentFileOperations)
+	failedCount := 0
+
+	for _, name := range names {
+		orchestrator.StartTask()
+		go relayoutFile(orchestrator, source, destination, name, &failedCount)
+	}
+
+	orchestrator.WaitForTasks()
+
+	if failedCount > 0 {
+		return fmt.Errorf("%s could not be moved, run relayout again to retry", utils.Pluralize("file", int64(failedCount)))
+	}
+
+	// Before the layout is recorded, so that running relayout again after a failure finishes pointing them
+	err = ctx.relinkSymlinks(&zapFolder{blobs: destination})
+
+	if err != nil {
+		return err
+	}
+
+	return blobstore.WriteManifest(blobs, blobstore.NewManifest(layout))
+}
+
+func relayoutFile(orchestrator *utils.TaskOrchestrator, source, destination blobstore.BlobStore, name string, failedCount *int) {
+	err := moveBlob(source, destination, name)
+
+	if err != nil {
+		log.Printf("Error moving file \"%s\" to \"%s\": %s\n", source.Location(name), destination.Location(name), err)
+
+		orchestrator.Lock()
+		*failedCount++
+		orchestrator.Unlock()
+	}
+
+	orchestrator.FinishTask()
+}
@@ -0,0 +1,230 @@
+//go:build integration
+// +build integration
+
+package main
+
+import (
+	"data-tools/blobstore"
+	"data-tools/config"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path"
+	"testing"
+)
+
+func hexFileNamesOfZappedHashes(t *testing.T, ctx *Context) []string {
+	var hashes []string
+	result := ctx.DB.Raw("SELECT hash FROM file_hashes WHERE zapped = 1").Scan(&hashes)
+	assert.NoError(t, result.Error)
+
+	var hexFileNames []string
+
+	for _, hash := range hashes {
+		hexFileNames = append(hexFileNames, DecodeHash(hash))
+	}
+
+	return hexFileNames
+}
+
+func TestZapShouldUseTheConfiguredLayout(t *testing.T) {
+	tempTestDataPath := createTempTestDataPath(t)
+	defer os.RemoveAll(tempTestDataPath)
+
+	c := &config.Config{
+		DBPath:                      path.Join(tempTestDataPath, "db.db"),
+		BatchSize:                   2,
+		MaxConcurrentFileOperations: 2,
+		ZapDataPath:                 path.Join(tempTestDataPath, "ZAP"),
+		VerifyBeforeDelete:          true,
+		ZapLayoutDepth:              1,
+		ZapLayoutWidth:              3,
+	}
+
+	ctx := &Context{
+		Config: c,
+		DB:     initDb(c),
+	}
+
+	dataPath := path.Join(tempTestDataPath, "a")
+
+	err := ctx.Crawl(dataPath)
+	assert.NoError(t, err)
+
+	err = ctx.HashFiles()
+	assert.NoError(t, err)
+
+	err = ctx.Zap()
+	assert.NoError(t, err)
+
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes WHERE zapped = 1", 3)
+
+	layout := blobstore.Layout{Depth: 1, Width: 3}
+	hexFileNames := hexFileNamesOfZappedHashes(t, ctx)
+
+	for _, hexFileName := range hexFileNames {
+		assert.True(t, IsFile(path.Join(c.ZapDataPath, layout.RelativePath(hexFileName))))
+		assert.False(t, IsFile(path.Join(c.ZapDataPath, FormatRelativeZapFilePathFromHash(hexFileName))))
+	}
+
+	// Only the buckets which are used are created
+	folderCount, fileCount := getFolderAndFileTotalCount(t, c.ZapDataPath)
+	assert.Equal(t, 3, folderCount)
+	assert.Equal(t, 4, fileCount) // The files and layout.json
+
+	manifest, err := blobstore.ReadManifest(blobstore.NewLocal(c.ZapDataPath))
+	assert.NoError(t, err)
+	assert.Equal(t, layout, manifest.Layout)
+
+	err = ctx.ZapDBIntegrityTestBySize()
+	assert.NoError(t, err)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes WHERE zapped = 1", 3)
+
+	// Changing the configuration does not change the layout of an existing ZAP folder until it is relaid out
+	c.ZapLayoutDepth = 0
+	c.ZapLayoutWidth = 0
+
+	err = ctx.ZapDBIntegrityTestBySize()
+	assert.NoError(t, err)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes WHERE zapped = 1", 3)
+
+	err = ctx.Relayout()
+	assert.NoError(t, err)
+
+	for _, hexFileName := range hexFileNames {
+		assert.False(t, IsFile(path.Join(c.ZapDataPath, layout.RelativePath(hexFileName))))
+		assert.True(t, IsFile(path.Join(c.ZapDataPath, FormatRelativeZapFilePathFromHash(hexFileName))))
+	}
+
+	manifest, err = blobstore.ReadManifest(blobstore.NewLocal(c.ZapDataPath))
+	assert.NoError(t, err)
+	assert.Equal(t, blobstore.DefaultLayout, manifest.Layout)
+	assert.Nil(t, manifest.RelayoutTo)
+
+	err = ctx.ZapDBIntegrityTestBySize()
+	assert.NoError(t, err)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes WHERE zapped = 1", 3)
+
+	outputPath := path.Join(tempTestDataPath, "output")
+	err = ctx.UnZap(c.ZapDataPath, outputPath, false)
+	assert.NoError(t, err)
+
+	_, fileCount = getFolderAndFileTotalCount(t, outputPath)
+	assert.Equal(t, 5, fileCount)
+}
+
+func TestZapShouldKeepTheDefaultLayoutOfExistingZapFolders(t *testing.T) {
+	tempTestDataPath := createTempTestDataPath(t)
+	defer os.RemoveAll(tempTestDataPath)
+
+	c := &config.Config{
+		DBPath:                      path.Join(tempTestDataPath, "db.db"),
+		BatchSize:                   2,
+		MaxConcurrentFileOperations: 2,
+		ZapDataPath:                 path.Join(tempTestDataPath, "ZAP"),
+		VerifyBeforeDelete:          true,
+		ZapLayoutDepth:              1,
+		ZapLayoutWidth:              3,
+	}
+
+	ctx := &Context{
+		Config: c,
+		DB:     initDb(c),
+	}
+
+	// A ZAP folder from before layouts were recorded
+	existingHexFileName := "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	existingPath := path.Join(c.ZapDataPath, FormatRelativeZapFilePathFromHash(existingHexFileName))
+	assert.NoError(t, os.MkdirAll(path.Dir(existingPath), 0700))
+	assert.NoError(t, os.WriteFile(existingPath, []byte("existing"), 0600))
+
+	err := ctx.Crawl(path.Join(tempTestDataPath, "a"))
+	assert.NoError(t, err)
+
+	err = ctx.HashFiles()
+	assert.NoError(t, err)
+
+	err = ctx.Zap()
+	assert.NoError(t, err)
+
+	for _, hexFileName := range hexFileNamesOfZappedHashes(t, ctx) {
+		assert.True(t, IsFile(path.Join(c.ZapDataPath, FormatRelativeZapFilePathFromHash(hexFileName))))
+	}
+
+	manifest, err := blobstore.ReadManifest(blobstore.NewLocal(c.ZapDataPath))
+	assert.NoError(t, err)
+	assert.Equal(t, blobstore.DefaultLayout, manifest.Layout)
+
+	// An unfinished relayout stops the ZAP folder being used
+	target := blobstore.Layout{Depth: 1, Width: 3}
+	manifest.RelayoutTo = &target
+	assert.NoError(t, blobstore.WriteManifest(blobstore.NewLocal(c.ZapDataPath), manifest))
+
+	_, err = ctx.openZapFolder(c.ZapDataPath)
+	assert.True(t, errors.Is(err, ErrZapRelayoutUnfinished))
+
+	err = ctx.Relayout()
+	assert.NoError(t, err)
+
+	assert.True(t, IsFile(path.Join(c.ZapDataPath, target.RelativePath(existingHexFileName))))
+
+	_, err = ctx.openZapFolder(c.ZapDataPath)
+	assert.NoError(t, err)
+}
+
+func TestRelayoutShouldPointSymlinksAtTheNewLayout(t *testing.T) {
+	tempTestDataPath := createTempTestDataPath(t)
+	defer os.RemoveAll(tempTestDataPath)
+
+	c := &config.Config{
+		DBPath:                      path.Join(tempTestDataPath, "db.db"),
+		BatchSize:                   2,
+		MaxConcurrentFileOperations: 2,
+		ZapDataPath:                 path.Join(tempTestDataPath, "ZAP"),
+		ZapMode:                     LinkTypeSymlink,
+	}
+
+	ctx := &Context{
+		Config: c,
+		DB:     initDb(c),
+	}
+
+	dataPath := path.Join(tempTestDataPath, "a")
+	symlinkPath := path.Join(dataPath, "b", "j.txt")
+	originalContent, err := os.ReadFile(symlinkPath)
+	assert.NoError(t, err)
+
+	err = ctx.Crawl(dataPath)
+	assert.NoError(t, err)
+
+	err = ctx.HashFiles()
+	assert.NoError(t, err)
+
+	err = ctx.Zap()
+	assert.NoError(t, err)
+
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM files WHERE link_type = 'symlink'", 5)
+
+	c.ZapLayoutDepth = 1
+	c.ZapLayoutWidth = 3
+
+	err = ctx.Relayout()
+	assert.NoError(t, err)
+
+	layout := blobstore.Layout{Depth: 1, Width: 3}
+	var hash string
+	result := ctx.DB.Raw("SELECT hash FROM file_hashes WHERE size = 6").Scan(&hash)
+	assert.NoError(t, result.Error)
+
+	target, err := os.Readlink(symlinkPath)
+	assert.NoError(t, err)
+	assert.Equal(t, path.Join(c.ZapDataPath, layout.RelativePath(DecodeHash(hash))), target)
+
+	content, err := os.ReadFile(symlinkPath)
+	assert.NoError(t, err)
+	assert.Equal(t, originalContent, content)
+
+	err = ctx.LinkIntegrityTest()
+	assert.NoError(t, err)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM files WHERE link_type = 'symlink'", 5)
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"data-tools/crypto"
+	"data-tools/models"
+	"data-tools/utils"
+	"errors"
+	"github.com/btcsuite/btcd/btcutil/base58"
+	"github.com/dustin/go-humanize"
+	"gorm.io/gorm"
+	"hash"
+	"io"
+	"log"
+	"sort"
+	"strings"
+)
+
+// ZapOrphans lists the files in the ZAP folder which no ZAP-ped hash in the DB refers to, such as those left behind by
+// a crash before the DB was updated or moved in by merge_zaps, along with the stray files in its bucket directories
+// which are not named by a hash. With adopt, orphans whose contents match their names are recorded in the DB as
+// ZAP-ped. With gc, the orphans which are left are moved into quarantine. Stray files are only listed.
+func (ctx *Context) ZapOrphans(adopt, gc bool) error {
+	folder, err := ctx.openZapFolder(ctx.Config.ZapDataPath)
+
+	if err != nil {
+		return err
+	}
+
+	utils.ConsoleAndLogPrintf("Acquiring data...")
+	blobSizes := map[string]int64{}
+
+	err = folder.blobs.List(func(name string, size int64) error {
+		blobSizes[name] = size
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	referenced, err := ctx.getReferencedBlobNames(folder, blobSizes)
+
+	if err != nil {
+		return err
+	}
+
+	var orphans []string
+
+	for name := range blobSizes {
+		if !referenced[name] {
+			orphans = append(orphans, name)
+		}
+	}
+
+	// Chunk manifests come first, so that the chunks of any which are adopted are no longer orphans
+	sort.Slice(orphans, func(i, j int) bool {
+		isManifest := strings.HasSuffix(orphans[i], chunkManifestSuffix)
+
+		if isManifest != strings.HasSuffix(orphans[j], chunkManifestSuffix) {
+			return isManifest
+		}
+
+		return orphans[i] < orphans[j]
+	})
+
+	orphanBytes := uint64(0)
+
+	for _, name := range orphans {
+		orphanBytes += uint64(blobSizes[name])
+		utils.ConsoleAndLogPrintf("Orphan: \"%s\" (%s)", folder.blobs.Location(name), humanize.Bytes(uint64(blobSizes[name])))
+	}
+
+	utils.ConsoleAndLogPrintf("%s (%s) in the ZAP folder not in the DB", utils.Pluralize("orphan", int64(len(orphans))), humanize.Bytes(orphanBytes))
+
+	strayCount := int64(0)
+
+	err = folder.blobs.ListStrays(func(relativePath string, size int64) error {
+		strayCount++
+		utils.ConsoleAndLogPrintf("Stray file: \"%s\" (%s)", relativePath, humanize.Bytes(uint64(size)))
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if strayCount > 0 {
+		utils.ConsoleAndLogPrintf("%s in the bucket directories of the ZAP folder which are not named by a hash", utils.Pluralize("stray file", strayCount))
+	}
+
+	// The chunks of orphaned chunk manifests are only adopted or moved into quarantine along with those manifests
+	chunkReferrers := map[string][]string{}
+	hasChunkManifests := false
+
+	for name := range blobSizes {
+		if strings.HasSuffix(name, chunkManifestSuffix) {
+			hasChunkManifests = true
+		}
+	}
+
+	for _, name := range orphans {
+		if !strings.HasSuffix(name, chunkManifestSuffix) {
+			continue
+		}
+
+		chunks, err := folder.readChunkManifestBlob(name)
+
+		if err != nil {
+			log.Printf("Could not read chunk manifest \"%s\": %v", folder.blobs.Location(name), err)
+			continue
+		}
+
+		for _, chunk := range chunks {
+			chunkName := folder.blobName(chunk.hash, "")
+			chunkReferrers[chunkName] = append(chunkReferrers[chunkName], name)
+		}
+	}
+
+	// Chunks are named by their hash just as files stored whole are, so a chunk which no manifest refers to, such as
+	// one stored before a crash, cannot be told apart from a file
+	mayHaveChunks := hasChunkManifests || ctx.Config.ZapChunking
+
+	if adopt {
+		adoptedCount := int64(0)
+
+		for _, name := range orphans {
+			// Such as a chunk of a file which has been adopted
+			if referenced[name] || len(chunkReferrers[name]) > 0 {
+				continue
+			}
+
+			adopted, chunkNames, err := ctx.adoptOrphan(folder, name, blobSizes[name], mayHaveChunks)
+
+			if err != nil {
+				return err
+			}
+
+			if adopted {
+				adoptedCount++
+				referenced[name] = true
+
+				for _, chunkName := range chunkNames {
+					referenced[chunkName] = true
+				}
+			}
+		}
+
+		utils.ConsoleAndLogPrintf("Adopted %s", utils.Pluralize("orphan", adoptedCount))
+	}
+
+	if gc {
+		quarantinedCount := int64(0)
+		quarantinedBytes := uint64(0)
+		quarantined := map[string]bool{}
+
+		for _, name := range orphans {
+			if referenced[name] || isReferredToByRemainingManifest(chunkReferrers[name], quarantined) {
+				continue
+			}
+
+			quarantinedFile, err := ctx.quarantineBlob(folder.blobs, name)
+
+			if err != nil {
+				return err
+			}
+
+			// Recorded one at a time, so that nothing in quarantine is left out of the DB if a later move fails
+			result := ctx.DB.Create(quarantinedFile)
+
+			if result.Error != nil {
+				return result.Error
+			}
+
+			quarantined[name] = true
+			quarantinedCount++
+			quarantinedBytes += uint64(*quarantinedFile.Size)
+		}
+
+		utils.ConsoleAndLogPrintf("Moved %s (%s) into quarantine", utils.Pluralize("orphan", quarantinedCount), humanize.Bytes(quarantinedBytes))
+	}
+
+	return nil
+}
+
+// isReferredToByRemainingManifest is true if any of the orphaned manifests which refer to a chunk were not moved into
+// quarantine. Manifests come first, so they have all been dealt with by the time their chunks are.
+func isReferredToByRemainingManifest(manifestNames []string, quarantined map[string]bool) bool {
+	for _, manifestName := range manifestNames {
+		if !quarantined[manifestName] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getReferencedBlobNames returns the names of every file in the ZAP folder which a ZAP-ped hash refers to, in whichever
+// form it is stored, along with the chunks of those stored in chunks
+func (ctx *Context) getReferencedBlobNames(folder *zapFolder, blobSizes map[string]int64) (map[string]bool, error) {
+	var hashes []string
+	result := ctx.DB.Model(&models.FileHash{}).Where("zapped = 1").Order("id").Pluck("hash", &hashes)
+
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	referenced := map[string]bool{}
+
+	for _, zappedHash := range hashes {
+		hexFileName := DecodeHash(zappedHash)
+
+		for _, suffix := range []string{"", compressedSuffix, chunkManifestSuffix} {
+			referenced[folder.blobName(hexFileName, suffix)] = true
+		}
+
+		manifestName := folder.blobName(hexFileName, chunkManifestSuffix)
+
+		if _, isStored := blobSizes[manifestName]; !isStored {
+			continue
+		}
+
+		chunks, err := folder.readChunkManifestBlob(manifestName)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, chunk := range chunks {
+			referenced[folder.blobName(chunk.hash, "")] = true
+		}
+	}
+
+	return referenced, nil
+}
+
+// adoptOrphan records a file from the ZAP folder in the DB as ZAP-ped if its contents match its name, whichever
+// algorithm it was hashed with. The names of its chunks are returned when it is stored in chunks. When the ZAP folder
+// may have chunks, a file stored whole is only adopted if its hash is already in the DB, as it may be a chunk.
+func (ctx *Context) adoptOrphan(folder *zapFolder, name string, blobSize int64, mayHaveChunks bool) (bool, []string, error) {
+	location := folder.blobs.Location(name)
+	suffix := ""
+
+	for _, storedSuffix := range []string{compressedSuffix, chunkManifestSuffix} {
+		if strings.HasSuffix(name, storedSuffix) {
+			suffix = storedSuffix
+		}
+	}
+
+	reader, chunkNames, err := folder.openOrphan(name, suffix)
+
+	if err != nil {
+		log.Printf("Not adopting \"%s\" because it could not be read: %v", location, err)
+		return false, nil, nil
+	}
+
+	defer reader.Close()
+
+	digests := map[string]hash.Hash{}
+	var writers []io.Writer
+
+	for _, algorithm := range crypto.Algorithms {
+		hasher, err := crypto.NewHasher(algorithm)
+
+		if err != nil {
+			return false, nil, err
+		}
+
+		digests[algorithm] = hasher.New()
+		writers = append(writers, digests[algorithm])
+	}
+
+	size, err := io.Copy(io.MultiWriter(writers...), reader)
+
+	if err != nil {
+		log.Printf("Not adopting \"%s\" because it could not be read: %v", location, err)
+		return false, nil, nil
+	}
+
+	for _, algorithm := range crypto.Algorithms {
+		fileHash := base58.Encode(digests[algorithm].Sum(nil))
+
+		if folder.blobName(DecodeHash(fileHash), suffix) != name {
+			continue
+		}
+
+		if suffix == "" && mayHaveChunks {
+			var existingCount int64
+			result := ctx.DB.Model(&models.FileHash{}).Where("hash = ? AND algorithm = ?", fileHash, algorithm).Count(&existingCount)
+
+			if result.Error != nil {
+				return false, nil, result.Error
+			}
+
+			if existingCount == 0 {
+				log.Printf("Not adopting \"%s\" because it may be a chunk of a file stored in chunks", location)
+				return false, nil, nil
+			}
+		}
+
+		// The size of files stored in chunks is recorded when ZAP-ping as the bytes of new chunks, which is not known here
+		var storedSize *uint
+
+		if suffix != chunkManifestSuffix {
+			plaintextSize := blobSize
+
+			if folder.key != nil {
+				plaintextSize, err = crypto.PlaintextSize(blobSize)
+
+				if err != nil {
+					return false, nil, err
+				}
+			}
+
+			storedSizeAsUint := uint(plaintextSize)
+			storedSize = &storedSizeAsUint
+		}
+
+		err = ctx.recordAdoptedHash(fileHash, algorithm, uint(size), storedSize)
+
+		if err != nil {
+			return false, nil, err
+		}
+
+		log.Printf("Adopted \"%s\" as hash %s", location, fileHash)
+		return true, chunkNames, nil
+	}
+
+	log.Printf("Not adopting \"%s\" because its contents do not match its name", location)
+	return false, nil, nil
+}
+
+// openOrphan opens a file in the ZAP folder by its name in the blob store, as openFile does by hash
+func (f *zapFolder) openOrphan(name, suffix string) (io.ReadCloser, []string, error) {
+	switch suffix {
+	case compressedSuffix:
+		reader, err := f.openBlob(name)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		decompressed, err := newCompressedReader(reader)
+		return decompressed, nil, err
+	case chunkManifestSuffix:
+		chunks, err := f.readChunkManifestBlob(name)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var chunkNames []string
+
+		for _, chunk := range chunks {
+			chunkNames = append(chunkNames, f.blobName(chunk.hash, ""))
+		}
+
+		return &chunkReader{folder: f, chunks: chunks}, chunkNames, nil
+	}
+
+	reader, err := f.openBlob(name)
+	return reader, nil, err
+}
+
+// recordAdoptedHash marks a hash as ZAP-ped, adding it if need be, such as when it came from another catalog
+func (ctx *Context) recordAdoptedHash(fileHash, algorithm string, size uint, storedSize *uint) error {
+	return ctx.DB.Transaction(func(tx *gorm.DB) error {
+		var existingFileHash models.FileHash
+		result := tx.Where("hash = ? AND algorithm = ?", fileHash, algorithm).First(&existingFileHash)
+
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return tx.Create(&models.FileHash{
+				Hash:       fileHash,
+				Algorithm:  algorithm,
+				Size:       &size,
+				Zapped:     true,
+				StoredSize: storedSize,
+			}).Error
+		}
+
+		if result.Error != nil {
+			return result.Error
+		}
+
+		return tx.Model(&existingFileHash).Updates(map[string]interface{}{
+			"zapped":      true,
+			"stored_size": storedSize,
+		}).Error
+	})
+}
@@ -0,0 +1,186 @@
+//go:build integration
+// +build integration
+
+package main
+
+import (
+	"data-tools/config"
+	"data-tools/models"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestZapOrphans(t *testing.T) {
+	tempTestDataPath := createTempTestDataPath(t)
+	defer os.RemoveAll(tempTestDataPath)
+
+	c := &config.Config{
+		DBPath:                      path.Join(tempTestDataPath, "db.db"),
+		BatchSize:                   2,
+		MaxConcurrentFileOperations: 2,
+		ZapDataPath:                 path.Join(tempTestDataPath, "ZAP"),
+		QuarantinePath:              path.Join(tempTestDataPath, "quarantine"),
+		QuarantineRetentionDays:     30,
+	}
+
+	ctx := &Context{
+		Config: c,
+		DB:     initDb(c),
+	}
+
+	err := ctx.Crawl(path.Join(tempTestDataPath, "a"))
+	assert.NoError(t, err)
+
+	err = ctx.HashFiles()
+	assert.NoError(t, err)
+
+	err = ctx.Zap()
+	assert.NoError(t, err)
+
+	// As if the ZAP had crashed before the DB was updated
+	result := ctx.DB.Exec("UPDATE file_hashes SET zapped = 0 WHERE size = 6")
+	assert.NoError(t, result.Error)
+
+	// From another catalog, such as by merge_zaps
+	hasher, err := ctx.getHasher()
+	assert.NoError(t, err)
+	otherContents := []byte("From another catalog")
+	otherHash := hasher.HashBytes(otherContents)
+	otherPath := path.Join(c.ZapDataPath, FormatRelativeZapFilePathFromHash(DecodeHash(otherHash)))
+	assert.NoError(t, os.MkdirAll(path.Dir(otherPath), 0700))
+	assert.NoError(t, os.WriteFile(otherPath, otherContents, 0600))
+
+	// Named by a hash, but not of its contents
+	mismatchedPath := path.Join(c.ZapDataPath, FormatRelativeZapFilePathFromHash(strings.Repeat("ab", 64)))
+	assert.NoError(t, os.MkdirAll(path.Dir(mismatchedPath), 0700))
+	assert.NoError(t, os.WriteFile(mismatchedPath, []byte("Not its hash"), 0600))
+
+	// Stray files
+	strayPaths := []string{path.Join(path.Dir(mismatchedPath), ".data-tools-123"), path.Join(path.Dir(mismatchedPath), "notes.txt")}
+
+	for _, strayPath := range strayPaths {
+		assert.NoError(t, os.WriteFile(strayPath, []byte("Stray"), 0600))
+	}
+
+	_, fileCount := getFolderAndFileTotalCount(t, c.ZapDataPath)
+
+	// Only listing changes nothing
+	err = ctx.ZapOrphans(false, false)
+	assert.NoError(t, err)
+
+	_, afterFileCount := getFolderAndFileTotalCount(t, c.ZapDataPath)
+	assert.Equal(t, fileCount, afterFileCount)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes WHERE zapped = 1", 2)
+
+	err = ctx.ZapOrphans(true, false)
+	assert.NoError(t, err)
+
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes WHERE zapped = 1", 4)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes WHERE zapped = 1 AND size = 6 AND stored_size = 6", 1)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes WHERE hash = '"+otherHash+"' AND zapped = 1 AND size = 20", 1)
+	assert.True(t, IsFile(mismatchedPath))
+
+	err = ctx.ZapOrphans(false, true)
+	assert.NoError(t, err)
+
+	assert.False(t, IsFile(mismatchedPath))
+	assert.True(t, IsFile(otherPath))
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM quarantined_files WHERE file_id IS NULL", 1)
+
+	// Stray files are left for you to look at
+	for _, strayPath := range strayPaths {
+		assert.True(t, IsFile(strayPath))
+	}
+
+	err = ctx.ZapDBIntegrityTestBySize()
+	assert.NoError(t, err)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes WHERE zapped = 1", 4)
+
+	// Orphans can be put back like anything else in quarantine
+	err = ctx.RestoreQuarantine(nil)
+	assert.NoError(t, err)
+
+	assert.True(t, IsFile(mismatchedPath))
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM quarantined_files WHERE deleted_at IS NULL", 0)
+}
+
+func TestZapOrphansShouldKeepChunksWithTheirManifests(t *testing.T) {
+	tempTestDataPath := createTempTestDataPath(t)
+	defer os.RemoveAll(tempTestDataPath)
+
+	c := &config.Config{
+		DBPath:                      path.Join(tempTestDataPath, "db.db"),
+		BatchSize:                   2,
+		MaxConcurrentFileOperations: 2,
+		ZapDataPath:                 path.Join(tempTestDataPath, "ZAP"),
+		QuarantinePath:              path.Join(tempTestDataPath, "quarantine"),
+		QuarantineRetentionDays:     30,
+		ZapChunking:                 true,
+		ZapChunkingMinFileSize:      64 * 1024,
+		ZapChunkSize:                1024,
+	}
+
+	ctx := &Context{
+		Config: c,
+		DB:     initDb(c),
+	}
+
+	err := ctx.Crawl(path.Join(tempTestDataPath, "a"))
+	assert.NoError(t, err)
+
+	err = ctx.HashFiles()
+	assert.NoError(t, err)
+
+	err = ctx.Zap()
+	assert.NoError(t, err)
+
+	// The PNG is stored in chunks, and is orphaned along with them
+	result := ctx.DB.Exec("UPDATE file_hashes SET zapped = 0 WHERE size = 255630")
+	assert.NoError(t, result.Error)
+
+	// A chunk left behind by a crash before its manifest was stored
+	hasher, err := ctx.getHasher()
+	assert.NoError(t, err)
+	chunkContents := []byte("A chunk")
+	chunkPath := path.Join(c.ZapDataPath, FormatRelativeZapFilePathFromHash(DecodeHash(hasher.HashBytes(chunkContents))))
+	assert.NoError(t, os.MkdirAll(path.Dir(chunkPath), 0700))
+	assert.NoError(t, os.WriteFile(chunkPath, chunkContents, 0600))
+
+	var fileHashCount int64
+	result = ctx.DB.Model(&models.FileHash{}).Count(&fileHashCount)
+	assert.NoError(t, result.Error)
+
+	_, fileCount := getFolderAndFileTotalCount(t, c.ZapDataPath)
+
+	// Chunks are not adopted as files of their own
+	err = ctx.ZapOrphans(true, false)
+	assert.NoError(t, err)
+
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes WHERE zapped = 1 AND size = 255630", 1)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes", int(fileHashCount))
+
+	// Only the lone chunk is an orphan now
+	err = ctx.ZapOrphans(false, true)
+	assert.NoError(t, err)
+
+	assert.False(t, IsFile(chunkPath))
+	_, afterFileCount := getFolderAndFileTotalCount(t, c.ZapDataPath)
+	assert.Equal(t, fileCount-1, afterFileCount)
+
+	err = ctx.ZapScrub()
+	assert.NoError(t, err)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes WHERE zapped = 1 AND corrupt = 0", 3)
+
+	// With nothing adopted, a manifest and its chunks are moved into quarantine together
+	result = ctx.DB.Exec("UPDATE file_hashes SET zapped = 0 WHERE size = 255630")
+	assert.NoError(t, result.Error)
+
+	err = ctx.ZapOrphans(false, true)
+	assert.NoError(t, err)
+
+	_, afterFileCount = getFolderAndFileTotalCount(t, c.ZapDataPath)
+	assert.Equal(t, 3, afterFileCount) // The two small files and layout.json
+}
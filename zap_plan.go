@@ -0,0 +1,287 @@
+package main
+
+import (
+	"data-tools/models"
+	"data-tools/utils"
+	"encoding/csv"
+	"github.com/dustin/go-humanize"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type ZapPlanEntry struct {
+	FileID       uint
+	FileHashID   uint
+	Hash         string
+	Size         uint
+	HashZapped   bool
+	LinkType     *string
+	AbsolutePath *string
+}
+
+type ZapPlanRootSummary struct {
+	RootPath       string
+	FilesToZap     int64
+	BytesToZap     uint64
+	FilesToDelete  int64
+	BytesReclaimed uint64
+}
+
+// ZapPlan reports what Zap would do without touching the disk or the DB.
+// If a plan path is specified, every file is written to it as CSV.
+func (ctx *Context) ZapPlan(planPath string) error {
+	utils.ConsoleAndLogPrintf("Acquiring data...")
+
+	var rootPaths []string
+	result := ctx.DB.Model(&models.Path{}).Where("parent_path_id IS NULL AND ignored = 0").Order("id").Pluck("name", &rootPaths)
+
+	if result.Error != nil {
+		return result.Error
+	}
+
+	summaries := map[string]*ZapPlanRootSummary{}
+
+	for _, rootPath := range rootPaths {
+		summaries[rootPath] = &ZapPlanRootSummary{RootPath: rootPath}
+	}
+
+	var planFile *os.File
+	var writer *csv.Writer
+	var err error
+
+	if len(planPath) > 0 {
+		planFile, err = os.Create(path.Clean(planPath))
+
+		if err != nil {
+			return err
+		}
+
+		// Only for when returning early, as the plan is closed explicitly once written so that a failure is reported
+		defer planFile.Close()
+
+		writer = csv.NewWriter(planFile)
+
+		err = writer.Write([]string{"action", "hash", "size", "path", "canonical_path"})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	// Only file IDs are kept for every hash, as nothing is recorded when planning
+	canonicalFiles := map[uint]uint{}
+
+	err = ctx.selectCanonicalFiles(func(batch map[uint]uint) error {
+		for fileHashID, fileID := range batch {
+			canonicalFiles[fileHashID] = fileID
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	rows, err := ctx.DB.Raw(QueryGetZapPlan()).Rows()
+
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	// Files are grouped by hash so that the canonical copy is known before its duplicates are reported
+	var group []ZapPlanEntry
+
+	for rows.Next() {
+		var entry ZapPlanEntry
+		err = ctx.DB.ScanRows(rows, &entry)
+
+		if err != nil {
+			return err
+		}
+
+		// The path could not be resolved, so this file will be skipped
+		if entry.AbsolutePath == nil {
+			continue
+		}
+
+		// Files which have already been linked are left alone unless ZAP-ping into the store
+		if entry.LinkType != nil && ctx.isLinkMode() {
+			continue
+		}
+
+		if len(group) > 0 && group[0].FileHashID != entry.FileHashID {
+			err = ctx.planFileHash(writer, rootPaths, summaries, canonicalFiles, group)
+
+			if err != nil {
+				return err
+			}
+
+			group = nil
+		}
+
+		group = append(group, entry)
+	}
+
+	if rows.Err() != nil {
+		return rows.Err()
+	}
+
+	err = ctx.planFileHash(writer, rootPaths, summaries, canonicalFiles, group)
+
+	if err != nil {
+		return err
+	}
+
+	if writer != nil {
+		writer.Flush()
+
+		if writer.Error() != nil {
+			return writer.Error()
+		}
+
+		err = planFile.Close()
+
+		if err != nil {
+			return err
+		}
+
+		utils.ConsoleAndLogPrintf("Plan written to \"%s\"", planPath)
+	}
+
+	if !ctx.isLinkMode() {
+		var deferredFileCount int64
+		result = ctx.DB.Model(&models.File{}).Where("hash_deferred = 1 AND file_hash_id IS NULL AND ignored = 0").Count(&deferredFileCount)
+
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if deferredFileCount > 0 {
+			utils.ConsoleAndLogPrintf("%s cannot be duplicates and will be hashed then ZAP-ped, so are not included below", utils.Pluralize("file", deferredFileCount))
+		}
+	}
+
+	printZapPlanSummary(rootPaths, summaries)
+
+	return nil
+}
+
+func (ctx *Context) planFileHash(writer *csv.Writer, rootPaths []string, summaries map[string]*ZapPlanRootSummary, canonicalFiles map[uint]uint, files []ZapPlanEntry) error {
+	if len(files) == 0 {
+		return nil
+	}
+
+	// If the hash has already been ZAPped, every file is a duplicate of the one in the ZAP store
+	canonicalPath := ctx.Config.ZapDataPath
+	canonicalFileID, hasCanonicalFile := canonicalFiles[files[0].FileHashID]
+
+	if files[0].HashZapped {
+		hasCanonicalFile = false
+	}
+
+	if hasCanonicalFile {
+		for _, file := range files {
+			if file.FileID == canonicalFileID {
+				canonicalPath = *file.AbsolutePath
+			}
+		}
+	}
+
+	for _, file := range files {
+		summary := summaries[findRootPath(rootPaths, *file.AbsolutePath)]
+
+		if summary == nil {
+			continue
+		}
+
+		action := "delete"
+		canonicalAction := "zap"
+
+		if len(ctx.Config.QuarantinePath) > 0 {
+			action = "quarantine"
+		}
+
+		if ctx.isLinkMode() {
+			action = "link"
+			canonicalAction = "keep"
+		}
+
+		if ctx.Config.ZapMode == LinkTypeSymlink {
+			action = "symlink"
+		}
+
+		if hasCanonicalFile && file.FileID == canonicalFileID {
+			action = canonicalAction
+			summary.FilesToZap++
+			summary.BytesToZap += uint64(file.Size)
+		} else {
+			summary.FilesToDelete++
+			summary.BytesReclaimed += uint64(file.Size)
+		}
+
+		if writer == nil {
+			continue
+		}
+
+		err := writer.Write([]string{action, file.Hash, strconv.FormatUint(uint64(file.Size), 10), *file.AbsolutePath, canonicalPath})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func printZapPlanSummary(rootPaths []string, summaries map[string]*ZapPlanRootSummary) {
+	total := ZapPlanRootSummary{}
+
+	for _, rootPath := range rootPaths {
+		summary := summaries[rootPath]
+
+		if summary.FilesToZap == 0 && summary.FilesToDelete == 0 {
+			continue
+		}
+
+		utils.ConsoleAndLogPrintf("\"%s\": would ZAP %s (%s) and delete %s, reclaiming %s", rootPath, utils.Pluralize("file", summary.FilesToZap), humanize.Bytes(summary.BytesToZap), utils.Pluralize("duplicate file", summary.FilesToDelete), humanize.Bytes(summary.BytesReclaimed))
+
+		total.FilesToZap += summary.FilesToZap
+		total.BytesToZap += summary.BytesToZap
+		total.FilesToDelete += summary.FilesToDelete
+		total.BytesReclaimed += summary.BytesReclaimed
+	}
+
+	utils.ConsoleAndLogPrintf("Dry run: would ZAP %s (%s) and delete %s, reclaiming %s. Nothing has been changed.", utils.Pluralize("file", total.FilesToZap), humanize.Bytes(total.BytesToZap), utils.Pluralize("duplicate file", total.FilesToDelete), humanize.Bytes(total.BytesReclaimed))
+}
+
+// findRootPath returns the most specific root path containing the file
+func findRootPath(rootPaths []string, absolutePath string) string {
+	var matches []string
+
+	for _, rootPath := range rootPaths {
+		if strings.HasPrefix(absolutePath, rootPath+"/") {
+			matches = append(matches, rootPath)
+		}
+	}
+
+	if len(matches) == 0 {
+		return ""
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		return len(matches[i]) > len(matches[j])
+	})
+
+	return matches[0]
+}
+
+// isLinkMode is true when duplicates are replaced by links to their canonical copy rather than ZAP-ped into the store
+func (ctx *Context) isLinkMode() bool {
+	return ctx.Config.ZapMode == LinkTypeHardlink || ctx.Config.ZapMode == LinkTypeReflink
+}
@@ -0,0 +1,68 @@
+//go:build integration
+// +build integration
+
+package main
+
+import (
+	"data-tools/config"
+	"encoding/csv"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestZapPlanShouldNotChangeAnything(t *testing.T) {
+	tempTestDataPath := createTempTestDataPath(t)
+	defer os.RemoveAll(tempTestDataPath)
+
+	c := &config.Config{
+		DBPath:                      path.Join(tempTestDataPath, "db.db"),
+		BatchSize:                   5,
+		MaxConcurrentFileOperations: 2,
+		ZapDataPath:                 path.Join(tempTestDataPath, "ZAP"),
+	}
+
+	ctx := &Context{
+		Config: c,
+		DB:     initDb(c),
+	}
+
+	dataPath := path.Join(tempTestDataPath, "a")
+	err := ctx.Crawl(dataPath)
+	assert.NoError(t, err)
+
+	err = ctx.HashFiles()
+	assert.NoError(t, err)
+
+	planPath := path.Join(tempTestDataPath, "plan.csv")
+	err = ctx.ZapPlan(planPath)
+	assert.NoError(t, err)
+
+	folderCount, fileCount := getFolderAndFileTotalCount(t, dataPath)
+	assert.Equal(t, 3, folderCount)
+	assert.Equal(t, 5, fileCount)
+	assert.False(t, IsDir(c.ZapDataPath))
+
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM files WHERE zapped = 1", 0)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes WHERE zapped = 1", 0)
+
+	planFile, err := os.Open(planPath)
+	assert.NoError(t, err)
+	defer planFile.Close()
+
+	records, err := csv.NewReader(planFile).ReadAll()
+	assert.NoError(t, err)
+
+	// A header plus one line per file
+	assert.Len(t, records, 6)
+
+	actions := map[string]int{}
+
+	for _, record := range records[1:] {
+		actions[record[0]]++
+	}
+
+	assert.Equal(t, 3, actions["zap"])
+	assert.Equal(t, 2, actions["delete"])
+}
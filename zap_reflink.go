@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+const LinkTypeReflink = "reflink"
+
+// replaceWithReflink asks the filesystem to share the blocks of the canonical file with the duplicate, returning the number of bytes deduplicated.
+// The duplicate keeps its own inode, so its metadata is left untouched.
+func replaceWithReflink(canonicalFilePath, duplicateFilePath string) (uint64, error) {
+	// The kernel compares the ranges too, but this lets us tell the user why a file was not deduplicated
+	isSameContent, err := CompareFiles(canonicalFilePath, duplicateFilePath)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if !isSameContent {
+		return 0, ErrFileContentsDiffer
+	}
+
+	info, err := os.Stat(canonicalFilePath)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return dedupeFileRange(canonicalFilePath, duplicateFilePath, info.Size())
+}
+
+// isLinkUnsupported is true if the filesystem(s) cannot link the files, in which case the duplicate is left as it is
+func isLinkUnsupported(err error) bool {
+	return errors.Is(err, errors.ErrUnsupported) || errors.Is(err, syscall.EXDEV)
+}
@@ -0,0 +1,83 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"os"
+	"path"
+	"syscall"
+)
+
+// Filesystems cap how much is deduplicated per call (btrfs: 16MiB), so we ask for no more than this at a time
+const maxDedupeLength = 16 * 1024 * 1024
+
+// dedupeFileRange shares the first length bytes of the source file with the destination using FIDEDUPERANGE
+func dedupeFileRange(sourceFilePath, destinationFilePath string, length int64) (uint64, error) {
+	source, err := os.Open(path.Clean(sourceFilePath))
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer source.Close()
+
+	// The destination must be writable, but opening it does not modify it
+	destination, err := os.OpenFile(path.Clean(destinationFilePath), os.O_RDWR, 0)
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer destination.Close()
+
+	deduped := uint64(0)
+
+	for offset := int64(0); offset < length; {
+		dedupe := &unix.FileDedupeRange{
+			Src_offset: uint64(offset),
+			Src_length: uint64(min(length-offset, maxDedupeLength)),
+			Info: []unix.FileDedupeRangeInfo{{
+				Dest_fd:     int64(destination.Fd()),
+				Dest_offset: uint64(offset),
+			}},
+		}
+
+		err = unix.IoctlFileDedupeRange(int(source.Fd()), dedupe)
+
+		if err != nil {
+			return deduped, wrapDedupeError(err)
+		}
+
+		info := dedupe.Info[0]
+
+		if info.Status == unix.FILE_DEDUPE_RANGE_DIFFERS {
+			return deduped, ErrFileContentsDiffer
+		}
+
+		if info.Status < 0 {
+			return deduped, wrapDedupeError(syscall.Errno(-info.Status))
+		}
+
+		// Nothing was deduplicated, so stop rather than loop forever
+		if info.Bytes_deduped == 0 {
+			return deduped, fmt.Errorf("could not deduplicate from offset %d", offset)
+		}
+
+		deduped += info.Bytes_deduped
+		offset += int64(info.Bytes_deduped)
+	}
+
+	return deduped, nil
+}
+
+// wrapDedupeError marks the errors returned by filesystems without FIDEDUPERANGE support as unsupported
+func wrapDedupeError(err error) error {
+	if errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.ENOTTY) {
+		return fmt.Errorf("%w: %w", errors.ErrUnsupported, err)
+	}
+
+	return err
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func dedupeFileRange(_, _ string, _ int64) (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
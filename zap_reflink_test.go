@@ -0,0 +1,34 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestReplaceWithReflink(t *testing.T) {
+	tempTestDataPath := createTempTestDataPath(t)
+	defer os.RemoveAll(tempTestDataPath)
+
+	canonicalFilePath := path.Join(tempTestDataPath, "a", "file.md")
+	duplicateFilePath := path.Join(tempTestDataPath, "a", "a", "file.md")
+	differentFilePath := path.Join(tempTestDataPath, "a", "b", "c", ".gitignore")
+
+	_, err := replaceWithReflink(canonicalFilePath, differentFilePath)
+	assert.ErrorIs(t, err, ErrFileContentsDiffer)
+
+	reclaimedBytes, err := replaceWithReflink(canonicalFilePath, duplicateFilePath)
+
+	// The test data may well be on a filesystem without copy-on-write support, e.g. ext4 or tmpfs
+	if isLinkUnsupported(err) {
+		t.Skipf("reflinks unsupported: %v", err)
+	}
+
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(6), reclaimedBytes)
+
+	isSameContent, err := CompareFiles(canonicalFilePath, duplicateFilePath)
+	assert.NoError(t, err)
+	assert.True(t, isSameContent)
+}
@@ -0,0 +1,123 @@
+//go:build integration
+// +build integration
+
+package main
+
+import (
+	"data-tools/blobstore"
+	"data-tools/blobstore/fakes3"
+	"data-tools/config"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestZapShouldStoreFilesInS3(t *testing.T) {
+	tempTestDataPath := createTempTestDataPath(t)
+	defer os.RemoveAll(tempTestDataPath)
+
+	t.Setenv(s3AccessKeyVariable, "access")
+	t.Setenv(s3SecretKeyVariable, "secret")
+
+	c := &config.Config{
+		DBPath:                      path.Join(tempTestDataPath, "db.db"),
+		BatchSize:                   2,
+		MaxConcurrentFileOperations: 2,
+		ZapDataPath:                 "s3://zap/data-tools/ZAP",
+		ZapS3Endpoint:               fakes3.NewServer(t, "zap"),
+		ZapS3Region:                 "us-east-1",
+		ZapS3Insecure:               true,
+		VerifyBeforeDelete:          true,
+		ZapCompression:              true,
+	}
+
+	ctx := &Context{
+		Config: c,
+		DB:     initDb(c),
+	}
+
+	dataPath := path.Join(tempTestDataPath, "a")
+	logContents := []byte(strings.Repeat("2001-02-03 04:05:06 Something happened\n", 1000))
+	assert.NoError(t, os.WriteFile(path.Join(dataPath, "app.log"), logContents, 0644))
+
+	err := ctx.Crawl(dataPath)
+	assert.NoError(t, err)
+
+	err = ctx.HashFiles()
+	assert.NoError(t, err)
+
+	err = ctx.Zap()
+	assert.NoError(t, err)
+
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM files WHERE zapped = 1", 6)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes WHERE zapped = 1", 4)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes WHERE stored_size < size", 1)
+
+	// Nothing is left on disk
+	assert.False(t, IsFile(path.Join(dataPath, "app.log")))
+	assert.False(t, IsFile(path.Join(dataPath, "b", "j.txt")))
+
+	blobs, err := ctx.openBlobStore(c.ZapDataPath)
+	assert.NoError(t, err)
+
+	var names []string
+	err = blobs.List(func(name string, size int64) error {
+		names = append(names, name)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Len(t, names, 4)
+
+	err = ctx.ZapDBIntegrityTestBySize()
+	assert.NoError(t, err)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes WHERE zapped = 1", 4)
+
+	// Orphans are copied out of S3 into quarantine
+	c.QuarantinePath = path.Join(tempTestDataPath, "quarantine")
+	orphanName := strings.Repeat("cd", 64)
+	assert.NoError(t, blobs.Put(orphanName, strings.NewReader("Not its hash")))
+
+	err = ctx.ZapOrphans(true, true)
+	assert.NoError(t, err)
+
+	_, err = blobs.Stat(orphanName)
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+	assert.True(t, IsFile(path.Join(c.QuarantinePath, "s3", "zap", "data-tools", "ZAP", blobstore.DefaultLayout.RelativePath(orphanName))))
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes WHERE zapped = 1", 4)
+
+	outputPath := path.Join(tempTestDataPath, "output")
+	err = ctx.UnZap(c.ZapDataPath, outputPath, false)
+	assert.NoError(t, err)
+
+	_, fileCount := getFolderAndFileTotalCount(t, outputPath)
+	assert.Equal(t, 6, fileCount)
+
+	restored, err := os.ReadFile(path.Join(outputPath, dataPath, "app.log"))
+	assert.NoError(t, err)
+	assert.Equal(t, logContents, restored)
+
+	// The files can be moved back to a local ZAP folder
+	localZapPath := path.Join(tempTestDataPath, "ZAP")
+
+	err = mergeZaps(blobs, blobstore.NewLocal(localZapPath))
+	assert.NoError(t, err)
+
+	for _, name := range names {
+		assert.True(t, IsFile(path.Join(localZapPath, blobstore.DefaultLayout.RelativePath(name))))
+	}
+
+	err = blobs.List(func(name string, size int64) error {
+		assert.Fail(t, "Not moved", name)
+		return nil
+	})
+	assert.NoError(t, err)
+
+	c.ZapDataPath = localZapPath
+	err = ctx.ZapDBIntegrityTestBySize()
+	assert.NoError(t, err)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes WHERE zapped = 1", 4)
+}
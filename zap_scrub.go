@@ -0,0 +1,243 @@
+package main
+
+import (
+	"data-tools/crypto"
+	"data-tools/models"
+	"data-tools/utils"
+	"errors"
+	"fmt"
+	"github.com/schollz/progressbar/v3"
+	"gorm.io/gorm"
+	"io/fs"
+	"log"
+	"time"
+)
+
+type ScrubResult struct {
+	ID        uint
+	Hash      string
+	Algorithm string
+	Corrupt   bool
+}
+
+type scrubOutcome int
+
+const (
+	scrubIntact scrubOutcome = iota
+	scrubCorrupt
+	scrubMissing
+	scrubFailed // The file could not be read, so whether it is intact is not known
+)
+
+// ZapScrub reads back every file in the ZAP folder and checks that it still matches its hash, which
+// ZapDBIntegrityTestBySize cannot. Progress is recorded after every batch, so a scrub which is stopped carries on where
+// it left off when run again. Corrupt files are marked as such, and missing files are no longer marked as ZAP-ped.
+func (ctx *Context) ZapScrub() error {
+	folder, err := ctx.openZapFolder(ctx.Config.ZapDataPath)
+
+	if err != nil {
+		return err
+	}
+
+	scrub, err := ctx.getUnfinishedScrub()
+
+	if err != nil {
+		return err
+	}
+
+	if scrub.LastFileHashID > 0 {
+		utils.ConsoleAndLogPrintf("Resuming the scrub started at %s", scrub.CreatedAt.Format(time.DateTime))
+	}
+
+	utils.ConsoleAndLogPrintf("Acquiring data...")
+	total, batches, err := ctx.GetBatchesOfIDs(QueryGetFileHashIdsToScrub(scrub.LastFileHashID), "fh")
+
+	if err != nil {
+		return err
+	}
+
+	utils.ConsoleAndLogPrintf("Scrubbing %s in %s", utils.Pluralize("hash", total), utils.Pluralize("batch", int64(len(batches))))
+
+	bar := progressbar.Default(total)
+	hashers := map[string]*crypto.Hasher{}
+	failedCount := 0
+
+	for _, batch := range batches {
+		var fileHashes []ScrubResult
+		result := ctx.DB.Raw(QueryGetFileHashesToScrub(), batch).Scan(&fileHashes)
+
+		if result.Error != nil {
+			return result.Error
+		}
+
+		outcomes := map[uint]scrubOutcome{}
+		orchestrator := utils.NewTaskOrchestrator(bar, len(fileHashes), ctx.Config.MaxConcurrentFileOperations)
+
+		for _, fileHash := range fileHashes {
+			hasher, exists := hashers[fileHash.Algorithm]
+
+			if !exists {
+				hasher, err = crypto.NewHasher(fileHash.Algorithm)
+
+				if err != nil {
+					return err
+				}
+
+				hashers[fileHash.Algorithm] = hasher
+			}
+
+			orchestrator.StartTask()
+			go scrubFile(orchestrator, folder, hasher, fileHash, outcomes)
+		}
+
+		orchestrator.WaitForTasks()
+
+		for _, outcome := range outcomes {
+			if outcome == scrubFailed {
+				failedCount++
+			}
+		}
+
+		err = ctx.recordScrubProgress(scrub, uint(batch[len(batch)-1]), fileHashes, outcomes)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	scrub.FinishedAt = &now
+	result := ctx.DB.Save(scrub)
+
+	if result.Error != nil {
+		return result.Error
+	}
+
+	utils.ConsoleAndLogPrintf("Scrub finished: %s, %s", utils.Pluralize("corrupt hash", int64(scrub.CorruptCount)), utils.Pluralize("missing hash", int64(scrub.MissingCount)))
+
+	if failedCount > 0 {
+		return fmt.Errorf("%s could not be read, see the log for details", utils.Pluralize("hash", int64(failedCount)))
+	}
+
+	return nil
+}
+
+// getUnfinishedScrub returns the scrub to carry on with, starting a new one if the last one finished
+func (ctx *Context) getUnfinishedScrub() (*models.Scrub, error) {
+	var scrubs []models.Scrub
+	result := ctx.DB.Where("finished_at IS NULL").Order("id DESC").Limit(1).Find(&scrubs)
+
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	if len(scrubs) > 0 {
+		return &scrubs[0], nil
+	}
+
+	scrub := &models.Scrub{}
+	result = ctx.DB.Create(scrub)
+
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return scrub, nil
+}
+
+// recordScrubProgress records the outcome of a batch along with the last hash checked, so that it is never recorded
+// without the other
+func (ctx *Context) recordScrubProgress(scrub *models.Scrub, lastFileHashID uint, fileHashes []ScrubResult, outcomes map[uint]scrubOutcome) error {
+	var corruptIDs, missingIDs, repairedIDs []uint
+
+	for _, fileHash := range fileHashes {
+		switch outcomes[fileHash.ID] {
+		case scrubCorrupt:
+			corruptIDs = append(corruptIDs, fileHash.ID)
+		case scrubMissing:
+			missingIDs = append(missingIDs, fileHash.ID)
+		case scrubIntact:
+			// Such as when it has been replaced with a good copy from a backup
+			if fileHash.Corrupt {
+				repairedIDs = append(repairedIDs, fileHash.ID)
+			}
+		}
+	}
+
+	return ctx.DB.Transaction(func(tx *gorm.DB) error {
+		if len(corruptIDs) > 0 {
+			result := tx.Model(&models.FileHash{}).Where("id IN ?", corruptIDs).Update("corrupt", true)
+
+			if result.Error != nil {
+				return result.Error
+			}
+		}
+
+		if len(missingIDs) > 0 {
+			result := tx.Model(&models.FileHash{}).Where("id IN ?", missingIDs).Update("zapped", false)
+
+			if result.Error != nil {
+				return result.Error
+			}
+		}
+
+		if len(repairedIDs) > 0 {
+			result := tx.Model(&models.FileHash{}).Where("id IN ?", repairedIDs).Update("corrupt", false)
+
+			if result.Error != nil {
+				return result.Error
+			}
+		}
+
+		scrub.LastFileHashID = lastFileHashID
+		scrub.CorruptCount += uint(len(corruptIDs))
+		scrub.MissingCount += uint(len(missingIDs))
+
+		return tx.Save(scrub).Error
+	})
+}
+
+func scrubFile(orchestrator *utils.TaskOrchestrator, folder *zapFolder, hasher *crypto.Hasher, fileHash ScrubResult, outcomes map[uint]scrubOutcome) {
+	outcome := checkZapFile(folder, hasher, fileHash.Hash)
+
+	orchestrator.Lock()
+	outcomes[fileHash.ID] = outcome
+	orchestrator.Unlock()
+
+	orchestrator.FinishTask()
+}
+
+// checkZapFile rehashes a file in the ZAP folder, however it is stored
+func checkZapFile(folder *zapFolder, hasher *crypto.Hasher, hash string) scrubOutcome {
+	hexFileName := DecodeHash(hash)
+	reader, err := folder.openFile(hash)
+
+	if err == nil {
+		var zapFileHash string
+		zapFileHash, err = hasher.HashReader(reader)
+		closeErr := reader.Close()
+
+		if err == nil {
+			err = closeErr
+		}
+
+		if err == nil && zapFileHash != hash {
+			log.Printf("Hash mismatch in ZAP folder: expected %s, got %s for \"%s\"", hash, zapFileHash, folder.location(hexFileName, ""))
+			return scrubCorrupt
+		}
+	}
+
+	switch {
+	case err == nil:
+		return scrubIntact
+	case errors.Is(err, fs.ErrNotExist):
+		log.Printf("Hash not found in ZAP folder: %s (%v)", hexFileName, err)
+		return scrubMissing
+	case errors.Is(err, crypto.ErrDecryptionFailed):
+		log.Printf("Hash could not be decrypted in ZAP folder: %s (%v)", hexFileName, err)
+		return scrubCorrupt
+	}
+
+	log.Printf("Error scrubbing hash %s: %v", hexFileName, err)
+	return scrubFailed
+}
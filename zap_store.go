@@ -0,0 +1,640 @@
+package main
+
+import (
+	"data-tools/blobstore"
+	"data-tools/crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// encryptionParametersFileName is kept at the top of an encrypted ZAP folder, so the key can be derived again
+const encryptionParametersFileName = "encryption.json"
+
+// zapPassphraseVariable is the environment variable the passphrase of an encrypted ZAP folder is read from, when no
+// key file is configured
+const zapPassphraseVariable = "DATA_TOOLS_ZAP_PASSPHRASE"
+
+// The credentials of a ZAP folder in S3 are read from the same environment variables as the AWS tools use
+const (
+	s3AccessKeyVariable = "AWS_ACCESS_KEY_ID"
+	s3SecretKeyVariable = "AWS_SECRET_ACCESS_KEY"
+)
+
+// A zapFolder names, reads and writes the files in a ZAP folder, which may be on the local filesystem or in object
+// storage. In an encrypted folder files are named by a keyed hash of their hash, and encrypted.
+type zapFolder struct {
+	blobs blobstore.BlobStore
+	key   *crypto.Key
+}
+
+// A zapStore stores files in a ZAP folder, in chunks or compressed when configured to, otherwise as they are
+type zapStore struct {
+	folder     *zapFolder
+	chunks     *chunkStore
+	compressor *compressor
+}
+
+// openBlobStore opens the store a ZAP folder is kept in, laid out as its manifest says
+func (ctx *Context) openBlobStore(location string) (blobstore.BlobStore, error) {
+	blobs, err := ctx.newBlobStore(location)
+
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, err := blobstore.ReadManifest(blobs)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Folders from before layouts were recorded have the default layout, as do new folders until something is stored
+	if manifest == nil {
+		return blobs, nil
+	}
+
+	if manifest.RelayoutTo != nil {
+		return nil, ErrZapRelayoutUnfinished
+	}
+
+	return blobs.WithLayout(manifest.Layout), nil
+}
+
+// newBlobStore returns the store a ZAP folder is kept in with the default layout, which is in S3 when given an
+// s3://bucket/prefix URL
+func (ctx *Context) newBlobStore(location string) (blobstore.BlobStore, error) {
+	bucket, prefix, isS3 := blobstore.ParseS3URL(location)
+
+	if isS3 {
+		return blobstore.NewS3(blobstore.S3Options{
+			Endpoint:  ctx.Config.ZapS3Endpoint,
+			Region:    ctx.Config.ZapS3Region,
+			AccessKey: os.Getenv(s3AccessKeyVariable),
+			SecretKey: os.Getenv(s3SecretKeyVariable),
+			Insecure:  ctx.Config.ZapS3Insecure,
+			Bucket:    bucket,
+			Prefix:    prefix,
+		})
+	}
+
+	basePath, err := filepath.Abs(location)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return blobstore.NewLocal(basePath), nil
+}
+
+// openZapFolder opens a ZAP folder to be read, deriving its key if it is encrypted
+func (ctx *Context) openZapFolder(location string) (*zapFolder, error) {
+	blobs, err := ctx.openBlobStore(location)
+
+	if err != nil {
+		return nil, err
+	}
+
+	folder := &zapFolder{blobs: blobs}
+	parameters, err := readEncryptionParameters(blobs)
+
+	if err != nil || parameters == nil {
+		return folder, err
+	}
+
+	secret, err := ctx.getZapSecret()
+
+	if err != nil {
+		return nil, err
+	}
+
+	folder.key, err = crypto.DeriveKey(secret, parameters)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return folder, nil
+}
+
+// newZapStore opens a ZAP folder to be written to, encrypting it first if it is empty and encryption is enabled
+func (ctx *Context) newZapStore(location string) (*zapStore, error) {
+	folder, err := ctx.openZapFolder(location)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = ctx.recordZapLayout(folder)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if ctx.Config.ZapEncryption && folder.key == nil {
+		folder.key, err = ctx.encryptZapFolder(folder.blobs)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	chunks, err := ctx.newChunkStore(folder)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &zapStore{
+		folder:     folder,
+		chunks:     chunks,
+		compressor: ctx.newCompressor(),
+	}, nil
+}
+
+func (ctx *Context) getZapSecret() ([]byte, error) {
+	if len(ctx.Config.ZapEncryptionKeyFile) > 0 {
+		return os.ReadFile(path.Clean(ctx.Config.ZapEncryptionKeyFile))
+	}
+
+	passphrase := os.Getenv(zapPassphraseVariable)
+
+	if len(passphrase) == 0 {
+		return nil, ErrNoZapSecret
+	}
+
+	return []byte(passphrase), nil
+}
+
+// encryptZapFolder derives a new key and records its parameters in the ZAP folder, which must not have had anything
+// ZAP-ped to it yet
+func (ctx *Context) encryptZapFolder(blobs blobstore.BlobStore) (*crypto.Key, error) {
+	var zappedCount int64 = 0
+	result := ctx.DB.Raw("SELECT COUNT(*) FROM file_hashes WHERE zapped = 1").Scan(&zappedCount)
+
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	if zappedCount > 0 {
+		return nil, ErrZapFolderNotEncrypted
+	}
+
+	secret, err := ctx.getZapSecret()
+
+	if err != nil {
+		return nil, err
+	}
+
+	parameters, err := crypto.NewKeyParameters()
+
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := crypto.DeriveKey(secret, parameters)
+
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.MarshalIndent(parameters, "", "  ")
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = blobs.WriteFile(encryptionParametersFileName, data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// readEncryptionParameters returns nil if the ZAP folder is not encrypted
+func readEncryptionParameters(blobs blobstore.BlobStore) (*crypto.KeyParameters, error) {
+	data, err := blobs.ReadFile(encryptionParametersFileName)
+
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	parameters := &crypto.KeyParameters{}
+	err = json.Unmarshal(data, parameters)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid \"%s\": %w", encryptionParametersFileName, err)
+	}
+
+	return parameters, nil
+}
+
+// name is the name a file is stored under, which is its hash unless the folder is encrypted
+func (f *zapFolder) name(hexFileName string) string {
+	if f.key == nil {
+		return hexFileName
+	}
+
+	return f.key.Name([]byte(hexFileName))
+}
+
+// blobName is the name of a file in the blob store, with a suffix for files which are compressed or stored in chunks
+func (f *zapFolder) blobName(hexFileName, suffix string) string {
+	return f.name(hexFileName) + suffix
+}
+
+// location describes where a file is stored, which is its path when the ZAP folder is on the local filesystem
+func (f *zapFolder) location(hexFileName, suffix string) string {
+	return f.blobs.Location(f.blobName(hexFileName, suffix))
+}
+
+// localPath is where a file is stored, returning false if the ZAP folder is not on the local filesystem
+func (f *zapFolder) localPath(hexFileName, suffix string) (string, bool) {
+	local, isLocal := f.blobs.(*blobstore.Local)
+
+	if !isLocal {
+		return "", false
+	}
+
+	return local.Path(f.blobName(hexFileName, suffix)), true
+}
+
+func (f *zapFolder) exists(hexFileName, suffix string) bool {
+	_, err := f.blobs.Stat(f.blobName(hexFileName, suffix))
+	return err == nil
+}
+
+// isStored is true if a file has been stored in any form
+func (f *zapFolder) isStored(hexFileName string) bool {
+	return f.exists(hexFileName, "") || f.exists(hexFileName, compressedSuffix) || f.exists(hexFileName, chunkManifestSuffix)
+}
+
+// Encrypted files are tied to their names, so that one cannot be swapped for another. openBlob relies on this being
+// the blob name.
+func (f *zapFolder) associatedData(hexFileName, suffix string) []byte {
+	return []byte(f.blobName(hexFileName, suffix))
+}
+
+// write stores a file, encrypting it if the folder is encrypted. Nothing is stored if write fails, and its error is
+// returned.
+func (f *zapFolder) write(hexFileName, suffix string, write func(w io.Writer) error) error {
+	reader, writer := io.Pipe()
+	writeErrors := make(chan error, 1)
+
+	go func() {
+		err := f.writeTo(writer, hexFileName, suffix, write)
+		_ = writer.CloseWithError(err)
+		writeErrors <- err
+	}()
+
+	err := f.blobs.Put(f.blobName(hexFileName, suffix), reader)
+
+	// Stops the writer if the blob store gave up before reading everything
+	_ = reader.CloseWithError(io.ErrClosedPipe)
+	writeErr := <-writeErrors
+
+	if writeErr != nil {
+		return writeErr
+	}
+
+	return err
+}
+
+func (f *zapFolder) writeTo(w io.Writer, hexFileName, suffix string, write func(w io.Writer) error) error {
+	if f.key == nil {
+		return write(w)
+	}
+
+	encrypted, err := f.key.NewWriter(w, f.associatedData(hexFileName, suffix))
+
+	if err != nil {
+		return err
+	}
+
+	err = write(encrypted)
+
+	if err != nil {
+		return err
+	}
+
+	return encrypted.Close()
+}
+
+// open opens a stored file, decrypting it if the folder is encrypted
+func (f *zapFolder) open(hexFileName, suffix string) (io.ReadCloser, error) {
+	return f.openBlob(f.blobName(hexFileName, suffix))
+}
+
+// openBlob opens a stored file by its name in the blob store, for when its hash is not known
+func (f *zapFolder) openBlob(name string) (io.ReadCloser, error) {
+	blob, err := f.blobs.Get(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if f.key == nil {
+		return blob, nil
+	}
+
+	decrypted, err := f.key.NewReader(blob, []byte(name))
+
+	if err != nil {
+		_ = blob.Close()
+		return nil, err
+	}
+
+	return &decryptedFile{Reader: decrypted, blob: blob}, nil
+}
+
+// size is the size of a stored file, before it was encrypted
+func (f *zapFolder) size(hexFileName, suffix string) (int64, error) {
+	size, err := f.blobs.Stat(f.blobName(hexFileName, suffix))
+
+	if err != nil {
+		return 0, err
+	}
+
+	if f.key == nil {
+		return size, nil
+	}
+
+	return crypto.PlaintextSize(size)
+}
+
+type decryptedFile struct {
+	io.Reader
+	blob io.Closer
+}
+
+func (f *decryptedFile) Close() error {
+	return f.blob.Close()
+}
+
+// store moves a file into the ZAP folder, and returns the size it takes up there when that is known
+func (s *zapStore) store(file ZapResult) (bool, *uint, error) {
+	// Store as hex so this will work fine on case-insensitive filesystems
+	hexFileName := DecodeHash(file.Hash)
+
+	// Files are moved into a local, unencrypted ZAP folder by CopyOrMoveFile, which also checks the size of any copy
+	// already there matches
+	destinationPath, isLocal := s.folder.localPath(hexFileName, "")
+	canMove := isLocal && s.folder.key == nil
+
+	if canMove && IsFile(destinationPath) {
+		return s.storeWhole(file, destinationPath)
+	}
+
+	stored := s.folder.isStored(hexFileName)
+	var storedSize *uint
+	var err error
+
+	if !stored {
+		stored, storedSize, err = s.chunks.store(file.AbsolutePath, hexFileName)
+	}
+
+	if err == nil && !stored {
+		stored, storedSize, err = s.compressor.store(s.folder, file.AbsolutePath, hexFileName, file.FileType)
+	}
+
+	if err == nil && !stored && !canMove {
+		stored, storedSize, err = s.storeByWriting(file, hexFileName)
+	}
+
+	if err != nil {
+		return false, nil, err
+	}
+
+	if !stored {
+		return s.storeWhole(file, destinationPath)
+	}
+
+	err = os.Remove(file.AbsolutePath)
+
+	if err != nil {
+		return false, nil, err
+	}
+
+	return true, storedSize, nil
+}
+
+func (s *zapStore) storeWhole(file ZapResult, destinationPath string) (bool, *uint, error) {
+	err := osMkdirAll(filepath.Dir(destinationPath))
+
+	if err != nil {
+		return false, nil, err
+	}
+
+	success, err := CopyOrMoveFile(file.AbsolutePath, destinationPath, true, true)
+
+	if err != nil || !success {
+		return success, nil, err
+	}
+
+	info, err := os.Stat(destinationPath)
+
+	if err != nil {
+		return false, nil, err
+	}
+
+	size := uint(info.Size()) // #nosec G115
+	return true, &size, nil
+}
+
+// storeByWriting writes a file through the ZAP folder, which encrypts it when needed and works with any blob store
+func (s *zapStore) storeByWriting(file ZapResult, hexFileName string) (bool, *uint, error) {
+	source, err := os.Open(path.Clean(file.AbsolutePath))
+
+	if err != nil {
+		return false, nil, err
+	}
+
+	defer source.Close()
+
+	size := uint(0)
+
+	err = s.folder.write(hexFileName, "", func(w io.Writer) error {
+		written, err := io.Copy(w, source)
+		size = uint(written) // #nosec G115
+		return err
+	})
+
+	if err != nil {
+		return false, nil, err
+	}
+
+	return true, &size, nil
+}
+
+func (s *zapStore) printStats() {
+	s.chunks.printStats()
+	s.compressor.printStats()
+}
+
+// openFile opens a file in the ZAP folder by its hash, decompressing it or reassembling it from its chunks as needed
+func (f *zapFolder) openFile(hash string) (io.ReadCloser, error) {
+	hexFileName := DecodeHash(hash)
+
+	if f.exists(hexFileName, "") {
+		return f.open(hexFileName, "")
+	}
+
+	if f.exists(hexFileName, compressedSuffix) {
+		reader, err := f.open(hexFileName, compressedSuffix)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return newCompressedReader(reader)
+	}
+
+	chunks, err := f.readChunkManifest(hexFileName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &chunkReader{folder: f, chunks: chunks}, nil
+}
+
+// statFile returns the size of a file in the ZAP folder before it was compressed or split into chunks. A file stored
+// in chunks must have all of its chunks.
+func (f *zapFolder) statFile(hash string) (int64, error) {
+	hexFileName := DecodeHash(hash)
+
+	if f.exists(hexFileName, "") {
+		return f.size(hexFileName, "")
+	}
+
+	if f.exists(hexFileName, compressedSuffix) {
+		reader, err := f.open(hexFileName, compressedSuffix)
+
+		if err != nil {
+			return 0, err
+		}
+
+		defer reader.Close()
+
+		return readCompressedSize(reader)
+	}
+
+	chunks, err := f.readChunkManifest(hexFileName)
+
+	if err != nil {
+		return 0, err
+	}
+
+	size := int64(0)
+
+	for _, chunk := range chunks {
+		chunkSize, err := f.size(chunk.hash, "")
+
+		if err != nil {
+			return 0, fmt.Errorf("chunk %s: %w", chunk.hash, err)
+		}
+
+		if chunkSize != chunk.size {
+			return 0, fmt.Errorf("chunk %s has size %d, expected %d: %w", chunk.hash, chunkSize, chunk.size, fs.ErrNotExist)
+		}
+
+		size += chunk.size
+	}
+
+	return size, nil
+}
+
+// copyFile copies a file out of the ZAP folder, as CopyOrMoveFile does, but also for files which are encrypted,
+// compressed or stored in chunks
+func (f *zapFolder) copyFile(hash, destination string) error {
+	hexFileName := DecodeHash(hash)
+	zapFilePath, isLocal := f.localPath(hexFileName, "")
+
+	if isLocal && f.key == nil && IsFile(zapFilePath) {
+		_, err := CopyOrMoveFile(zapFilePath, destination, false, false)
+		return err
+	}
+
+	zapFileLocation := f.location(hexFileName, "")
+
+	if IsFile(destination) {
+		isSame, err := f.compareWithFile(hash, destination)
+
+		if err != nil {
+			return err
+		}
+
+		if !isSame {
+			log.Printf("Not copying file \"%s\" to \"%s\" because they are different\n", zapFileLocation, destination)
+		}
+
+		return nil
+	}
+
+	reader, err := f.openFile(hash)
+
+	if err != nil {
+		return err
+	}
+
+	defer reader.Close()
+
+	err = osMkdirAll(filepath.Dir(destination))
+
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path.Clean(destination), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(file, reader)
+	closeErr := file.Close()
+
+	if err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		_ = os.Remove(destination)
+		return &FileOperationError{Op: "restore", Source: zapFileLocation, Destination: destination, Err: err}
+	}
+
+	return nil
+}
+
+// compareWithFile compares a file with its copy in the ZAP folder, however that is stored
+func (f *zapFolder) compareWithFile(hash, filePath string) (bool, error) {
+	zapFile, err := f.openFile(hash)
+
+	if err != nil {
+		return false, fmt.Errorf("failed to open file for left-hand comparison: %v", err)
+	}
+
+	defer zapFile.Close()
+
+	file, err := os.Open(path.Clean(filePath))
+
+	if err != nil {
+		return false, fmt.Errorf("failed to open file for right-hand comparison: %v", err)
+	}
+
+	defer file.Close()
+
+	return compareReaders(zapFile, file)
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"data-tools/blobstore"
+	"data-tools/models"
+	"data-tools/utils"
+	"errors"
+	"fmt"
+	"github.com/schollz/progressbar/v3"
+	"gorm.io/gorm"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+const LinkTypeSymlink = "symlink"
+
+// replaceWithSymlink creates the symlink alongside the file first, then renames over the file so that it is never missing
+func (ctx *Context) replaceWithSymlink(zapFilePath, filePath string) error {
+	target := zapFilePath
+
+	if ctx.Config.ZapRelativeSymlinks {
+		relativeTarget, err := filepath.Rel(filepath.Dir(filePath), zapFilePath)
+
+		if err != nil {
+			return err
+		}
+
+		target = relativeTarget
+	}
+
+	temporaryFilePath, err := temporaryPathAlongside(filePath, ".data-tools-link")
+
+	if err != nil {
+		return err
+	}
+
+	err = os.Symlink(target, temporaryFilePath)
+
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(temporaryFilePath, filePath)
+
+	if err != nil {
+		_ = os.Remove(temporaryFilePath)
+		return err
+	}
+
+	return nil
+}
+
+// isSymlinkIntact checks the file is still a symlink pointing at the ZAP-ped copy of its hash
+func (ctx *Context) isSymlinkIntact(folder *zapFolder, filePath, hash string) bool {
+	target, err := os.Readlink(filePath)
+
+	if err != nil {
+		return false
+	}
+
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(filePath), target)
+	}
+
+	zapFilePath, isLocal := folder.localPath(DecodeHash(hash), "")
+
+	return isLocal && filepath.Clean(target) == zapFilePath && IsFile(zapFilePath)
+}
+
+// symlinkFilesInDB records that the files now point into the ZAP folder at the copy of their canonical file
+func symlinkFilesInDB(tx *gorm.DB, symlinkedFileIds []uint) error {
+	if len(symlinkedFileIds) == 0 {
+		return nil
+	}
+
+	result := tx.Model(&models.File{}).Where("id IN ?", symlinkedFileIds).Updates(map[string]interface{}{
+		"link_type":      LinkTypeSymlink,
+		"linked_file_id": gorm.Expr("(SELECT fh.canonical_file_id FROM file_hashes fh WHERE fh.id = files.file_hash_id)"),
+	})
+
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected != int64(len(symlinkedFileIds)) {
+		return errors.New("could not symlink files in db")
+	}
+
+	return nil
+}
+
+// MaterialiseSymlinks replaces the symlinks created by the symlink ZAP mode with copies of the files in the ZAP folder
+func (ctx *Context) MaterialiseSymlinks(sourcePath string, restoreMetadata bool) error {
+	utils.ConsoleAndLogPrintf("Acquiring data...")
+	total, batches, err := ctx.GetBatchesOfIDs(QueryGetSymlinkedFileIds(), "f")
+
+	if err != nil {
+		return err
+	}
+
+	if len(batches) == 0 {
+		utils.ConsoleAndLogPrintf("No symlinks to materialise. Have you ZAPped with zap_mode: symlink?")
+		return nil
+	}
+
+	folder, err := ctx.openZapFolder(sourcePath)
+
+	if err != nil {
+		return err
+	}
+
+	if _, isLocal := folder.blobs.(*blobstore.Local); !isLocal {
+		return fmt.Errorf("symlinks can only point into a local ZAP folder, not \"%s\"", sourcePath)
+	}
+
+	utils.ConsoleAndLogPrintf("Materialising %s in %s", utils.Pluralize("symlink", total), utils.Pluralize("batch", int64(len(batches))))
+
+	bar := progressbar.Default(total)
+
+	for _, batch := range batches {
+		var filesToMaterialise []UnZapResult
+		result := ctx.DB.Raw(QueryGetSymlinkedFilesToMaterialise(), batch).Scan(&filesToMaterialise)
+
+		if result.Error != nil {
+			return result.Error
+		}
+
+		var materialisedFileIDs []uint
+
+		orchestrator := utils.NewTaskOrchestrator(bar, len(filesToMaterialise), ctx.Config.MaxConcurrentFileOperations)
+
+		for _, file := range filesToMaterialise {
+			orchestrator.StartTask()
+			go ctx.materialiseSymlink(orchestrator, folder, file, restoreMetadata, &materialisedFileIDs)
+		}
+
+		orchestrator.WaitForTasks()
+
+		if len(materialisedFileIDs) == 0 {
+			continue
+		}
+
+		result = ctx.DB.Model(&models.File{}).Where("id IN ?", materialisedFileIDs).Updates(map[string]interface{}{
+			"zapped":         false,
+			"link_type":      nil,
+			"linked_file_id": nil,
+		})
+
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if result.RowsAffected != int64(len(materialisedFileIDs)) {
+			return errors.New("could not materialise files in db")
+		}
+	}
+
+	return nil
+}
+
+func (ctx *Context) materialiseSymlink(orchestrator *utils.TaskOrchestrator, folder *zapFolder, file UnZapResult, restoreMetadata bool, materialisedFileIDs *[]uint) {
+	// MaterialiseSymlinks checks the ZAP folder is local
+	sourceFilePath, _ := folder.localPath(DecodeHash(file.Hash), "")
+
+	if !IsFile(sourceFilePath) {
+		log.Printf("Not materialising \"%s\" because \"%s\" was not found", file.AbsolutePath, sourceFilePath)
+		orchestrator.FinishTask()
+		return
+	}
+
+	info, err := os.Lstat(file.AbsolutePath)
+
+	// Anything other than a symlink has been replaced since ZAP-ping, so is left alone
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		log.Printf("Not materialising \"%s\" because it is no longer a symlink", file.AbsolutePath)
+		orchestrator.FinishTask()
+		return
+	}
+
+	// Copy alongside the symlink first, then rename over it so that the file is never missing
+	temporaryFilePath, err := temporaryPathAlongside(file.AbsolutePath, ".data-tools-copy")
+
+	if err == nil {
+		err = osCopy(sourceFilePath, temporaryFilePath)
+	}
+
+	if err == nil {
+		err = os.Rename(temporaryFilePath, file.AbsolutePath)
+	}
+
+	if err != nil {
+		_ = os.Remove(temporaryFilePath)
+		log.Fatalf("Could not materialise file \"%s\": %v", file.AbsolutePath, err)
+	}
+
+	if restoreMetadata {
+		err = ApplyMetadata(file.AbsolutePath, file.Metadata)
+
+		if err != nil {
+			log.Printf("Could not restore metadata of file \"%s\": %v", file.AbsolutePath, err)
+		}
+	}
+
+	orchestrator.Lock()
+	*materialisedFileIDs = append(*materialisedFileIDs, file.FileID)
+	orchestrator.Unlock()
+
+	orchestrator.FinishTask()
+}
+
+// relinkSymlinks points the symlinks created by the symlink ZAP mode at where the files in the ZAP folder are now, such
+// as after a relayout
+func (ctx *Context) relinkSymlinks(folder *zapFolder) error {
+	if _, isLocal := folder.blobs.(*blobstore.Local); !isLocal {
+		return nil
+	}
+
+	total, batches, err := ctx.GetBatchesOfIDs(QueryGetSymlinkedFileIds(), "f")
+
+	if err != nil {
+		return err
+	}
+
+	if len(batches) == 0 {
+		return nil
+	}
+
+	utils.ConsoleAndLogPrintf("Pointing %s at the new layout in %s", utils.Pluralize("symlink", total), utils.Pluralize("batch", int64(len(batches))))
+
+	bar := progressbar.Default(total)
+	failedCount := 0
+
+	for _, batch := range batches {
+		var filesToRelink []UnZapResult
+		result := ctx.DB.Raw(QueryGetSymlinkedFilesToMaterialise(), batch).Scan(&filesToRelink)
+
+		if result.Error != nil {
+			return result.Error
+		}
+
+		orchestrator := utils.NewTaskOrchestrator(bar, len(filesToRelink), ctx.Config.MaxConcurrentFileOperations)
+
+		for _, file := range filesToRelink {
+			orchestrator.StartTask()
+			go ctx.relinkSymlink(orchestrator, folder, file, &failedCount)
+		}
+
+		orchestrator.WaitForTasks()
+	}
+
+	if failedCount > 0 {
+		return fmt.Errorf("%s could not be pointed at the new layout, run relayout again to retry", utils.Pluralize("symlink", int64(failedCount)))
+	}
+
+	return nil
+}
+
+func (ctx *Context) relinkSymlink(orchestrator *utils.TaskOrchestrator, folder *zapFolder, file UnZapResult, failedCount *int) {
+	info, err := os.Lstat(file.AbsolutePath)
+
+	// Anything other than a symlink has been replaced since ZAP-ping, which the link integrity test deals with
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		log.Printf("Not pointing \"%s\" at the new layout because it is no longer a symlink", file.AbsolutePath)
+		orchestrator.FinishTask()
+		return
+	}
+
+	// relinkSymlinks checks the ZAP folder is local
+	zapFilePath, _ := folder.localPath(DecodeHash(file.Hash), "")
+	err = ctx.replaceWithSymlink(zapFilePath, file.AbsolutePath)
+
+	if err != nil {
+		log.Printf("Could not point \"%s\" at \"%s\": %v", file.AbsolutePath, zapFilePath, err)
+
+		orchestrator.Lock()
+		*failedCount++
+		orchestrator.Unlock()
+	}
+
+	orchestrator.FinishTask()
+}
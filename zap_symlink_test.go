@@ -0,0 +1,83 @@
+//go:build integration
+// +build integration
+
+package main
+
+import (
+	"data-tools/config"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+)
+
+func TestZapSymlinkShouldReplaceEveryFileWithASymlink(t *testing.T) {
+	tempTestDataPath := createTempTestDataPath(t)
+	defer os.RemoveAll(tempTestDataPath)
+
+	c := &config.Config{
+		DBPath:                      path.Join(tempTestDataPath, "db.db"),
+		BatchSize:                   5,
+		MaxConcurrentFileOperations: 2,
+		ZapDataPath:                 path.Join(tempTestDataPath, "ZAP"),
+		ZapMode:                     LinkTypeSymlink,
+		ZapRelativeSymlinks:         true,
+	}
+
+	ctx := &Context{
+		Config: c,
+		DB:     initDb(c),
+	}
+
+	dataPath := path.Join(tempTestDataPath, "a")
+	originalContent, err := os.ReadFile(path.Join(dataPath, "b", "j.txt"))
+	assert.NoError(t, err)
+
+	err = ctx.Crawl(dataPath)
+	assert.NoError(t, err)
+
+	err = ctx.HashFiles()
+	assert.NoError(t, err)
+
+	err = ctx.Zap()
+	assert.NoError(t, err)
+
+	// The folder structure is kept
+	folderCount, fileCount := getFolderAndFileTotalCount(t, dataPath)
+	assert.Equal(t, 3, folderCount)
+	assert.Equal(t, 5, fileCount)
+
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM files WHERE zapped = 1 AND link_type = 'symlink'", 5)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes WHERE zapped = 1", 3)
+
+	symlinkPath := path.Join(dataPath, "b", "j.txt")
+	info, err := os.Lstat(symlinkPath)
+	assert.NoError(t, err)
+	assert.NotZero(t, info.Mode()&os.ModeSymlink)
+
+	target, err := os.Readlink(symlinkPath)
+	assert.NoError(t, err)
+	assert.False(t, filepath.IsAbs(target))
+
+	content, err := os.ReadFile(symlinkPath)
+	assert.NoError(t, err)
+	assert.Equal(t, originalContent, content)
+
+	err = ctx.LinkIntegrityTest()
+	assert.NoError(t, err)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM files WHERE link_type = 'symlink'", 5)
+
+	err = ctx.MaterialiseSymlinks(c.ZapDataPath, true)
+	assert.NoError(t, err)
+
+	info, err = os.Lstat(symlinkPath)
+	assert.NoError(t, err)
+	assert.True(t, info.Mode().IsRegular())
+
+	content, err = os.ReadFile(symlinkPath)
+	assert.NoError(t, err)
+	assert.Equal(t, originalContent, content)
+
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM files WHERE zapped = 1 OR link_type IS NOT NULL", 0)
+}
@@ -0,0 +1,62 @@
+//go:build integration
+// +build integration
+
+package main
+
+import (
+	"data-tools/config"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestZapShouldKeepDuplicatesWhichChangedSinceHashing(t *testing.T) {
+	tempTestDataPath := createTempTestDataPath(t)
+	defer os.RemoveAll(tempTestDataPath)
+
+	c := &config.Config{
+		DBPath:                      path.Join(tempTestDataPath, "db.db"),
+		BatchSize:                   5,
+		MaxConcurrentFileOperations: 2,
+		ZapDataPath:                 path.Join(tempTestDataPath, "ZAP"),
+		VerifyBeforeDelete:          true,
+	}
+
+	ctx := &Context{
+		Config: c,
+		DB:     initDb(c),
+	}
+
+	dataPath := path.Join(tempTestDataPath, "a")
+	err := ctx.Crawl(dataPath)
+	assert.NoError(t, err)
+
+	err = ctx.HashFiles()
+	assert.NoError(t, err)
+
+	// Same size and modification time, different contents
+	changedFilePath := path.Join(dataPath, "b", "j.txt")
+	info, err := os.Stat(changedFilePath)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(changedFilePath, []byte("# Fil!"), 0644))
+	assert.NoError(t, os.Chtimes(changedFilePath, info.ModTime(), info.ModTime()))
+
+	err = ctx.Zap()
+	assert.NoError(t, err)
+
+	assert.True(t, IsFile(changedFilePath))
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM files WHERE hash_mismatch = 1 AND file_hash_id IS NULL AND zapped = 0", 1)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM files WHERE zapped = 1", 4)
+
+	// Hashing again picks up the change, so the file is ZAP-ped as a unique file
+	err = ctx.HashFiles()
+	assert.NoError(t, err)
+
+	err = ctx.Zap()
+	assert.NoError(t, err)
+
+	assert.False(t, IsFile(changedFilePath))
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM files WHERE zapped = 1", 5)
+	ctx.AssertDBCount(t, "SELECT COUNT(*) FROM file_hashes WHERE zapped = 1", 4)
+}